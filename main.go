@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"os/user"
+	"os/signal"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/korbexmachina/go-archive-it/utils"
@@ -15,8 +21,12 @@ import (
 
 func main() {
 	start := time.Now()
-	count := 0
+	var stats runStats
 	verbose := false
+	force := false // Archive vaults with skipUnchanged set even when they are unchanged
+	tag := ""
+	command := "" // Set by commands that work on the archives of the loaded config, instead of creating new ones
+	var commandArgs []string
 
 	configDir, err := os.UserHomeDir()
 	if err != nil {
@@ -32,17 +42,45 @@ func main() {
 	-h, help		Display this help message
 	-e, ext			Use external config file (~/.config/go-archive-it/ext.yaml)
 	-i, init [NAME]		Initialize named config file (~/.config/go-archive-it/[NAME].yaml)
+	    --template NAME	Start from a template (built in, or ~/.config/go-archive-it/templates/NAME.yaml)
+	    --set KEY=VALUE	Set a template variable instead of being asked for it
+	    --list-templates	List the available templates
 	-p, path [NAME]		Use named config file (~/.config/go-archive-it/[NAME].yaml)
+	-t, tag [TAG]		Tag the archives from this run (used by the {tag} token in naming templates)
 	-v, verbose		Verbose logging
+	-f, --force		Archive every vault, even the ones that are unchanged since their last archive (see skipUnchanged)
+	config migrate [NAME]	Rewrite a config file (default: config) in the current format, and move archives to their vault's directory
+	config validate [NAME]	Check a config file (default: config) for mistakes
+	list			List the archives of every vault
+	verify			Read back every archive and check that it is intact
+	repair			Rebuild damaged archives from their recovery data, and missing or damaged shards of erasure coded archives
+	verify -		Check an archive that is piped to stdin instead
+	restore VAULT [ARCHIVE]	Extract an archive of a vault (default: the newest one)
+	    --to DIR		Extract into DIR instead of a directory named after the archive
+	restore - --to DIR	Extract an archive that is piped to stdin into DIR
+	stream VAULT		Write an archive of a vault to stdout instead of its destinations
+	    --format FORMAT	Use FORMAT (tar, tar.gz or tar.zst) instead of the vault's format
+	watch			Keep running, and archive each vault once it has been quiet for a while after it changed
+	daemon			Keep running, and archive each vault with a schedule when it is due (reloads the config on SIGHUP)
+	sync			Copy archives from each vault's first destination to its other destinations
+	    --from DEST		Copy from DEST instead of the first destination
+	    --to DEST		Copy to DEST instead of the other destinations (may be repeated)
+	    --retention		Apply retention to the destinations that were copied to (only archives it would keep are copied)
 	---------------------------------
 	Running with no arguments will use the default config file (~/.config/go-archive-it/config.yaml)
 	`
 
-	if len(os.Args) < 2 {
+	args := os.Args[1:]
+	if len(args) == 0 {
 		log.Print("Running with no arguments\n")
-	} else {
+	}
+
+	// Options can be combined (e.g. -p work -v), commands like init and config exit once they are done
+	for len(args) > 0 {
+		arg := args[0]
+		args = args[1:]
 
-		switch os.Args[1] {
+		switch arg {
 		case "-h", "help":
 			fmt.Printf(helpMessage)
 			os.Exit(0)
@@ -50,69 +88,866 @@ func main() {
 			configPath = filepath.Join(configDir, "go-archive-it/ext.yaml")
 			log.Printf("Running with external config: %s", configPath)
 		case "-i", "init":
-			name := ""
-			if len(os.Args) < 3 || os.Args[2] == "" {
-				name = "go-archive-it/config"
-			} else {
-				name = "go-archive-it/" + os.Args[2]
-			}
-			utils.ConfigExists(filepath.Join(configDir, name+".yaml"))
+			initConfig(configDir, args)
 			os.Exit(0)
 		case "-p", "path":
-			name := "go-archive-it/" + os.Args[2]
+			if len(args) == 0 {
+				log.Fatalf("Missing config name for %s", arg)
+			}
+			name := "go-archive-it/" + args[0]
+			args = args[1:]
 			configPath = filepath.Join(configDir, name+".yaml")
 			log.Printf("Running with named config: %s", configPath)
+		case "-t", "tag":
+			if len(args) == 0 {
+				log.Fatalf("Missing tag for %s", arg)
+			}
+			tag = args[0]
+			args = args[1:]
 		case "-v", "verbose":
 			verbose = true
+		case "-f", "force", "--force":
+			force = true
+		case "list", "verify", "repair", "watch", "daemon":
+			command = arg
+			if arg == "verify" && len(args) > 0 && args[0] == "-" {
+				command, args = "verify -", args[1:]
+			}
+		case "sync", "restore", "stream":
+			command = arg
+			commandArgs, args = args, nil // Everything after the command is an option for it
+		case "config":
+			configCommand(configDir, args)
+			os.Exit(0)
 		default:
-			log.Fatalf("Unknown argument: %s", os.Args[1])
+			log.Fatalf("Unknown argument: %s", arg)
 		}
 	}
 
+	if command == "verify -" { // Doesn't need a config, the archive is all there is to check
+		if !verifyStdin() {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if command == "restore" && len(commandArgs) > 0 && commandArgs[0] == "-" {
+		if !restoreStdin(commandArgs[1:]) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	utils.ConfigExists(configPath)
 	config := utils.LoadConfig(configPath)
+	utils.CheckLegacyArchives(config)
+
+	switch command {
+	case "list":
+		if !listArchives(config) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "verify":
+		if !verifyArchives(config) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "repair":
+		if !repairArchives(config) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "restore":
+		if !restoreArchive(config, commandArgs) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "sync":
+		if !syncArchives(config, commandArgs, verbose) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "stream":
+		if !streamArchive(config, commandArgs) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "watch":
+		if !watchVaults(config, tag, verbose) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "daemon":
+		if !runDaemon(configPath, config, tag, verbose) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	var wg sync.WaitGroup
+	// The loop that actually runs everything
+	for _, vault := range config.Vaults {
+		wg.Add(1)
+		go func(vault utils.Vault) {
+			defer wg.Done()
+			archiveVault(vault, tag, force, verbose, &stats)
+		}(vault)
+	}
+
+	wg.Wait()
+	elapsed := time.Since(start)
+	log.Printf("%d Archive(s) created in [[ %f ]] seconds", stats.count, elapsed.Seconds())
+	if stats.skipped > 0 {
+		log.Printf("%d vault(s) were unchanged and skipped, run with --force to archive them anyway", stats.skipped)
+	}
+	if stats.unstable > 0 {
+		log.Printf("%d file(s) kept changing while they were archived, and may be incomplete in the archive", stats.unstable)
+	}
+	if stats.failures > 0 {
+		log.Printf("%d destination(s) failed", stats.failures)
+		os.Exit(1)
+	}
+}
+
+// runStats counts what happened to the vaults of a run, for its summary
+type runStats struct {
+	count    int32 // Vaults that were archived
+	failures int32 // Destinations that an archive could not be saved to
+	unstable int32 // Files that kept changing while they were archived
+	skipped  int32 // Vaults that were unchanged since their last archive
+}
+
+/*
+archiveVault runs a vault's hooks around archiving it, logs how it went, and applies retention to the destinations
+the archive was saved to
+
+It reports whether the vault is archived as it is now, either in a new archive saved to at least one destination,
+or in its last one when it was unchanged. A vault that another run is archiving is skipped, see LockVault.
+*/
+func archiveVault(vault utils.Vault, tag string, force bool, verbose bool, stats *runStats) bool {
+	unlock, err := utils.LockVault(vault)
+	if err != nil {
+		log.Printf("Skipping %s: %s", vault.Name, err)
+		return false
+	}
+	defer unlock()
+
+	run := utils.HookRun{Vault: vault}
+	run.Err = utils.RunHooks("pre", run)
+	if run.Err != nil {
+		log.Printf("Skipping %s: %s", vault.Name, run.Err)
+		finishHooks(run)
+		return false
+	}
 
-	usr, err := user.Current()
+	results, err := utils.Archive(vault, tag, force)
+	run.Results, run.Err = results, err
+	if err != nil {
+		log.Printf("[[ FAILED ]] %s: %s", vault.Name, err)
+		atomic.AddInt32(&stats.failures, int32(len(vault.Destinations)))
+		finishHooks(run)
+		return false
+	}
+	if len(results) > 0 && results[0].Skipped {
+		log.Printf("Skipping %s: unchanged since %s", vault.Name, results[0].Name)
+		atomic.AddInt32(&stats.skipped, 1)
+		finishHooks(run)
+		return true
+	}
+	saved := false
+	for _, result := range results {
+		if result.Err != nil {
+			log.Printf("[[ FAILED ]] %s to %s: %s", vault.Name, result.Destination, result.Err)
+			atomic.AddInt32(&stats.failures, 1)
+			continue
+		}
+		saved = true
+		if verbose {
+			log.Printf("Saved %s to %s (%d bytes)", result.Name, result.Destination, result.Size)
+		}
+	}
+	if saved {
+		atomic.AddInt32(&stats.count, 1)
+	}
+	if len(results) > 0 {
+		for _, file := range results[0].Unstable {
+			log.Printf("[[ UNSTABLE ]] %s/%s kept changing while it was read, it was archived as it was last read", vault.Name, file)
+		}
+		atomic.AddInt32(&stats.unstable, int32(len(results[0].Unstable)))
+	}
+	finishHooks(run)
+
+	for _, result := range results {
+		if result.Err != nil {
+			continue // Old archives are only removed once a new one has been saved next to them
+		}
+		err = utils.Cleanup(vault, result.Target, verbose)
+		if err != nil {
+			log.Printf("Failed to cleanup %s: %s", result.Destination, err)
+		}
+	}
+	return saved
+}
+
+// setFlags collects repeated --set KEY=VALUE flags
+type setFlags map[string]string
+
+func (s setFlags) String() string {
+	return fmt.Sprint(map[string]string(s))
+}
+
+func (s setFlags) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected KEY=VALUE, got %q", value)
+	}
+	s[key] = val
+	return nil
+}
+
+// listFlags collects a flag that may be repeated
+type listFlags []string
+
+func (l *listFlags) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *listFlags) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// initConfig handles the init command: init [NAME] [--template TEMPLATE] [--set KEY=VALUE]... [--list-templates]
+func initConfig(configDir string, args []string) {
+	name := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	values := setFlags{}
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	templateName := flags.String("template", "", "template to create the config from")
+	listTemplates := flags.Bool("list-templates", false, "list the available templates")
+	flags.Var(values, "set", "template variable as KEY=VALUE, may be repeated")
+	flags.Parse(args)
+	if name == "" {
+		name = flags.Arg(0)
+	}
+	if name == "" {
+		name = "config"
+	}
+
+	configPath := filepath.Join(configDir, "go-archive-it", name+".yaml")
+	templatesDir := filepath.Join(configDir, "go-archive-it", "templates")
+
+	if *listTemplates {
+		templates, err := utils.ListTemplates(templatesDir)
+		if err != nil {
+			log.Fatalf("Failed to list templates: %s", err)
+		}
+		for _, t := range templates {
+			fmt.Printf("%-16s %s\n", t.Name, t.Description)
+		}
+		return
+	}
+
+	if *templateName == "" {
+		utils.ConfigExists(configPath)
+		return
+	}
+
+	t, err := utils.LoadTemplate(*templateName, templatesDir)
 	if err != nil {
 		log.Fatal(err)
 	}
-	dir := usr.HomeDir
+	var input io.Reader
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		input = os.Stdin // Only ask questions when someone is there to answer them
+	}
+	err = utils.InitConfig(configPath, t, values, input)
+	if err != nil {
+		log.Fatalf("Failed to create config: %s", err)
+	}
+}
 
-	archivePath := config.ArchivePath
-	if archivePath == "~" {
-		archivePath = dir
-	} else if strings.HasPrefix(archivePath, "~/") {
-		archivePath = filepath.Join(dir, archivePath[2:])
+// configCommand handles the config commands: config migrate [NAME] and config validate [NAME]
+func configCommand(configDir string, args []string) {
+	if len(args) < 1 {
+		log.Fatal("Missing config command, expected: migrate or validate")
 	}
+	name := "go-archive-it/config"
+	if len(args) > 1 && args[1] != "" {
+		name = "go-archive-it/" + args[1]
+	}
+	path := filepath.Join(configDir, name+".yaml")
 
-	var wg sync.WaitGroup
-	// The loop that actually runs everything
-	for _, path := range config.VaultPath {
-		count++
-		// Tilda expansion
-		if path == "~" {
-			path = dir
-		} else if strings.HasPrefix(path, "~/") {
-			path = filepath.Join(dir, path[2:])
+	switch args[0] {
+	case "migrate":
+		err := utils.MigrateConfig(path)
+		if err != nil {
+			log.Fatalf("Failed to migrate config: %s", err)
+		}
+		err = utils.MigrateArchives(utils.LoadConfig(path))
+		if err != nil {
+			log.Fatalf("Failed to migrate archives: %s", err)
+		}
+	case "validate":
+		_, errs := utils.ValidateConfig(path)
+		if len(errs) > 0 {
+			for _, err := range errs {
+				fmt.Printf("%s: %s\n", path, err)
+			}
+			os.Exit(1)
 		}
+		fmt.Printf("%s is valid\n", path)
+	default:
+		log.Fatalf("Unknown config command: %s", args[0])
+	}
+}
 
-		wg.Add(1)
-		go func(path string) {
-			defer wg.Done()
-			utils.Archive(path, archivePath, config.ArchiveType)
-		}(path)
+// listArchives prints the archives of every vault in the config, and reports whether every destination could be listed
+func listArchives(config utils.Config) bool {
+	ok := true
+	for _, vault := range config.Vaults {
+		for _, target := range vault.AllDestinations() {
+			dest, err := utils.OpenDestination(target.Destination, vault.Name)
+			if err != nil {
+				log.Fatalf("Failed to open destination: %s", err)
+			}
+			archives, err := utils.ListArchives(vault, dest)
+			dest.Close()
+			if err != nil {
+				log.Printf("Failed to list %s: %s", dest, err)
+				ok = false
+				continue
+			}
 
-		wg.Add(1)
-		go func(path string) {
-			defer wg.Done()
-			err := utils.Cleanup(filepath.Join(archivePath, filepath.Base(path)), config.Retention, verbose)
+			fmt.Printf("%s (%s)\n", vault.Name, dest)
+			for _, archive := range archives {
+				fmt.Printf("  %-40s %12d  %s\n", archive.Name, archive.Size, archive.ModTime.Local().Format(time.RFC3339))
+			}
+		}
+	}
+	return ok
+}
+
+// verifyArchives checks every archive of every vault in the config, and reports whether they were all intact
+func verifyArchives(config utils.Config) bool {
+	ok := true
+	for _, vault := range config.Vaults {
+		dests := openDestinations(vault)
+		for _, dest := range dests {
+			archives, err := utils.ListArchives(vault, dest)
 			if err != nil {
-				log.Fatalf("Failed to cleanup: %s", err)
+				log.Printf("[[ FAILED ]] %s: %s", dest, err)
+				ok = false
+				continue
+			}
+
+			for _, archive := range archives {
+				if archive.IsSharded() {
+					continue // Erasure coded, it is checked along with the rest of its shards
+				}
+				files, err := utils.VerifyArchive(dest, archive)
+				if err != nil {
+					log.Printf("[[ FAILED ]] %s/%s: %s", dest, archive.Name, err)
+					ok = false
+					continue
+				}
+				log.Printf("[[ OK ]] %s/%s (%d files)", dest, archive.Name, files)
 			}
-		}(path)
+		}
+
+		sharded, err := utils.FindShardedArchives(vault, dests)
+		if err != nil {
+			ok = false // Already reported above
+		}
+		for _, archive := range sharded {
+			files, err := utils.VerifyShardedArchive(archive)
+			if err != nil {
+				log.Printf("[[ FAILED ]] %s/%s: %s", vault.Name, archive.Name, err)
+				logShards(archive)
+				ok = false
+				continue
+			}
+			if missing := archive.Missing(); len(missing) > 0 {
+				log.Printf("[[ DEGRADED ]] %s/%s (%d files): %d of %d shards missing or damaged, run repair to rebuild them", vault.Name, archive.Name, files, len(missing), archive.Total)
+				logShards(archive)
+				ok = false
+				continue
+			}
+			log.Printf("[[ OK ]] %s/%s (%d files, %d shards)", vault.Name, archive.Name, files, archive.Total)
+		}
+		closeDestinations(dests)
 	}
+	return ok
+}
 
-	wg.Wait()
-	elapsed := time.Since(start)
-	log.Printf("%d Archive(s) created in [[ %f ]] seconds", count, elapsed.Seconds())
+// logShards logs what is wrong with each of an erasure coded archive's shards
+func logShards(archive *utils.ShardedArchive) {
+	for _, i := range archive.Missing() {
+		if shard := archive.Shards[i]; shard != nil {
+			log.Printf("  shard %d in %s: %s", i+1, shard.Dest, shard.Err)
+		} else {
+			log.Printf("  shard %d: missing", i+1)
+		}
+	}
+}
+
+// repairArchives rebuilds damaged archives from their recovery data, and the missing and damaged shards of erasure coded archives,
+// and reports whether every archive is whole
+func repairArchives(config utils.Config) bool {
+	ok := true
+	repaired := 0
+	for _, vault := range config.Vaults {
+		dests := openDestinations(vault)
+		for _, dest := range dests {
+			archives, err := utils.ListArchives(vault, dest)
+			if err != nil {
+				log.Printf("[[ FAILED ]] %s: %s", dest, err)
+				ok = false
+				continue
+			}
+			for _, archive := range archives {
+				if !archive.HasRecovery() {
+					continue // Nothing to repair it with
+				}
+				done, err := repairArchive(vault, dest, archive)
+				if err != nil {
+					log.Printf("[[ FAILED ]] %s/%s: %s", dest, archive.Name, err)
+					ok = false
+				} else if done != "" {
+					log.Printf("[[ REPAIRED ]] %s/%s: %s", dest, archive.Name, done)
+					repaired++
+				}
+			}
+		}
+
+		sharded, err := utils.FindShardedArchives(vault, dests)
+		if err != nil {
+			ok = false // Already reported above
+		}
+		for _, archive := range sharded {
+			err := archive.Check()
+			if err == nil {
+				var rebuilt int
+				rebuilt, err = utils.RepairShardedArchive(archive, dests[:len(vault.Destinations)])
+				if rebuilt > 0 {
+					log.Printf("[[ REPAIRED ]] %s/%s: rebuilt %d shard(s)", vault.Name, archive.Name, rebuilt)
+					repaired++
+				}
+			}
+			if err != nil {
+				log.Printf("[[ FAILED ]] %s/%s: %s", vault.Name, archive.Name, err)
+				logShards(archive)
+				ok = false
+			}
+		}
+		closeDestinations(dests)
+	}
+	if repaired == 0 && ok {
+		log.Print("Nothing to repair")
+	}
+	return ok
+}
+
+// repairArchive repairs an archive that has recovery data, and returns what it did ("" when the archive was intact)
+func repairArchive(vault utils.Vault, dest utils.Destination, archive utils.ArchiveInfo) (string, error) {
+	_, err := utils.VerifyArchive(dest, archive)
+	var damage *utils.DamagedError
+	switch {
+	case err == nil:
+		return "", nil
+	case errors.As(err, &damage) && damage.Repairable:
+		blocks, err := utils.RepairArchive(dest, archive)
+		if err != nil {
+			return "", err
+		}
+		if blocks == 0 {
+			return "trimmed it back to its original size", nil
+		}
+		return fmt.Sprintf("rebuilt %d block(s)", blocks), nil
+	case errors.Is(err, utils.ErrRecoveryDamaged):
+		if vault.Recovery < 1 {
+			return "", fmt.Errorf("%w, set recovery to make it again", utils.ErrRecoveryDamaged)
+		}
+		err = utils.RebuildRecovery(dest, archive, vault.Recovery)
+		if err != nil {
+			return "", err
+		}
+		return "made new recovery data", nil
+	default:
+		return "", err
+	}
+}
+
+// restoreArchive handles the restore command: restore VAULT [ARCHIVE] [--to DIR], and reports whether the archive was extracted
+func restoreArchive(config utils.Config, args []string) bool {
+	var positional []string
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") && len(positional) < 2 {
+		positional, args = append(positional, args[0]), args[1:]
+	}
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	to := flags.String("to", "", "directory to extract into, instead of one named after the archive")
+	flags.Parse(args)
+	positional = append(positional, flags.Args()...)
+	if len(positional) == 0 || len(positional) > 2 {
+		log.Fatal("Usage: restore VAULT [ARCHIVE] [--to DIR]")
+	}
+
+	var vault *utils.Vault
+	for i := range config.Vaults {
+		if config.Vaults[i].Name == positional[0] {
+			vault = &config.Vaults[i]
+		}
+	}
+	if vault == nil {
+		log.Fatalf("No vault named %s", positional[0])
+	}
+	name := ""
+	if len(positional) > 1 {
+		name = positional[1]
+	}
+
+	reader, archive, err := utils.OpenArchive(*vault, name)
+	if err != nil {
+		log.Printf("[[ FAILED ]] %s", err)
+		return false
+	}
+	defer reader.Close()
+
+	dir := *to
+	if dir == "" {
+		dir = archive.Name
+		for _, format := range []string{utils.FormatTarGz, utils.FormatTarZst, utils.FormatTar} {
+			if strings.HasSuffix(dir, "."+format) {
+				dir = strings.TrimSuffix(dir, "."+format)
+				break
+			}
+		}
+	}
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		log.Printf("[[ FAILED ]] %s is not empty, restore into an empty or new directory", dir)
+		return false
+	}
+
+	files, err := utils.Extract(reader, archive.Name, dir)
+	if err != nil {
+		log.Printf("[[ FAILED ]] restoring %s to %s after %d files: %s", archive.Name, dir, files, err)
+		return false
+	}
+	log.Printf("Restored %s to %s (%d files)", archive.Name, dir, files)
+	return true
+}
+
+// restoreStdin handles restore - --to DIR, and extracts the archive that is piped to stdin
+func restoreStdin(args []string) bool {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	to := flags.String("to", "", "directory to extract into")
+	flags.Parse(args)
+	if *to == "" || flags.NArg() > 0 {
+		log.Fatal("Usage: restore - --to DIR")
+	}
+	if isTerminal(os.Stdin) {
+		log.Fatal("Nothing is piped to stdin, e.g. ssh host cat archive.tar.gz | go-archive-it restore - --to DIR")
+	}
+	if entries, err := os.ReadDir(*to); err == nil && len(entries) > 0 {
+		log.Printf("[[ FAILED ]] %s is not empty, restore into an empty or new directory", *to)
+		return false
+	}
+
+	format, r, err := utils.SniffFormat(os.Stdin)
+	if err != nil {
+		log.Printf("[[ FAILED ]] reading stdin: %s", err)
+		return false
+	}
+	files, err := utils.Extract(r, utils.StreamName(format), *to)
+	if err != nil {
+		log.Printf("[[ FAILED ]] restoring to %s after %d files: %s", *to, files, err)
+		return false
+	}
+	log.Printf("Restored a %s archive to %s (%d files)", format, *to, files)
+	return true
+}
+
+// verifyStdin handles verify -, and checks the archive that is piped to stdin
+func verifyStdin() bool {
+	if isTerminal(os.Stdin) {
+		log.Fatal("Nothing is piped to stdin, e.g. ssh host cat archive.tar.gz | go-archive-it verify -")
+	}
+	files, format, err := utils.VerifyStream(os.Stdin)
+	if err != nil {
+		log.Printf("[[ FAILED ]] stdin: %s", err)
+		return false
+	}
+	log.Printf("[[ OK ]] stdin (%s, %d files)", format, files)
+	return true
+}
+
+// streamArchive handles the stream command: stream VAULT [--format FORMAT], and writes the vault's archive to stdout
+func streamArchive(config utils.Config, args []string) bool {
+	var name string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	flags := flag.NewFlagSet("stream", flag.ExitOnError)
+	format := flags.String("format", "", "archive format (tar, tar.gz or tar.zst), instead of the vault's")
+	flags.Parse(args)
+	if name == "" && flags.NArg() == 1 {
+		name = flags.Arg(0)
+	} else if name == "" || flags.NArg() > 0 {
+		log.Fatal("Usage: stream VAULT [--format FORMAT]")
+	}
+	if isTerminal(os.Stdout) {
+		log.Fatal("Refusing to write an archive to a terminal, pipe it into a file or another program")
+	}
+
+	var vault *utils.Vault
+	for i := range config.Vaults {
+		if config.Vaults[i].Name == name {
+			vault = &config.Vaults[i]
+		}
+	}
+	if vault == nil {
+		log.Fatalf("No vault named %s", name)
+	}
+
+	run := utils.HookRun{Vault: *vault}
+	run.Err = utils.RunHooks("pre", run)
+	if run.Err == nil {
+		run.Err = utils.StreamArchive(*vault, *format, os.Stdout)
+	}
+	if run.Err != nil {
+		log.Printf("[[ FAILED ]] %s: %s", vault.Name, run.Err)
+	}
+	finishHooks(run)
+	return run.Err == nil
+}
+
+// watchVaults handles the watch command, and archives vaults as they change until it is interrupted
+func watchVaults(config utils.Config, tag string, verbose bool) bool {
+	var vaults []utils.Vault
+	for _, vault := range config.Vaults {
+		if vault.Command != "" {
+			log.Printf("Not watching %s: it is a command vault, there is nothing to watch", vault.Name)
+			continue
+		}
+		vaults = append(vaults, vault)
+	}
+	if len(vaults) == 0 {
+		log.Print("No vaults to watch")
+		return false
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	log.Printf("Watching %d vault(s), press Ctrl+C to stop", len(vaults))
+	var stats runStats
+	err := utils.WatchVaults(ctx, vaults, func(vault utils.Vault) bool {
+		log.Printf("%s changed, archiving it", vault.Name)
+		return archiveVault(vault, tag, false, verbose, &stats)
+	})
+	if err != nil {
+		log.Printf("Failed to watch: %s", err)
+		return false
+	}
+	log.Printf("Stopped watching, %d archive(s) created", stats.count)
+	return true
+}
+
+/*
+runDaemon handles the daemon command, and archives the vaults with a schedule when they are due until it is stopped
+
+The config is read again on SIGHUP, and kept as it was when the new one has mistakes. Under systemd (Type=notify), it
+reports when it is ready, reloading and stopping, and what is up next.
+*/
+func runDaemon(configPath string, config utils.Config, tag string, verbose bool) bool {
+	scheduled := 0
+	for _, vault := range config.Vaults {
+		if vault.Schedule.Cron != "" {
+			scheduled++
+		}
+	}
+	if scheduled == 0 {
+		log.Print("No vault has a schedule, add one to run them with the daemon (see schedule in the README)")
+		return false
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	reload := make(chan []utils.Vault)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				utils.SystemdNotify("STOPPING=1")
+				return
+			case <-hangup:
+			}
+			utils.SystemdNotify("RELOADING=1")
+			log.Printf("Reloading %s", configPath)
+			config, errs := utils.ValidateConfig(configPath)
+			for _, err := range errs {
+				log.Printf("%s: %s", configPath, err)
+			}
+			if len(errs) > 0 {
+				log.Print("Invalid config file, keeping the one that was loaded")
+			} else {
+				select {
+				case reload <- config.Vaults:
+				case <-ctx.Done():
+				}
+			}
+			utils.SystemdNotify("READY=1")
+		}
+	}()
+	go utils.SystemdWatchdog(ctx)
+
+	log.Printf("Running %d vault(s) on their schedules, press Ctrl+C to stop", scheduled)
+	var stats runStats
+	utils.SystemdNotify("READY=1")
+	utils.RunSchedules(ctx, config.Vaults, reload, func(vault utils.Vault) {
+		log.Printf("%s is due, archiving it", vault.Name)
+		archiveVault(vault, tag, false, verbose, &stats)
+	})
+	log.Printf("Stopped, %d archive(s) created", stats.count)
+	return true
+}
+
+// finishHooks runs a vault's post hooks, then its onSuccess or onFailure hooks, and logs the ones that fail
+func finishHooks(run utils.HookRun) {
+	hooks := []string{"post", "onSuccess"}
+	if run.Failed() {
+		hooks[1] = "onFailure"
+	}
+	for _, hook := range hooks {
+		err := utils.RunHooks(hook, run)
+		if err != nil {
+			log.Printf("Hook for %s: %s", run.Vault.Name, err)
+		}
+	}
+}
+
+// isTerminal reports whether a file is a terminal, rather than a pipe, a file or /dev/null
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(info, null)
+}
+
+// openDestinations opens every destination of a vault, in the order of vault.AllDestinations
+func openDestinations(vault utils.Vault) []utils.Destination {
+	var dests []utils.Destination
+	for _, target := range vault.AllDestinations() {
+		dest, err := utils.OpenDestination(target.Destination, vault.Name)
+		if err != nil {
+			log.Fatalf("Failed to open destination: %s", err)
+		}
+		dests = append(dests, dest)
+	}
+	return dests
+}
+
+func closeDestinations(dests []utils.Destination) {
+	for _, dest := range dests {
+		dest.Close()
+	}
+}
+
+// syncArchives handles the sync command: sync [--from DEST] [--to DEST]... [--retention], and reports whether everything was copied
+func syncArchives(config utils.Config, args []string, verbose bool) bool {
+	var to listFlags
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	from := flags.String("from", "", "destination to copy from, instead of each vault's first destination")
+	flags.Var(&to, "to", "destination to copy to, instead of each vault's other destinations, may be repeated")
+	retention := flags.Bool("retention", false, "apply retention to the destinations that were copied to")
+	flags.Parse(args)
+
+	// Destinations given on the command line are relative to the working directory
+	cwd, err := os.Getwd()
+	if err != nil {
+		log.Fatal(err)
+	}
+	expand := func(destination string) string {
+		expanded, err := utils.ExpandDestination(destination, cwd)
+		if err != nil {
+			log.Fatalf("Bad destination %s: %s", destination, err)
+		}
+		return expanded
+	}
+
+	ok := true
+	pairs := 0
+	for _, vault := range config.Vaults {
+		if vault.Erasure.Enabled() {
+			log.Printf("Skipping %s, its archives are erasure coded across its destinations instead of copied to each, see repair", vault.Name)
+			continue
+		}
+		source := vault.Destinations[0]
+		if *from != "" {
+			source = utils.Target{Destination: expand(*from), Retention: vault.Retention}
+		}
+		targets := vault.Destinations[1:]
+		if len(to) > 0 {
+			targets = nil
+			for _, destination := range to {
+				target := utils.Target{Destination: expand(destination), Retention: vault.Retention}
+				for _, configured := range vault.AllDestinations() {
+					if configured.Destination == target.Destination {
+						target = configured // Keeps the retention set in the config
+					}
+				}
+				targets = append(targets, target)
+			}
+		}
+
+		src, err := utils.OpenDestination(source.Destination, vault.Name)
+		if err != nil {
+			log.Fatalf("Failed to open destination: %s", err)
+		}
+		for _, target := range targets {
+			if target.Destination == source.Destination {
+				continue
+			}
+			pairs++
+			dst, err := utils.OpenDestination(target.Destination, vault.Name)
+			if err != nil {
+				log.Fatalf("Failed to open destination: %s", err)
+			}
+
+			newest := 0
+			if *retention {
+				newest = target.Retention
+			}
+			copied, err := utils.SyncArchives(vault, src, dst, newest, verbose)
+			dst.Close()
+			if err != nil {
+				log.Printf("[[ FAILED ]] syncing %s to %s: %s", src, dst, err)
+				ok = false
+				continue // Retention is left alone, so nothing is removed while the copies are incomplete
+			}
+			log.Printf("Copied %d archive(s) from %s to %s", copied, src, dst)
+
+			if *retention {
+				err = utils.Cleanup(vault, target, verbose)
+				if err != nil {
+					log.Printf("Failed to cleanup %s: %s", dst, err)
+					ok = false
+				}
+			}
+		}
+		src.Close()
+	}
+
+	if pairs == 0 {
+		log.Print("Nothing to sync, give a destination with --to or add more destinations to your vaults")
+	}
+	return ok
 }
@@ -8,91 +8,332 @@ package utils
 import (
 	"archive/tar"
 	"compress/gzip"
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"time"
+
+	"github.com/klauspost/compress/zstd"
 )
 
 /*
-Archive takes 3 arguments, and calls the appropriate archive function, passing on it's other arguments.
+Archive takes a vault, and calls the appropriate archive function for the vault's format.
 
 args:
 
-	vaultPath string: The path to the directory that will be archived
-	archivePath string: The name of the directory where all of the archives are to be stored
-	archiveType uint8: The type of archive that is to be created
-		- 0 = .tar
-		- 1 = .tar.gz
+	vault Vault: The vault that will be archived, with the defaults from the config already applied
+		- Path: The path to the directory that will be archived
+		- Destinations: The directories (or URLs, see OpenDestination) where all of the archives are to be stored
+		- Format: The type of archive that is to be created ("tar", "tar.gz" or "tar.zst")
+		- Naming: The naming template for the archive file, see ArchiveName
+		- Exclude: Patterns for files and directories that are left out of the archive
+	tag string: The value of the {tag} token in the naming template
+	force bool: Archive the vault even when it is unchanged, see skipUnchanged
+
+Archive returns how writing to each of the vault's destinations went, in the same order as vault.Destinations.
+When the vault uses erasure coding, each destination gets some of the archive's shards instead of a copy, see archiveShards.
+The archive is only produced once, and streamed to every destination at the same time. A destination that fails is
+dropped and the others carry on, so the results have to be checked one by one. The error is for problems producing
+the archive itself, in which case it was not saved anywhere.
+
+With vault.Recovery set, recovery data for the archive is made as it is written (see newRecoveryEncoder), kept in a
+temporary file, and saved next to the archive in every destination. With vault.MaxVolumeSize set, the archive is
+written as volumes of at most that size instead of a single file (see createArchive).
 
-This function does not return a value and logs it's own errors.
+Files that change while they are read are read again, up to vault.FileRetries times, and the ones that never held still
+are archived as they were last read and listed in each result's Unstable (see fileReader).
 
-Archive creates any directories neccesary for it to function.
+With vault.SkipUnchanged set, a manifest of the vault's files is saved next to the archive in every destination, and
+when it matches the newest archive's everywhere nothing is archived: every result is Skipped, and named after that
+archive (see unchangedSince). Command vaults are always archived, there is no telling what their command would output.
+
+Archive creates any directories neccesary for it to function. The archive only appears in a destination once it is complete,
+and its size is checked with Stat before it counts as saved.
 */
-func Archive(vaultPath string, archivePath string, archiveType uint8) {
-	fullPath := filepath.Join(archivePath, filepath.Base(vaultPath)) // Path to subdir in the archive dir
-	time := time.Now().Format(time.RFC3339)
+func Archive(vault Vault, tag string, force bool) ([]TargetResult, error) {
+	format := vault.Format
+	switch format {
+	case FormatTar, FormatTarGz, FormatTarZst:
+	default:
+		return nil, fmt.Errorf("unknown archive format %q", format) // LoadConfig rejects these, so this should never happen
+	}
 
-	err := os.MkdirAll(fullPath, 0755) // Create the subdir in the archive dir
-	if err != nil {
-		log.Fatalf("Failed to create archive directory: %s", err)
+	results := make([]TargetResult, len(vault.Destinations))
+	dests := make([]Destination, len(vault.Destinations))
+	taken := make(map[string]bool)
+	for i, target := range vault.Destinations {
+		results[i] = TargetResult{Target: target, Destination: redactDestination(target.Destination)}
+		dest, err := OpenDestination(target.Destination, vault.Name)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		defer dest.Close()
+		results[i].Destination = dest.String()
+
+		existing, err := dest.List()
+		if err != nil {
+			results[i].Err = fmt.Errorf("listing: %w", err)
+			continue
+		}
+		for _, archive := range existing {
+			taken[archive.Name] = true
+			if name, _, ok := archivePart(archive.Name); ok {
+				taken[name] = true
+			}
+		}
+		dests[i] = dest
 	}
 
-	switch archiveType {
-	case 0:
-		fileName := time + ".tar" // Name of the tar file "2006-01-02T15:04:05Z07:00.tar"
-		_, err := os.Create(filepath.Join(fullPath, fileName))
+	var manifest []byte
+	if vault.SkipUnchanged != "" && vault.Command == "" {
+		var err error
+		manifest, err = makeManifest(vault)
 		if err != nil {
-			log.Fatal(err)
+			return results, fmt.Errorf("listing the vault's files: %w", err)
+		}
+		if last := unchangedSince(vault, dests, manifest, time.Now()); last != "" && !force {
+			for i := range results {
+				results[i].Name = last
+				results[i].Skipped = true
+			}
+			return results, nil
 		}
-		outfile, err := os.OpenFile(filepath.Join(fullPath, fileName), os.O_APPEND|os.O_WRONLY, os.ModeAppend)
+	}
+
+	// The same name is used everywhere, so it has to be free in every destination
+	fileName, err := ArchiveName(vault, tag, time.Now(), func(name string) bool { return taken[name] })
+	if err != nil {
+		return results, err
+	}
+
+	files := newFileReader(vault)
+	produce := func(w io.Writer) error {
+		return writeArchive(vault, format, w, files)
+	}
+	for i := range results {
+		results[i].Name = fileName
+	}
+
+	if vault.Erasure.Enabled() {
+		err = archiveShards(vault.Erasure, fileName, dests, results, produce)
 		if err != nil {
-			log.Fatal(err)
+			return results, fmt.Errorf("creating %s archive: %w", format, err)
 		}
-		defer outfile.Close()
-		err = tarArchive(vaultPath, outfile)
+		for i, dest := range dests {
+			if manifest != nil && results[i].Err == nil {
+				err = upload(dest, fileName+manifestSuffix, manifestReader(manifest))
+				if err != nil {
+					results[i].Err = fmt.Errorf("saving the manifest: %w", err)
+				}
+			}
+		}
+		files.report(results)
+		return results, nil
+	}
+
+	var volumeSize int64
+	if vault.MaxVolumeSize != "" {
+		volumeSize, err = parseSize(vault.MaxVolumeSize)
 		if err != nil {
-			log.Fatalf("Failed to create tar archive: %s", err)
+			return results, err // LoadConfig rejects these, so this should never happen
 		}
-	case 1:
-		fileName := time + ".tar.gz" // Name of the gztar file "2006-01-02T15:04:05Z07:00.tar.gz"
-		_, err := os.Create(filepath.Join(fullPath, fileName))
+	}
+
+	out := &fanOut{}
+	for i, dest := range dests {
+		if dest == nil {
+			continue
+		}
+		writer, err := createArchive(dest, fileName, volumeSize)
 		if err != nil {
-			log.Fatal(err)
+			results[i].Err = err
+			continue
+		}
+		out.targets = append(out.targets, &fanOutTarget{dest: dest, writer: writer, result: &results[i]})
+	}
+	if len(out.targets) == 0 {
+		return results, nil // Every destination already failed, there is nothing to write to
+	}
+
+	var recovery *os.File
+	var encoder *recoveryEncoder
+	var archiveOut io.Writer = out
+	if vault.Recovery > 0 {
+		recovery, err = os.CreateTemp("", "go-archive-it-*"+recoverySuffix)
+		if err == nil {
+			defer os.Remove(recovery.Name())
+			defer recovery.Close()
+			encoder, err = newRecoveryEncoder(recovery, vault.Recovery)
 		}
-		outfile, err := os.OpenFile(filepath.Join(fullPath, fileName), os.O_APPEND|os.O_WRONLY, os.ModeAppend)
 		if err != nil {
-			log.Fatal(err)
+			out.abort(err)
+			return results, fmt.Errorf("creating recovery data: %w", err)
+		}
+		archiveOut = io.MultiWriter(out, encoder)
+	}
+
+	err = produce(archiveOut)
+	if err == nil && encoder != nil {
+		err = encoder.Close()
+	}
+	if err != nil && !out.allFailed() {
+		out.abort(err)
+		return results, fmt.Errorf("creating %s archive: %w", format, err)
+	}
+
+	for _, target := range out.targets {
+		if target.result.Err != nil {
+			continue
 		}
-		defer outfile.Close()
-		err = gztarArchive(vaultPath, outfile)
+		err := target.writer.Close()
 		if err != nil {
-			log.Fatalf("Failed to create gztar archive: %s", err)
+			target.result.Err = fmt.Errorf("saving %s: %w", fileName, err)
+			continue
 		}
-	default:
-		log.Print("No archive type specified, defaulting to .tar.gz")
-		fileName := time + ".tar.gz" // Name of the gztar file "2006-01-02T15:04:05Z07:00.tar.gz"
-		_, err := os.Create(filepath.Join(fullPath, fileName))
+		size, err := savedSize(target.dest, fileName, target.writer)
 		if err != nil {
-			log.Fatal(err)
+			target.result.Err = fmt.Errorf("checking %s: %w", fileName, err)
+			continue
+		}
+		if size != target.written {
+			target.result.Err = fmt.Errorf("%s is %d bytes, but %d were written", fileName, size, target.written)
+			continue
+		}
+		target.result.Size = size
+
+		if recovery != nil {
+			err = uploadFile(target.dest, fileName+recoverySuffix, recovery)
+			if err != nil {
+				target.result.Err = fmt.Errorf("saving recovery data: %w", err)
+				continue
+			}
+		}
+		if manifest != nil {
+			err = upload(target.dest, fileName+manifestSuffix, manifestReader(manifest))
+			if err != nil {
+				target.result.Err = fmt.Errorf("saving the manifest: %w", err)
+			}
+		}
+	}
+	files.report(results)
+	return results, nil
+}
+
+// TargetResult is how writing an archive to one of a vault's destinations went
+type TargetResult struct {
+	Target      Target
+	Destination string // The destination as it is shown in log messages
+	Name        string // The archive's file name
+	Size        int64
+	Err         error
+	Unstable    []string // Files that kept changing while they were read, relative to the vault (see fileReader)
+	Skipped     bool     // Nothing changed since the archive in Name, so no archive was made (see skipUnchanged)
+}
+
+/*
+fanOut writes an archive to several destinations at once
+
+A destination whose write fails is aborted and left out of any further writes, the write only fails once
+there is no destination left to write to.
+*/
+type fanOut struct {
+	targets []*fanOutTarget
+}
+
+type fanOutTarget struct {
+	dest    Destination
+	writer  ArchiveWriter
+	result  *TargetResult
+	written int64
+}
+
+func (f *fanOut) Write(p []byte) (int, error) {
+	var lastErr error
+	for _, target := range f.targets {
+		if target.result.Err != nil {
+			continue
+		}
+		n, err := target.writer.Write(p)
+		target.written += int64(n)
+		if err == nil && n < len(p) {
+			err = io.ErrShortWrite
 		}
-		outfile, err := os.OpenFile(filepath.Join(fullPath, fileName), os.O_APPEND|os.O_WRONLY, os.ModeAppend)
 		if err != nil {
-			log.Fatal(err)
+			target.result.Err = fmt.Errorf("writing: %w", err)
+			target.writer.Abort()
+			lastErr = err
+		}
+	}
+	if f.allFailed() {
+		return 0, fmt.Errorf("every destination failed, the last with: %w", lastErr)
+	}
+	return len(p), nil
+}
+
+// allFailed reports whether every destination has failed
+func (f *fanOut) allFailed() bool {
+	for _, target := range f.targets {
+		if target.result.Err == nil {
+			return false
 		}
-		defer outfile.Close()
-		err = gztarArchive(vaultPath, outfile)
+	}
+	return true
+}
+
+// abort throws away the archive in every destination that is still being written to
+func (f *fanOut) abort(err error) {
+	for _, target := range f.targets {
+		if target.result.Err == nil {
+			target.result.Err = err
+			target.writer.Abort()
+		}
+	}
+}
+
+// writeArchive writes an archive of a vault in the given format to w, files reads the vault's files (see fileReader)
+func writeArchive(vault Vault, format string, w io.Writer, files *fileReader) error {
+	if vault.Command != "" {
+		return commandArchive(vault, format, w)
+	}
+	if vault.Git != "" {
+		return gitArchive(vault, format, w, files)
+	}
+	return compressed(format, w, func(w io.Writer) error {
+		return tarArchive(vault.Path, w, vault.Exclude, files)
+	})
+}
+
+// compressed compresses what write writes to w, as the format says
+func compressed(format string, w io.Writer, write func(io.Writer) error) error {
+	switch format {
+	case FormatTarGz:
+		gw := gzip.NewWriter(w)
+		err := write(gw)
+		if closeErr := gw.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	case FormatTarZst:
+		zw, err := zstd.NewWriter(w)
 		if err != nil {
-			log.Fatalf("Failed to create gztar archive: %s", err)
+			return err
+		}
+		err = write(zw)
+		if closeErr := zw.Close(); err == nil {
+			err = closeErr
 		}
+		return err
+	default:
+		return write(w)
 	}
-	return
 }
 
-func tarArchive(vaultPath string, archive io.Writer) error {
+// tarArchive writes a tar archive of a vault's directory to archive, compressed() wraps it in the vault's format
+func tarArchive(vaultPath string, archive io.Writer, exclude []string, files *fileReader) error {
 	tw := tar.NewWriter(archive)
-	defer tw.Close()
 
 	// Check if the vaultPath is a symlink
 	isSymlink, err := isSymlink(vaultPath)
@@ -111,8 +352,20 @@ func tarArchive(vaultPath string, archive io.Writer) error {
 	// Traverse the directory and all of its subdirectories and add each file found to the archive
 	err = filepath.Walk(vaultPath,
 		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if path != vaultPath && isExcluded(path, vaultPath, exclude) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if isSQLiteCompanion(path) {
+				return nil // The database's snapshot already has what is in it
+			}
 			if !info.IsDir() {
-				err = addFile(tw, path, vaultPath)
+				err = addFile(tw, path, vaultPath, exclude, files)
 				if err != nil {
 					return err
 				}
@@ -122,47 +375,59 @@ func tarArchive(vaultPath string, archive io.Writer) error {
 	if err != nil {
 		return err
 	}
-	return nil
+	return tw.Close() // Writes the end of the archive, which a reader needs to know it is complete
 }
 
 /*
-gztarArchive takes 2 arguments
-
-```
-args:
-- vaultPath string: The path to the directory being archived
-- archive io.writer: An io.Writer
-```
+isExcluded reports whether a path matches any of the exclude patterns
 
-gztarArchive initializes a ne gzip writer, and chains it onto a tar writer by calling tarArchive
+Patterns are matched against the path relative to the vault, and against the base name alone,
+so "*.tmp" excludes temporary files anywhere in the vault while ".obsidian/cache" only excludes that directory.
 */
-func gztarArchive(vaultPath string, archive io.Writer) error {
-	gw := gzip.NewWriter(archive)
-	defer gw.Close()
-	err := tarArchive(vaultPath, gw) // Chaining the writers
+func isExcluded(path string, vaultPath string, exclude []string) bool {
+	rel, err := filepath.Rel(vaultPath, path)
 	if err != nil {
-		return err
+		return false
 	}
-	return nil
+	for _, pattern := range exclude {
+		if ok, _ := filepath.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, filepath.Base(path)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func addFile(tw *tar.Writer, name string, vaultPath string, exclude []string, files *fileReader) error {
+	if isSQLite(name) {
+		return addSQLite(tw, name, vaultPath, exclude, files) // A live database can't be copied as it is, see snapshotSQLite
+	}
+	return copyFile(tw, name, vaultPath, files)
 }
 
-func addFile(tw *tar.Writer, name string, vaultPath string) error {
-	file, err := os.Open(name)
+// copyFile adds a file to the archive as it is, read by files so that it isn't torn by changes made while it is read
+func copyFile(tw *tar.Writer, name string, vaultPath string, files *fileReader) error {
+	rel, err := filepath.Rel(vaultPath, name)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	// get file info
-	fileInfo, err := file.Stat()
+	contents, info, err := files.read(name, rel)
 	if err != nil {
 		return err
 	}
+	defer contents.Close()
+	return addFileFrom(tw, name, vaultPath, info, contents, contents.size)
+}
 
+// addFileFrom adds a file to the archive with the contents of source (size bytes), which is a copy of the file
+func addFileFrom(tw *tar.Writer, name string, vaultPath string, fileInfo os.FileInfo, source io.Reader, size int64) error {
 	tarHeader, err := tar.FileInfoHeader(fileInfo, fileInfo.Name())
 	if err != nil {
 		return err
 	}
+	tarHeader.Size = size
 
 	tarHeader.Name, err = filepath.Rel(vaultPath, name) // Preserving directory structure relative to the directory being archived
 	if err != nil {
@@ -174,7 +439,7 @@ func addFile(tw *tar.Writer, name string, vaultPath string) error {
 		return err
 	}
 
-	_, err = io.Copy(tw, file) // Add file contents to archive
+	_, err = io.Copy(tw, source) // Add file contents to archive
 	if err != nil {
 		return err
 	}
@@ -186,48 +451,109 @@ func addFile(tw *tar.Writer, name string, vaultPath string) error {
 Cleanup takes 3 arguments and returns an error
 
 args:
-archivePath string: The path to the archive that is being cleaned up
-retention uint8: The number of archives that should be retained
+vault Vault: The vault whose archives are being cleaned up
+target Target: The destination that is cleaned up, one of vault.Destinations (or the vault's cold tier)
 verbose bool: whether or not the verbose flag was specified
 
+Cleanup removes the oldest archives from the destination until no more than target.Retention are left.
+It is meant to run after the vault has been archived, so the new archive counts towards retention.
+Only files that are named like archives (by the vault's naming template, or the RFC3339 names that older versions used)
+are counted or removed, anything else in the archive directory is left alone. See ListArchives.
+
+When the vault has a cold tier, the archives past retention (and any older than the tier's Age) are moved to it instead
+of being removed, and then the cold tier's own retention is applied. A cold tier without a retention keeps everything.
+
 Cleanup returns an error if something goes wrong
 */
-func Cleanup(archivePath string, retention uint8, verbose bool) error {
-	files, err := os.ReadDir(archivePath)
-	if len(files) < int(retention) {
-		return nil
-	} else {
-		if verbose == true {
-			log.Printf("Retention cap [[ %d ]] exceeded - Cleaning up %s...", retention, archivePath)
-		}
+func Cleanup(vault Vault, target Target, verbose bool) error {
+	retention := target.Retention
+	if retention < 1 {
+		return nil // Only a cold tier can go without retention
 	}
+	dest, err := OpenDestination(target.Destination, vault.Name)
 	if err != nil {
 		return err
 	}
+	defer dest.Close()
 
-	oldestFile, err := files[0].Info()
+	archives, err := ListArchives(vault, dest)
 	if err != nil {
 		return err
 	}
-	oldest := time.Now()
-	for _, file := range files[1:] {
-		info, err := file.Info()
+	cold := vault.Cold
+	tiered := cold.Destination != "" && cold.Destination != target.Destination
+	age := 0
+	if tiered {
+		age = cold.Age
+	}
+	expired := expiredArchives(archives, retention, age, time.Now())
+	if len(expired) == 0 {
+		return nil
+	}
+
+	if tiered {
+		coldDest, err := OpenDestination(cold.Destination, vault.Name)
 		if err != nil {
 			return err
 		}
-		if info.ModTime().Before(oldest) {
-			oldestFile = info
-			oldest = info.ModTime()
+		defer coldDest.Close()
+		if verbose == true {
+			log.Printf("Moving %d archive(s) from %s to %s...", len(expired), dest, coldDest)
+		}
+		for _, archive := range expired {
+			err = MoveArchive(dest, coldDest, archive)
+			if err != nil {
+				return fmt.Errorf("moving %s to %s: %w", archive.Name, coldDest, err)
+			}
 		}
+		return Cleanup(vault, cold.Target(), verbose)
 	}
 
-	os.Remove(filepath.Join(archivePath, oldestFile.Name()))
 	if verbose == true {
-		log.Printf("%s succesfully cleaned up!", archivePath)
+		log.Printf("Retention cap [[ %d ]] exceeded - Cleaning up %s...", retention, dest)
+	}
+	for _, archive := range expired {
+		err = deleteArchive(dest, archive)
+		if err != nil {
+			return err
+		}
+	}
+	if verbose == true {
+		log.Printf("%s succesfully cleaned up!", dest)
+	}
+	return nil
+}
+
+// deleteArchive removes an archive from a destination, along with all of its parts and the files that belong with it
+func deleteArchive(dest Destination, archive ArchiveInfo) error {
+	files := archive.Parts
+	if len(files) == 0 {
+		files = []ArchiveInfo{archive}
+	}
+	for _, file := range append(append([]ArchiveInfo{}, files...), archive.Sidecars...) {
+		err := dest.Delete(file.Name)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// expiredArchives returns the archives (sorted oldest first) past the newest retention, or older than age days when age is set
+func expiredArchives(archives []ArchiveInfo, retention int, age int, now time.Time) []ArchiveInfo {
+	count := 0
+	if len(archives) > retention {
+		count = len(archives) - retention
+	}
+	if age > 0 {
+		cutoff := now.AddDate(0, 0, -age)
+		for count < len(archives) && archives[count].ModTime.Before(cutoff) {
+			count++
+		}
+	}
+	return archives[:count]
+}
+
 // isSymlink takes a path as an argument and returns a bool and an error
 // isSymlink returns true if the path is a symlink, and false if it is not
 func isSymlink(path string) (bool, error) {
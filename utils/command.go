@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+)
+
+/*
+commandArchive writes an archive of a command vault to w, in the given format
+
+The vault's command is run with `sh -c` in the user's home directory. With vault.File set, its output is stored in the
+archive as a file of that name, otherwise the output has to be a tar stream (like `ssh host tar -cf - dir`), which
+is compressed into the archive as it is. Either way the archive fails when the command exits with an error, so a
+truncated dump is never saved. What the command writes to stderr is logged.
+*/
+func commandArchive(vault Vault, format string, w io.Writer) error {
+	return compressed(format, w, func(w io.Writer) error {
+		return commandTar(vault, w)
+	})
+}
+
+// commandTar runs a command vault's command, and writes the tar archive of its output to w
+func commandTar(vault Vault, w io.Writer) error {
+	if vault.File == "" {
+		checker := &tarChecker{w: w}
+		err := runCommand(vault, checker)
+		if checker.err != nil {
+			return checker.err // The command was stopped by it, which is less helpful to report
+		}
+		if err == nil && !checker.checked {
+			return errNotTar
+		}
+		return err
+	}
+
+	// The size goes in the tar header before the file, so the output is collected first
+	out, err := os.CreateTemp("", "go-archive-it-*.out")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	started := time.Now()
+	err = runCommand(vault, out)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	err = addOutput(tw, vault.File, out, started)
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// addOutput adds a temporary file that a command wrote its output to (up to where it is at) to the archive, as name
+func addOutput(tw *tar.Writer, name string, out *os.File, modTime time.Time) error {
+	size, err := out.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0o600, // Dumps tend to hold everything in a database, so they are only readable by their owner
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, io.NewSectionReader(out, 0, size))
+	return err
+}
+
+// runCommand runs a command vault's command with its output going to w
+func runCommand(vault Vault, w io.Writer) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command("sh", "-c", vault.Command)
+	cmd.Dir = vault.workDir()
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if stderr.Len() > 0 {
+		log.Printf("[command] %s %s:\n%s", vault.Name, vault.Command, stderr.Bytes())
+	}
+	if err != nil {
+		return fmt.Errorf("command %q failed: %w", vault.Command, err)
+	}
+	return nil
+}
+
+/*
+tarChecker passes a command's output through, once its first block has been checked to be a tar header
+
+Without it, a vault with a command that doesn't output a tar stream (and no file) would save archives that can't be
+read back.
+*/
+type tarChecker struct {
+	w       io.Writer
+	header  []byte
+	checked bool
+	err     error
+}
+
+var errNotTar = errors.New("the output is not a tar stream, set file to store it as a file in the archive")
+
+func (t *tarChecker) Write(p []byte) (int, error) {
+	if t.checked {
+		return t.w.Write(p)
+	}
+	n := minInt(len(p), 512-len(t.header))
+	t.header = append(t.header, p[:n]...)
+	if len(t.header) < 512 {
+		return len(p), nil
+	}
+	if string(t.header[257:262]) != "ustar" {
+		t.err = errNotTar
+		return 0, t.err
+	}
+	t.checked = true
+	_, err := t.w.Write(t.header)
+	if err != nil {
+		return 0, err
+	}
+	_, err = t.w.Write(p[n:])
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,152 @@
+//go:build !windows
+
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// makeTar returns a tar archive of the files
+func makeTar(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for name, data := range files {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(data))})
+		if err == nil {
+			_, err = tw.Write([]byte(data))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archive.Bytes()
+}
+
+func TestCommandArchive(t *testing.T) {
+	files := map[string]string{"notes/a.md": "some notes\n", "notes/b.md": strings.Repeat("more notes\n", 1000)}
+	tarred := makeTar(t, files) // Once, the order of the files in it changes with every call
+	stream := filepath.Join(t.TempDir(), "stream.tar")
+	err := os.WriteFile(stream, tarred, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		command string
+		file    string
+		want    map[string]string
+	}{
+		{"file", "printf 'CREATE TABLE notes;'", "notes.sql", map[string]string{"notes.sql": "CREATE TABLE notes;"}},
+		{"empty file", "true", "notes.sql", map[string]string{"notes.sql": ""}},
+		{"tar stream", "cat " + stream, "", files},
+		{"tar stream as a file", "cat " + stream, "notes.tar", map[string]string{"notes.tar": string(tarred)}},
+	}
+	for _, test := range tests {
+		vault := Vault{Name: "db", Command: test.command, File: test.file}
+		for _, format := range []string{FormatTar, FormatTarGz, FormatTarZst} {
+			var archive bytes.Buffer
+			err := commandArchive(vault, format, &archive)
+			if err != nil {
+				t.Errorf("%s as %s: %s", test.name, format, err)
+				continue
+			}
+			if got := tarFiles(t, archive.Bytes(), format); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s as %s: the archive has %d files that don't match", test.name, format, len(got))
+			}
+		}
+	}
+}
+
+func TestCommandArchiveFails(t *testing.T) {
+	stream := filepath.Join(t.TempDir(), "stream.tar")
+	err := os.WriteFile(stream, makeTar(t, map[string]string{"a.md": strings.Repeat("notes\n", 1000)}), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		command string
+		file    string
+		want    string
+	}{
+		{"a file from a failing command", "printf 'CREATE TABLE'; exit 3", "notes.sql", "exit status 3"},
+		{"a tar stream from a failing command", "cat " + stream + "; exit 3", "", "exit status 3"},
+		{"a command that isn't there", "no-such-command-gai", "notes.sql", "exit status 127"},
+		{"text", "echo hello", "", errNotTar.Error()},
+		{"no output", "true", "", errNotTar.Error()},
+		{"a lot of text", "yes | head -c 1000000", "", errNotTar.Error()},
+	}
+	for _, test := range tests {
+		vault := Vault{Name: "db", Command: test.command, File: test.file}
+		err := commandArchive(vault, FormatTar, io.Discard)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: commandArchive gave %v, expected %q", test.name, err, test.want)
+		}
+	}
+
+	// Nothing is saved when the command fails
+	dir := t.TempDir()
+	vault := Vault{Name: "db", Command: "printf 'CREATE TABLE'; exit 3", File: "notes.sql", Settings: Settings{
+		Format:       FormatTarGz,
+		Destinations: []Target{{Destination: dir, Retention: 3}},
+	}}
+	results, err := Archive(vault, "", false)
+	if err == nil && (len(results) != 1 || results[0].Err == nil) {
+		t.Errorf("Archive saved the output of a failing command: %+v", results)
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, vault.Name))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("Archive left %s behind", entry.Name())
+	}
+}
+
+func TestTarChecker(t *testing.T) {
+	archive := makeTar(t, map[string]string{"a.md": strings.Repeat("notes\n", 200)})
+	for _, size := range []int{1, 100, 511, 512, 513, len(archive)} {
+		var out bytes.Buffer
+		checker := &tarChecker{w: &out}
+		for rest := archive; len(rest) > 0; {
+			n := minInt(size, len(rest))
+			written, err := checker.Write(rest[:n])
+			if err != nil || written != n {
+				t.Fatalf("writing %d bytes at a time: wrote %d of %d (%v)", size, written, n, err)
+			}
+			rest = rest[n:]
+		}
+		if !checker.checked || !bytes.Equal(out.Bytes(), archive) {
+			t.Errorf("writing %d bytes at a time: passed %d of %d bytes on", size, out.Len(), len(archive))
+		}
+	}
+
+	var out bytes.Buffer
+	checker := &tarChecker{w: &out}
+	text := bytes.Repeat([]byte("not a tar header\n"), 40)
+	_, err := checker.Write(text[:300]) // Not a whole block yet
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checker.Write(text[300:]); !errors.Is(err, errNotTar) {
+		t.Errorf("tarChecker took text for a tar header (%v)", err)
+	}
+	if out.Len() > 0 {
+		t.Errorf("tarChecker passed %d bytes of text on", out.Len())
+	}
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
@@ -9,14 +10,204 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
+// ConfigVersion is the current version of the configuration schema
+const ConfigVersion = 2
+
+// Archive formats understood by Archive
+const (
+	FormatTar    = "tar"
+	FormatTarGz  = "tar.gz"
+	FormatTarZst = "tar.zst"
+)
+
 // Config is a struct used to parse configuration files
 type Config struct {
+	Version  int             `yaml:"version"`
+	Defaults Settings        `yaml:"defaults"`
+	Vaults   []Vault         `yaml:"vaults"`
+	Discover []DiscoveryRule `yaml:"discover,omitempty"`
+}
+
+/*
+Settings holds the options that can be set for every vault, or once in the defaults
+
+A vault is archived to either a single Destination, or to every one of its Destinations. applyDefaults folds Destination
+into Destinations, so once a config is loaded Destinations is the only one that needs to be looked at.
+*/
+type Settings struct {
+	Destination   string   `yaml:"destination,omitempty"`
+	Destinations  []Target `yaml:"destinations,omitempty"`
+	Format        string   `yaml:"format,omitempty"`
+	Naming        string   `yaml:"naming,omitempty"`
+	Retention     int      `yaml:"retention,omitempty"`
+	Exclude       []string `yaml:"exclude,omitempty"`
+	Hooks         Hooks    `yaml:"hooks,omitempty"`
+	Cold          Tier     `yaml:"cold,omitempty"`
+	Erasure       Erasure  `yaml:"erasure,omitempty"`
+	Recovery      int      `yaml:"recovery,omitempty"`
+	MaxVolumeSize string   `yaml:"maxVolumeSize,omitempty"`
+	FileRetries   int      `yaml:"fileRetries,omitempty"`
+	Git           string   `yaml:"git,omitempty"`           // GitFiles or GitBundle, for vaults that are git repositories
+	SkipUnchanged string   `yaml:"skipUnchanged,omitempty"` // SkipMetadata or SkipHash, see unchangedSince
+	ArchiveEvery  string   `yaml:"archiveEvery,omitempty"`  // EveryDay, EveryWeek or EveryMonth, archives unchanged vaults anyway
+	Watch         Watch    `yaml:"watch,omitempty"`
+	Schedule      Schedule `yaml:"schedule,omitempty"`
+}
+
+/*
+Target is one of the destinations a vault is archived to, with its own retention
+
+In the config file a target is either just the destination, or a mapping that also sets the retention
+(which otherwise comes from the vault):
+
+	destinations:
+	  - ~/archive
+	  - destination: s3://backups/{hostname}
+	    retention: 30
+*/
+type Target struct {
+	Destination string `yaml:"destination"`
+	Retention   int    `yaml:"retention,omitempty"`
+}
+
+/*
+Tier is a cold destination that archives are moved to as they age, instead of being removed by retention
+
+Archives past a destination's retention, or older than Age days, are copied to the tier, checked, and only then removed
+from where they were. The tier has its own Retention, and keeps every archive when it isn't set.
+*/
+type Tier struct {
+	Destination string `yaml:"destination,omitempty"`
+	Age         int    `yaml:"age,omitempty"`
+	Retention   int    `yaml:"retention,omitempty"`
+}
+
+/*
+Erasure splits every archive into Data shards plus Parity Reed-Solomon shards, spread over the vault's destinations
+
+Any Data of the shards are enough to rebuild the archive. Shard i is stored in destination i modulo the number of destinations,
+so with as many destinations as shards, up to Parity destinations can be lost.
+*/
+type Erasure struct {
+	Data   int `yaml:"data,omitempty"`
+	Parity int `yaml:"parity,omitempty"`
+}
+
+// Enabled reports whether archives are erasure coded
+func (erasure Erasure) Enabled() bool {
+	return erasure.Data > 0 || erasure.Parity > 0
+}
+
+// Target returns the tier as a Target, for the code that works on any of a vault's destinations
+func (tier Tier) Target() Target {
+	return Target{Destination: tier.Destination, Retention: tier.Retention}
+}
+
+// workDir is the directory that the vault's command and hooks run in
+func (vault Vault) workDir() string {
+	if vault.Path != "" {
+		return vault.Path
+	}
+	home, _ := os.UserHomeDir()
+	return home
+}
+
+// AllDestinations returns the vault's destinations, followed by its cold tier if it has one
+func (vault Vault) AllDestinations() []Target {
+	if vault.Cold.Destination == "" {
+		return vault.Destinations
+	}
+	return append(append([]Target{}, vault.Destinations...), vault.Cold.Target())
+}
+
+// UnmarshalYAML accepts a target written as a plain string
+func (target *Target) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&target.Destination)
+	}
+	type plain Target // Without the UnmarshalYAML method, so decoding doesn't recurse
+	return node.Decode((*plain)(target))
+}
+
+/*
+Vault is a single directory to be archived, along with its own settings
+
+Path may also be a glob pattern (e.g. ~/notes/*), in which case every directory it matches is archived as a vault of its own.
+A vault can have a Command instead of a Path, in which case its archive holds the command's output (see commandArchive).
+*/
+type Vault struct {
+	Name     string `yaml:"name,omitempty"`
+	Path     string `yaml:"path,omitempty"`
+	Command  string `yaml:"command,omitempty"`
+	File     string `yaml:"file,omitempty"` // The name of the command's output in the archive, without it the output is the tar stream itself
+	Settings `yaml:",inline"`
+
+	discover *discovery // Set while the vault stands in for a discovery rule
+}
+
+// Hooks are shell commands that are run around archiving a vault, see RunHooks
+type Hooks struct {
+	Pre       []string `yaml:"pre,omitempty"`
+	Post      []string `yaml:"post,omitempty"`
+	OnSuccess []string `yaml:"onSuccess,omitempty"`
+	OnFailure []string `yaml:"onFailure,omitempty"`
+	Timeout   string   `yaml:"timeout,omitempty"` // For each command, e.g. 30s or 5m
+}
+
+// Watch is when the watch command archives a vault after it changes, see WatchVaults
+type Watch struct {
+	Quiet       string `yaml:"quiet,omitempty"`       // How long the vault has to go without changes, e.g. 5m
+	MinInterval string `yaml:"minInterval,omitempty"` // How long after its last archive the vault is archived again at the soonest, e.g. 1h
+}
+
+/*
+Schedule is when the daemon command archives a vault, see RunSchedules
+
+In the config file a schedule is either just the cron expression, or a mapping that also sets the jitter:
+
+	schedule: "0 3 * * *"
+	schedule:
+	  cron: "@daily"
+	  jitter: 15m
+*/
+type Schedule struct {
+	Cron   string `yaml:"cron,omitempty"`   // See cronSchedule
+	Jitter string `yaml:"jitter,omitempty"` // Up to how long after its time the vault is archived, picked at random every time, e.g. 10m
+}
+
+// UnmarshalYAML accepts a schedule written as a plain cron expression
+func (schedule *Schedule) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&schedule.Cron)
+	}
+	type plain Schedule // Without the UnmarshalYAML method, so decoding doesn't recurse
+	return node.Decode((*plain)(schedule))
+}
+
+// configV1 is the original flat configuration schema, kept so that old files can still be loaded
+type configV1 struct {
 	VaultPath   []string
 	ArchivePath string
 	ArchiveType uint8
 	Retention   uint8
 }
 
+// DefaultConfig returns the config that is written when no config file exists
+func DefaultConfig() Config {
+	return Config{
+		Version: ConfigVersion,
+		Defaults: Settings{
+			Destination: "~/archive",
+			Format:      FormatTarGz,
+			Retention:   10,
+		},
+		Vaults: []Vault{
+			{Path: "~/example"},
+			{Path: "~/directories"},
+		},
+	}
+}
+
 /*
 ConfigExists checks if a config file exists at a specified location
 
@@ -31,14 +222,7 @@ func ConfigExists(configPath string) {
 			log.Fatalf("Unable to create directory: %v", err)
 		}
 
-		config := Config{
-			VaultPath:   []string{"~/example", "~/directories"},
-			ArchivePath: "~/archive",
-			ArchiveType: 1,
-			Retention:   10,
-		}
-
-		c, err := yaml.Marshal(config) // Serialize the struct
+		c, err := yaml.Marshal(DefaultConfig()) // Serialize the struct
 		if err != nil {
 			log.Fatalf("Failed to serialize data: %v", err)
 		}
@@ -55,19 +239,253 @@ func ConfigExists(configPath string) {
 	}
 }
 
-// LoadConfig reads and unmarshals a yaml file given a path, it returns a Config struct with the data from the file
+/*
+LoadConfig reads and unmarshals a yaml file given a path, it returns a Config struct with the data from the file
+
+The file is checked with ValidateConfig, and every problem is logged before exiting if it is not valid.
+Version 1 files are converted to the current schema on the fly, and the defaults are applied to every vault,
+so the returned Config can be used without looking at Config.Defaults again.
+*/
 func LoadConfig(configPath string) Config {
-	var config Config
+	config, errs := ValidateConfig(configPath)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("%s: %s", configPath, err)
+		}
+		log.Fatalf("Invalid config file %s, run `go-archive-it config validate` after fixing it", configPath)
+	}
+	if config.Version < ConfigVersion {
+		log.Printf("%s uses config version %d, run `go-archive-it config migrate` to update it", configPath, config.Version)
+	}
+	return config
+}
 
+// parseConfig unmarshals a config file of any known version into the current schema
+func parseConfig(file []byte) (Config, error) {
+	var probe struct {
+		Version int `yaml:"version"`
+	}
+	err := yaml.Unmarshal(file, &probe)
+	if err != nil {
+		return Config{}, err
+	}
+
+	switch probe.Version {
+	case 0, 1: // Files written before the schema was versioned have no version key
+		var old configV1
+		err = yaml.Unmarshal(file, &old)
+		if err != nil {
+			return Config{}, err
+		}
+		return old.upgrade(), nil
+	case ConfigVersion:
+		var config Config
+		err = yaml.Unmarshal(file, &config)
+		return config, err
+	default:
+		return Config{}, fmt.Errorf("unsupported config version %d", probe.Version)
+	}
+}
+
+// upgrade converts a version 1 config into the current schema
+func (old configV1) upgrade() Config {
+	config := Config{
+		Version: 1,
+		Defaults: Settings{
+			Destination: old.ArchivePath,
+			Format:      archiveTypeFormat(old.ArchiveType),
+			Retention:   int(old.Retention),
+		},
+	}
+	for _, path := range old.VaultPath {
+		config.Vaults = append(config.Vaults, Vault{Path: path})
+	}
+	return config
+}
+
+// archiveTypeFormat maps the version 1 archivetype numbers onto format names
+func archiveTypeFormat(archiveType uint8) string {
+	switch archiveType {
+	case 0:
+		return FormatTar
+	default:
+		return FormatTarGz
+	}
+}
+
+// applyDefaults fills in every vault setting that was left empty from Config.Defaults
+func (config *Config) applyDefaults() {
+	for i := range config.Vaults {
+		vault := &config.Vaults[i]
+		if vault.Destination == "" && len(vault.Destinations) == 0 {
+			vault.Destination = config.Defaults.Destination
+			vault.Destinations = config.Defaults.Destinations
+		}
+		if vault.Format == "" {
+			vault.Format = config.Defaults.Format
+		}
+		if vault.Format == "" {
+			vault.Format = FormatTarGz
+		}
+		if vault.Naming == "" {
+			vault.Naming = config.Defaults.Naming
+		}
+		if vault.Naming == "" {
+			vault.Naming = DefaultNaming
+		}
+		if vault.Retention == 0 {
+			vault.Retention = config.Defaults.Retention
+		}
+		targets := append([]Target{}, vault.Destinations...) // The defaults' targets are shared by every vault, so they are copied
+		if vault.Destination != "" {
+			targets = append(targets, Target{Destination: vault.Destination})
+		}
+		for j := range targets {
+			if targets[j].Retention == 0 {
+				targets[j].Retention = vault.Retention
+			}
+		}
+		vault.Destination, vault.Destinations = "", targets
+		if vault.Cold.Destination == "" {
+			vault.Cold.Destination = config.Defaults.Cold.Destination
+		}
+		if vault.Cold.Age == 0 {
+			vault.Cold.Age = config.Defaults.Cold.Age
+		}
+		if vault.Cold.Retention == 0 {
+			vault.Cold.Retention = config.Defaults.Cold.Retention
+		}
+		if !vault.Erasure.Enabled() {
+			vault.Erasure = config.Defaults.Erasure
+		}
+		if vault.Recovery == 0 {
+			vault.Recovery = config.Defaults.Recovery
+		}
+		if vault.MaxVolumeSize == "" {
+			vault.MaxVolumeSize = config.Defaults.MaxVolumeSize
+		}
+		if vault.FileRetries == 0 {
+			vault.FileRetries = config.Defaults.FileRetries
+		}
+		if vault.Git == "" {
+			vault.Git = config.Defaults.Git
+		}
+		if vault.SkipUnchanged == "" {
+			vault.SkipUnchanged = config.Defaults.SkipUnchanged
+		}
+		if vault.ArchiveEvery == "" {
+			vault.ArchiveEvery = config.Defaults.ArchiveEvery
+		}
+		if vault.Watch.Quiet == "" {
+			vault.Watch.Quiet = config.Defaults.Watch.Quiet
+		}
+		if vault.Watch.MinInterval == "" {
+			vault.Watch.MinInterval = config.Defaults.Watch.MinInterval
+		}
+		if vault.Schedule.Cron == "" {
+			vault.Schedule.Cron = config.Defaults.Schedule.Cron
+		}
+		if vault.Schedule.Jitter == "" {
+			vault.Schedule.Jitter = config.Defaults.Schedule.Jitter
+		}
+		vault.Exclude = append(append([]string{}, config.Defaults.Exclude...), vault.Exclude...)
+		vault.Hooks.Pre = append(append([]string{}, config.Defaults.Hooks.Pre...), vault.Hooks.Pre...)
+		vault.Hooks.Post = append(append([]string{}, config.Defaults.Hooks.Post...), vault.Hooks.Post...)
+		vault.Hooks.OnSuccess = append(append([]string{}, config.Defaults.Hooks.OnSuccess...), vault.Hooks.OnSuccess...)
+		vault.Hooks.OnFailure = append(append([]string{}, config.Defaults.Hooks.OnFailure...), vault.Hooks.OnFailure...)
+		if vault.Hooks.Timeout == "" {
+			vault.Hooks.Timeout = config.Defaults.Hooks.Timeout
+		}
+	}
+}
+
+// expandError is a vault setting that could not be expanded
+type expandError struct {
+	key    string
+	value  string
+	target int // The index of the target, for destinations
+	err    error
+}
+
+func (e expandError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.key, e.value, e.err)
+}
+
+/*
+expandPaths runs every vault's path and destinations through ExpandPath
+
+It returns the index of each vault that could not be expanded, along with the error, so they can be reported
+against the right part of the config file.
+*/
+func (config *Config) expandPaths(configDir string) map[int]expandError {
+	errs := make(map[int]expandError)
+	for i := range config.Vaults {
+		vault := &config.Vaults[i]
+		path, err := ExpandPath(vault.Path, configDir)
+		if err != nil {
+			errs[i] = expandError{"path", vault.Path, 0, err}
+			continue
+		}
+		vault.Path = path
+
+		for j := range vault.Destinations {
+			target := &vault.Destinations[j]
+			destination, err := ExpandDestination(target.Destination, configDir)
+			if err != nil {
+				errs[i] = expandError{"destination", target.Destination, j, err}
+				break
+			}
+			target.Destination = destination
+		}
+
+		if vault.Cold.Destination != "" {
+			destination, err := ExpandDestination(vault.Cold.Destination, configDir)
+			if err != nil {
+				errs[i] = expandError{"cold", vault.Cold.Destination, 0, err}
+				continue
+			}
+			vault.Cold.Destination = destination
+		}
+	}
+	return errs
+}
+
+/*
+MigrateConfig rewrites a config file in the current schema
+
+The original file is kept next to the new one with a .v1.bak suffix. Files that are already
+up to date are left alone.
+*/
+func MigrateConfig(configPath string) error {
 	file, err := ioutil.ReadFile(configPath)
 	if err != nil {
-		log.Fatalf("Unable to read file: %v", err)
+		return err
+	}
+
+	config, err := parseConfig(file)
+	if err != nil {
+		return err
+	}
+	if config.Version == ConfigVersion {
+		log.Printf("%s is already at config version %d", configPath, ConfigVersion)
+		return nil
 	}
+	config.Version = ConfigVersion
 
-	err = yaml.Unmarshal(file, &config)
+	c, err := yaml.Marshal(config)
 	if err != nil {
-		log.Fatalf("Unable to parse file: %v", err)
+		return err
 	}
 
-	return config
+	err = ioutil.WriteFile(configPath+".v1.bak", file, 0664)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(configPath, c, 0664)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Migrated %s to config version %d, the old file was saved as %s", configPath, ConfigVersion, configPath+".v1.bak")
+	return nil
 }
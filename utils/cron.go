@@ -0,0 +1,199 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+cronSchedule is a parsed cron expression, in the usual five fields:
+
+	minute  hour  day-of-month  month  day-of-week
+
+Each field is *, a number, a range (1-5), a step over either of those (1-30/2 runs every other value), or a list
+of those (1,15). Months and days of the week can be given by name (jan, mon), and Sunday is 0 or 7. When both day
+fields are restricted, a day that matches either of them is run on, like cron does. @yearly, @monthly, @weekly,
+@daily and @hourly stand for the usual expressions. Times are in local time.
+*/
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64 // A bit for every value the field allows
+	domStar, dowStar              bool   // The day fields were *, see matchesDay
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+type cronField struct {
+	name     string
+	min, max int
+	names    []string // Names for the values from min up
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59, nil},
+	{"hour", 0, 23, nil},
+	{"day of month", 1, 31, nil},
+	{"month", 1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{"day of week", 0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+// parseCron parses a cron expression, see cronSchedule
+func parseCron(expr string) (cronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if macro, ok := cronMacros[strings.ToLower(expr)]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return cronSchedule{}, fmt.Errorf("expected 5 fields (minute hour day-of-month month day-of-week), got %d", len(fields))
+	}
+
+	var bits [5]uint64
+	for i, field := range cronFields {
+		var err error
+		bits[i], err = field.parse(fields[i])
+		if err != nil {
+			return cronSchedule{}, err
+		}
+	}
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1 // Sunday
+	}
+	return cronSchedule{
+		minute: bits[0], hour: bits[1], dom: bits[2], month: bits[3], dow: bits[4],
+		domStar: strings.HasPrefix(fields[2], "*"),
+		dowStar: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+// parse returns the bits of the values a field allows
+func (f cronField) parse(text string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(text, ",") {
+		span, stepText, stepped := strings.Cut(part, "/")
+		step := 1
+		if stepped {
+			var err error
+			step, err = strconv.Atoi(stepText)
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("%s: invalid step %q", f.name, stepText)
+			}
+		}
+
+		low, high := f.min, f.max
+		if span != "*" {
+			from, to, ranged := strings.Cut(span, "-")
+			var err error
+			low, err = f.value(from)
+			if err != nil {
+				return 0, err
+			}
+			high = low
+			if ranged {
+				high, err = f.value(to)
+				if err != nil {
+					return 0, err
+				}
+			} else if stepped {
+				high = f.max // 5/15 is 5, 20, 35 and 50
+			}
+			if high < low {
+				return 0, fmt.Errorf("%s: %s is a range that goes backwards", f.name, span)
+			}
+		}
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// value parses a single value of a field, a number or a name
+func (f cronField) value(text string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(text, name) {
+			return f.min + i, nil
+		}
+	}
+	v, err := strconv.Atoi(text)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("%s: %q is not from %d to %d", f.name, text, f.min, f.max)
+	}
+	return v, nil
+}
+
+// matchesDay reports whether the schedule runs on t's day
+func (s cronSchedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+/*
+next returns the first time after after that the schedule runs at, in local time, or the zero time if it never does
+(like 0 0 30 2 *)
+
+Times that don't exist because the clocks go forward are skipped, and times that happen twice because the clocks go
+back are only run at the first time.
+*/
+func (s cronSchedule) next(after time.Time) time.Time {
+	t := after.Local().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0) // Every day of the week falls on every date within a few years
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = forward(t, localTime(t.Year(), t.Month()+1, 1, 0, 0))
+		case !s.matchesDay(t):
+			t = forward(t, localTime(t.Year(), t.Month(), t.Day()+1, 0, 0))
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = forward(t, localTime(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0))
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		case !localTime(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()).Equal(t):
+			t = t.Add(time.Minute) // The second time through an hour that the clocks went back over
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// forward returns next if it is after t, and otherwise the start of the next hour, next can be earlier when the
+// clocks go forward over the time it was meant to be at
+func forward(t time.Time, next time.Time) time.Time {
+	if next.After(t) {
+		return next
+	}
+	return t.Truncate(time.Hour).Add(time.Hour)
+}
+
+/*
+localTime returns the time a wall clock in local time shows, the first of them when it shows it twice because the
+clocks go back
+
+time.Date gives either of the two, depending on the zone.
+*/
+func localTime(year int, month time.Month, day, hour, min int) time.Time {
+	t := time.Date(year, month, day, hour, min, 0, 0, time.Local)
+	_, offset := t.Zone()
+	_, before := t.Add(-12 * time.Hour).Zone()
+	if before > offset {
+		earlier := t.Add(-time.Duration(before-offset) * time.Second)
+		if earlier.Hour() == t.Hour() && earlier.Minute() == t.Minute() {
+			return earlier
+		}
+	}
+	return t
+}
@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+// setLocal makes zone the local time zone until the test is over
+func setLocal(t *testing.T, zone string) *time.Location {
+	t.Helper()
+	location, err := time.LoadLocation(zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := time.Local
+	t.Cleanup(func() { time.Local = local })
+	time.Local = location
+	return location
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"@every 5m",
+		"60 * * * *",
+		"* 24 * * *",
+		"0 0 0 * *",
+		"0 0 32 * *",
+		"0 0 * 13 *",
+		"0 0 * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"5-1 * * * *",
+		"0 0 * foo *",
+		"0 0 * * mon-",
+		"0,,5 * * * *",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) gave no error", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	tests := []struct {
+		zone  string
+		expr  string
+		after string // In the zone
+		want  string // In UTC, empty when it never runs
+	}{
+		{"UTC", "*/15 * * * *", "2024-05-15 10:07:30", "2024-05-15 10:15"},
+		{"UTC", "*/15 * * * *", "2024-05-15 10:15:00", "2024-05-15 10:30"}, // After, not at
+		{"UTC", "5/20 * * * *", "2024-05-15 10:46:00", "2024-05-15 11:05"},
+		{"UTC", "0 9-17/4 * * *", "2024-05-15 13:00:00", "2024-05-15 17:00"},
+		{"UTC", "0,30 8 * * *", "2024-05-15 08:10:00", "2024-05-15 08:30"},
+		{"UTC", "@hourly", "2024-05-15 23:59:59", "2024-05-16 00:00"},
+		{"UTC", "@DAILY", "2024-12-31 12:00:00", "2025-01-01 00:00"},
+		{"UTC", "@yearly", "2024-06-01 00:00:00", "2025-01-01 00:00"},
+		{"UTC", "@monthly", "2024-01-31 00:00:00", "2024-02-01 00:00"},
+		{"UTC", "0 0 * * 0", "2024-05-15 10:00:00", "2024-05-19 00:00"}, // A Wednesday, Sunday is 0
+		{"UTC", "0 0 * * 7", "2024-05-15 10:00:00", "2024-05-19 00:00"}, // And 7
+		{"UTC", "0 9 * * MON-fri", "2024-05-17 10:00:00", "2024-05-20 09:00"},
+		{"UTC", "0 9 * jun *", "2024-05-17 10:00:00", "2024-06-01 09:00"},
+		{"UTC", "0 9 13 * fri", "2024-09-01 00:00:00", "2024-09-06 09:00"}, // Either day field
+		{"UTC", "0 9 13 * fri", "2024-09-06 10:00:00", "2024-09-13 09:00"},
+		{"UTC", "0 9 31 * *", "2024-04-01 00:00:00", "2024-05-31 09:00"},
+		{"UTC", "0 0 29 2 *", "2024-03-01 00:00:00", "2028-02-29 00:00"},
+		{"UTC", "0 0 30 2 *", "2024-03-01 00:00:00", ""},
+
+		// The clocks go forward from 02:00 to 03:00 on 31 March 2024, and back from 03:00 to 02:00 on 27 October
+		{"Europe/Berlin", "0 3 * * *", "2024-05-15 10:00:00", "2024-05-16 01:00"},
+		{"Europe/Berlin", "0 3 * * *", "2024-01-15 10:00:00", "2024-01-16 02:00"},
+		{"Europe/Berlin", "0 * * * *", "2024-03-31 01:30:00", "2024-03-31 01:00"},  // 03:00, 02:00 doesn't exist
+		{"Europe/Berlin", "30 2 * * *", "2024-03-30 12:00:00", "2024-04-01 00:30"}, // Skipped the day 02:30 doesn't exist
+		{"Europe/Berlin", "0 0 * * *", "2024-03-30 12:00:00", "2024-03-30 23:00"},
+		{"Europe/Berlin", "0 0 * * *", "2024-03-31 00:00:00", "2024-03-31 22:00"},    // A 23 hour day
+		{"Europe/Berlin", "30 2 * * *", "2024-10-26 12:00:00", "2024-10-27 00:30"},   // The first 02:30
+		{"Europe/Berlin", "*/30 * * * *", "2024-10-27 02:45:00", "2024-10-27 02:00"}, // 03:00 CET, not the second 02:00 and 02:30
+		{"Europe/Berlin", "0 0 * * *", "2024-10-27 00:00:00", "2024-10-27 23:00"},    // A 25 hour day
+
+		// The clocks go forward from 02:00 to 03:00 on 10 March 2024, and back from 02:00 to 01:00 on 3 November
+		{"America/New_York", "0 2 * * *", "2024-03-09 12:00:00", "2024-03-11 06:00"},
+		{"America/New_York", "*/20 * * * *", "2024-03-10 01:50:00", "2024-03-10 07:00"},
+		{"America/New_York", "0 1 * * *", "2024-11-02 12:00:00", "2024-11-03 05:00"},
+		{"America/New_York", "0 1 * * *", "2024-11-03 01:30:00", "2024-11-04 06:00"}, // Not the second 01:00
+		{"America/New_York", "@weekly", "2024-10-30 12:00:00", "2024-11-03 04:00"},
+		{"America/New_York", "@weekly", "2024-11-03 00:00:00", "2024-11-10 05:00"},
+	}
+	for _, test := range tests {
+		zone := setLocal(t, test.zone)
+		cron, err := parseCron(test.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %s", test.expr, err)
+		}
+		after, err := time.ParseInLocation("2006-01-02 15:04:05", test.after, zone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want time.Time
+		if test.want != "" {
+			want, err = time.Parse("2006-01-02 15:04", test.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := cron.next(after); !got.Equal(want) {
+			t.Errorf("%q after %s in %s: next gave %s (%s UTC), expected %s UTC", test.expr, test.after, test.zone, got, got.UTC(), want)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+//go:build darwin || freebsd || netbsd
+
+package utils
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// changeTime returns a file's change time (ctime)
+func changeTime(info os.FileInfo) time.Time {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(stat.Ctimespec.Sec, stat.Ctimespec.Nsec)
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !netbsd
+
+package utils
+
+import (
+	"os"
+	"time"
+)
+
+// changeTime returns the zero time where the change time isn't available, so only the size and modification time are compared
+func changeTime(info os.FileInfo) time.Time {
+	return time.Time{}
+}
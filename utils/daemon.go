@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+/*
+Archiving vaults on a schedule
+
+The daemon command archives every vault that has a schedule at the times its cron expression gives, each time after
+a random delay of up to its jitter, so that machines (or vaults) that share a schedule don't all hit a destination
+at once.
+
+Runs that were missed, because the daemon wasn't running or the machine was asleep, are caught up on: a vault whose
+last archive is older than the last time it was due is archived straight away (give or take its jitter), once. The
+clock is looked at every few seconds rather than waited on, since timers don't count the time the machine sleeps.
+*/
+
+// scheduleTick is how often the daemon checks whether a vault is due
+const scheduleTick = 10 * time.Second
+
+// scheduledVault is the state of a vault that RunSchedules looks after
+type scheduledVault struct {
+	vault   Vault
+	cron    cronSchedule
+	jitter  time.Duration
+	last    time.Time // When the vault was last archived, or its last run started
+	next    time.Time
+	running bool
+}
+
+/*
+RunSchedules calls archive for each of the vaults with a schedule when it is due (see above), until ctx is done
+
+The vaults are replaced by the ones sent on reload, when the config is reloaded. Vaults that were already there (by
+name) keep when they were last run, and when they are due next unless their schedule changed. Vaults are archived in
+the background, so one doesn't hold up the others, and a vault is never archived twice at once. Once ctx is done,
+RunSchedules waits for the archives that are running to finish.
+*/
+func RunSchedules(ctx context.Context, vaults []Vault, reload <-chan []Vault, archive func(Vault)) {
+	scheduled := make(map[string]*scheduledVault) // By name
+	running := make(map[string]bool)
+	apply := func(vaults []Vault) {
+		now := time.Now()
+		old := scheduled
+		scheduled = make(map[string]*scheduledVault)
+		for _, vault := range vaults {
+			if vault.Schedule.Cron == "" {
+				continue
+			}
+			cron, err := parseCron(vault.Schedule.Cron)
+			if err != nil {
+				log.Printf("[daemon] %s: schedule %q: %s", vault.Name, vault.Schedule.Cron, err) // LoadConfig checks these
+				continue
+			}
+			v := &scheduledVault{vault: vault, cron: cron, running: running[vault.Name]}
+			if vault.Schedule.Jitter != "" {
+				v.jitter, _ = time.ParseDuration(vault.Schedule.Jitter)
+			}
+			previous, ok := old[vault.Name]
+			if ok {
+				v.last = previous.last
+			} else {
+				v.last = lastArchived(vault)
+			}
+			if ok && previous.vault.Schedule == vault.Schedule {
+				v.next = previous.next // So that reloading doesn't put runs off by drawing their jitter again
+			} else if !v.running {
+				v.plan(now)
+			}
+			scheduled[vault.Name] = v
+		}
+		if len(scheduled) == 0 {
+			log.Print("[daemon] No vault has a schedule, there is nothing to run")
+		}
+		notifyNext(scheduled)
+	}
+	apply(vaults)
+
+	done := make(chan string)
+	ticker := time.NewTicker(scheduleTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			for range running {
+				<-done
+			}
+			return
+
+		case vaults := <-reload:
+			apply(vaults)
+
+		case name := <-done:
+			delete(running, name)
+			if v, ok := scheduled[name]; ok { // Unless it was removed from the config while it ran
+				v.running = false
+				v.plan(time.Now())
+				notifyNext(scheduled)
+			}
+
+		case <-ticker.C:
+			now := time.Now().Round(0) // The wall clock, which keeps counting while the machine sleeps
+			for name, v := range scheduled {
+				if !v.start(now) {
+					continue
+				}
+				running[name] = true
+				go func(vault Vault) {
+					archive(vault)
+					done <- vault.Name
+				}(v.vault)
+			}
+		}
+	}
+}
+
+// start reports whether the vault is due at now, and marks it as running when it is
+func (v *scheduledVault) start(now time.Time) bool {
+	if v.running || now.Before(v.next) {
+		return false
+	}
+	v.running, v.last = true, now
+	return true
+}
+
+// plan works out when the vault is due next, which is now when a run was missed since it was last run
+func (v *scheduledVault) plan(now time.Time) {
+	next := v.cron.next(now)
+	if !v.last.IsZero() {
+		if due := v.cron.next(v.last); !due.IsZero() && due.Before(now) {
+			next = now
+			log.Printf("[daemon] %s missed its run at %s, catching up", v.vault.Name, due.Format("2006-01-02 15:04"))
+		}
+	}
+	if v.jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(v.jitter))))
+	}
+	v.next = next
+	log.Printf("[daemon] %s: next run at %s", v.vault.Name, next.Format("2006-01-02 15:04:05"))
+}
+
+// notifyNext tells systemd which vault is up next, for systemctl status
+func notifyNext(scheduled map[string]*scheduledVault) {
+	var next []*scheduledVault
+	for _, v := range scheduled {
+		if !v.running {
+			next = append(next, v)
+		}
+	}
+	sort.Slice(next, func(i, j int) bool { return next[i].next.Before(next[j].next) })
+	status := fmt.Sprintf("%d vault(s) scheduled", len(scheduled))
+	if len(next) > 0 {
+		status += fmt.Sprintf(", next is %s at %s", next[0].vault.Name, next[0].next.Format("2006-01-02 15:04:05"))
+	}
+	SystemdNotify("STATUS=" + status)
+}
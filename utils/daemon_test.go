@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlan(t *testing.T) {
+	setLocal(t, "Europe/Berlin")
+	now := time.Date(2024, 5, 15, 10, 0, 0, 0, time.Local)
+	tomorrow := time.Date(2024, 5, 16, 3, 0, 0, 0, time.Local)
+	tests := []struct {
+		name string
+		last time.Time
+		want time.Time
+	}{
+		{"never archived", time.Time{}, tomorrow},
+		{"archived since it was due", time.Date(2024, 5, 15, 3, 0, 5, 0, time.Local), tomorrow},
+		{"archived just before it was due", time.Date(2024, 5, 15, 2, 59, 0, 0, time.Local), now},
+		{"one run missed", time.Date(2024, 5, 14, 3, 0, 5, 0, time.Local), now},
+		{"days of runs missed", time.Date(2024, 5, 1, 3, 0, 5, 0, time.Local), now},
+	}
+	for _, test := range tests {
+		cron, err := parseCron("0 3 * * *")
+		if err != nil {
+			t.Fatal(err)
+		}
+		v := &scheduledVault{vault: Vault{Name: "notes"}, cron: cron, last: test.last}
+		v.plan(now)
+		if !v.next.Equal(test.want) {
+			t.Errorf("%s: next run at %s, expected %s", test.name, v.next, test.want)
+		}
+
+		v.jitter = 30 * time.Minute
+		v.plan(now)
+		if v.next.Before(test.want) || !v.next.Before(test.want.Add(v.jitter)) {
+			t.Errorf("%s: with jitter the next run is at %s, expected it within %s of %s", test.name, v.next, v.jitter, test.want)
+		}
+	}
+}
+
+func TestPlanCatchesUpOnce(t *testing.T) {
+	setLocal(t, "Europe/Berlin")
+	cron, err := parseCron("0 3 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 5, 15, 10, 0, 5, 0, time.Local)
+	v := &scheduledVault{vault: Vault{Name: "notes"}, cron: cron, last: time.Date(2024, 5, 10, 3, 0, 0, 0, time.Local)}
+	v.plan(start)
+
+	// The daemon's loop, with archives that take a minute
+	var runs []time.Time
+	var finishAt time.Time
+	for now := start; now.Before(start.Add(48 * time.Hour)); now = now.Add(scheduleTick) {
+		if v.running && !now.Before(finishAt) {
+			v.running = false
+			v.plan(now)
+		}
+		if v.start(now) {
+			runs = append(runs, now)
+			finishAt = now.Add(time.Minute)
+		}
+	}
+	want := []time.Time{
+		start, // Caught up on the runs since the 10th, once
+		time.Date(2024, 5, 16, 3, 0, 5, 0, time.Local),
+		time.Date(2024, 5, 17, 3, 0, 5, 0, time.Local),
+	}
+	if !reflect.DeepEqual(runs, want) {
+		t.Errorf("ran at %v, expected %v", runs, want)
+	}
+}
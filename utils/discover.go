@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultMarkers are the files and directories that make a directory a vault when a discovery rule doesn't list its own
+var DefaultMarkers = []string{".obsidian", ".git", ".archive-me"}
+
+// DefaultDiscoveryDepth is how many directories below the root a discovery rule looks for vaults when it doesn't set a depth
+const DefaultDiscoveryDepth = 3
+
+/*
+DiscoveryRule scans a root directory for vaults
+
+Any directory below Root (up to Depth levels down) that contains one of the Markers is archived as if it had been
+listed in the config as a vault of its own, using the rule's settings. Directories inside a discovered vault are not scanned.
+*/
+type DiscoveryRule struct {
+	Root     string   `yaml:"root"`
+	Markers  []string `yaml:"markers,omitempty"`
+	Depth    int      `yaml:"depth,omitempty"`
+	Settings `yaml:",inline"`
+}
+
+// vault turns the rule into a placeholder vault, so the defaults and path expansion are applied to it like any other vault
+func (rule DiscoveryRule) vault() Vault {
+	markers := rule.Markers
+	if len(markers) == 0 {
+		markers = DefaultMarkers
+	}
+	depth := rule.Depth
+	if depth == 0 {
+		depth = DefaultDiscoveryDepth
+	}
+	return Vault{
+		Path:     rule.Root,
+		Settings: rule.Settings,
+		discover: &discovery{markers: markers, depth: depth},
+	}
+}
+
+// discovery is set on the placeholder vaults that stand in for a discovery rule
+type discovery struct {
+	markers []string
+	depth   int
+}
+
+// isGlob reports whether a vault path is a pattern rather than a single directory
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+/*
+findVaults replaces glob and discovery vaults with the directories they match
+
+Each match gets its own copy of the settings, and is named after its path by assignNames. nodes is expanded alongside
+the vaults so that every found vault can still be traced back to the part of the config it came from.
+*/
+func findVaults(vaults []Vault, nodes []vaultNodes) ([]Vault, []vaultNodes, []error) {
+	var found []Vault
+	var foundNodes []vaultNodes
+	var errs []error
+
+	for i, vault := range vaults {
+		var paths []string
+		var err error
+		switch {
+		case vault.discover != nil:
+			paths, err = discoverVaults(vault.Path, vault.discover, vault.Exclude)
+		case isGlob(vault.Path):
+			paths, err = globVaults(vault.Path)
+		default:
+			found = append(found, vault)
+			foundNodes = append(foundNodes, nodes[i])
+			continue
+		}
+		if err != nil {
+			errs = append(errs, configErrorf(or(nodes[i].path, nodes[i].vault), "%s", err))
+			continue
+		}
+		if nodes[i].name != nil {
+			errs = append(errs, configErrorf(or(nodes[i].name, nodes[i].vault), "vaults with a glob path can't have a name, each match is named after its path"))
+			continue
+		}
+
+		for _, path := range paths {
+			match := vault
+			match.Path = path
+			match.Name = ""
+			match.discover = nil
+			found = append(found, match)
+			foundNodes = append(foundNodes, nodes[i])
+		}
+	}
+	return found, foundNodes, errs
+}
+
+// globVaults returns every directory matching pattern, a pattern that matches none is most likely a typo
+func globVaults(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("bad glob pattern %s: %w", pattern, err)
+	}
+
+	var dirs []string
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err == nil && info.IsDir() {
+			dirs = append(dirs, match)
+		}
+	}
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("glob pattern %s matches no directories", pattern)
+	}
+	return dirs, nil
+}
+
+// discoverVaults walks root looking for directories that contain one of the markers
+func discoverVaults(root string, rule *discovery, exclude []string) ([]string, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("discovery root %s does not exist", root)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("discovery root %s is not a directory", root)
+	}
+
+	var vaults []string
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return filepath.SkipDir // Unreadable directories can't be archived anyway
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if path != root && isExcluded(path, root, exclude) {
+			return filepath.SkipDir
+		}
+
+		for _, marker := range rule.markers {
+			if _, err := os.Lstat(filepath.Join(path, marker)); err == nil {
+				vaults = append(vaults, path)
+				return filepath.SkipDir // Don't look for vaults inside of a vault
+			}
+		}
+
+		rel, _ := filepath.Rel(root, path)
+		if rel != "." && strings.Count(rel, string(filepath.Separator))+1 >= rule.depth {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(vaults)
+	return vaults, nil
+}
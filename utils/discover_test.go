@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// makeTree creates the directories and files under root, the ones that end in a slash are directories
+func makeTree(t *testing.T, root string, paths ...string) {
+	t.Helper()
+	for _, path := range paths {
+		full := filepath.Join(root, path)
+		var err error
+		if strings.HasSuffix(path, "/") {
+			err = os.MkdirAll(full, 0o755)
+		} else {
+			err = os.MkdirAll(filepath.Dir(full), 0o755)
+			if err == nil {
+				err = os.WriteFile(full, nil, 0o644)
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDiscoverVaults(t *testing.T) {
+	root := t.TempDir()
+	makeTree(t, root,
+		"a/.obsidian/",
+		"a/nested/.git/",
+		"b/c/.archive-me",
+		"d/e/f/.git/",
+		"d/e/f/g/h/.git/",
+		"node_modules/x/.git/",
+		"plain/notes.md",
+	)
+	tests := []struct {
+		name    string
+		markers []string
+		depth   int
+		exclude []string
+		want    []string
+	}{
+		{"defaults", DefaultMarkers, DefaultDiscoveryDepth, nil, []string{"a", "b/c", "d/e/f", "node_modules/x"}},
+		{"shallow", DefaultMarkers, 2, nil, []string{"a", "b/c", "node_modules/x"}},
+		{"one level", DefaultMarkers, 1, nil, []string{"a"}},
+		{"deep", DefaultMarkers, 5, nil, []string{"a", "b/c", "d/e/f", "node_modules/x"}}, // Not inside a vault that was found
+		{"excluded", DefaultMarkers, DefaultDiscoveryDepth, []string{"node_modules"}, []string{"a", "b/c", "d/e/f"}},
+		{"own markers", []string{".git"}, DefaultDiscoveryDepth, nil, []string{"a/nested", "d/e/f", "node_modules/x"}},
+		{"a marker that is a file", []string{".archive-me"}, DefaultDiscoveryDepth, nil, []string{"b/c"}},
+		{"no matches", []string{".hg"}, DefaultDiscoveryDepth, nil, nil},
+	}
+	for _, test := range tests {
+		got, err := discoverVaults(root, &discovery{markers: test.markers, depth: test.depth}, test.exclude)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want []string
+		for _, path := range test.want {
+			want = append(want, filepath.Join(root, path))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: found %v, expected %v", test.name, got, want)
+		}
+	}
+
+	for _, missing := range []string{filepath.Join(root, "gone"), filepath.Join(root, "plain/notes.md")} {
+		if _, err := discoverVaults(missing, &discovery{markers: DefaultMarkers, depth: 1}, nil); err == nil {
+			t.Errorf("%s was taken for a discovery root", missing)
+		}
+	}
+}
+
+func TestGlobVaults(t *testing.T) {
+	root := t.TempDir()
+	makeTree(t, root, "notes/b/", "notes/a/", "notes/c.md", "work/a/")
+	tests := []struct {
+		pattern string
+		want    []string // Nil when it is an error
+	}{
+		{"notes/*", []string{"notes/a", "notes/b"}},
+		{"*/a", []string{"notes/a", "work/a"}},
+		{"notes/[ab]", []string{"notes/a", "notes/b"}},
+		{"notes/c*", nil}, // Only a file
+		{"notes/z*", nil},
+		{"notes/[", nil},
+	}
+	for _, test := range tests {
+		got, err := globVaults(filepath.Join(root, test.pattern))
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: found %v, expected an error", test.pattern, got)
+			}
+			continue
+		}
+		var want []string
+		for _, path := range test.want {
+			want = append(want, filepath.Join(root, path))
+		}
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: found %v (%v), expected %v", test.pattern, got, err, want)
+		}
+	}
+}
+
+func TestValidateFindsVaults(t *testing.T) {
+	dirs := []string{"notes/a", "notes/b", "projects/x/.git", "projects/y/.obsidian", "projects/y/sub/.git"}
+	config, errs := validate(t, `version: 2
+defaults:
+  destination: archives
+  retention: 7
+vaults:
+  - path: notes/*
+    format: tar
+discover:
+  - root: projects
+    retention: 3
+`, dirs...)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	var got []string
+	for _, vault := range config.Vaults {
+		rel := filepath.Base(filepath.Dir(vault.Path)) + "/" + filepath.Base(vault.Path)
+		got = append(got, fmt.Sprintf("%s %s %d", rel, vault.Format, vault.Destinations[0].Retention))
+		if vault.Name == "" || strings.ContainsAny(vault.Name, "/*") {
+			t.Errorf("%s was named %q", vault.Path, vault.Name)
+		}
+	}
+	want := []string{"notes/a tar 7", "notes/b tar 7", "projects/x tar.gz 3", "projects/y tar.gz 3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("found %v, expected %v", got, want)
+	}
+
+	tests := []struct {
+		name   string
+		config string
+		want   []configProblem
+	}{
+		{
+			"no matches",
+			"version: 2\ndefaults:\n  destination: archives\n  retention: 7\nvaults:\n  - path: notes/a\n  - path: notse/*\n",
+			[]configProblem{{7, 11, "matches no directories"}},
+		},
+		{
+			"named glob",
+			"version: 2\ndefaults:\n  destination: archives\n  retention: 7\nvaults:\n  - path: notes/a\n  - path: notes/*\n    name: notes\n",
+			[]configProblem{{8, 11, "can't have a name"}},
+		},
+		{
+			"missing root",
+			"version: 2\ndefaults:\n  destination: archives\n  retention: 7\nvaults:\n  - path: notes/a\ndiscover:\n  - root: gone\n",
+			[]configProblem{{8, 11, "discovery root"}},
+		},
+	}
+	for _, test := range tests {
+		_, errs := validate(t, test.config, dirs...)
+		checkProblems(t, test.name, errs, test.want)
+	}
+}
@@ -0,0 +1,717 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+Erasure coded archives
+
+An erasure coded archive is stored as Data+Parity shard files named NAME.shardIofN, spread over the vault's destinations.
+The archive is cut into stripes of Data blocks, and every stripe adds one block (data or parity) to each shard, with the
+last stripe padded with zeros. Each shard ends with a footer that records the coding, the archive's size and the SHA-256
+of the shard's blocks, so a damaged shard is found by reading it on its own.
+*/
+
+const (
+	shardBlockSize  = 64 << 10
+	shardFooterSize = 64
+	shardMagic      = "GAIEC1\x00\x00"
+)
+
+var shardSuffix = regexp.MustCompile(`\.shard(\d+)of(\d+)$`)
+
+// shardName returns the file name of one of an archive's shards, index counts from 0
+func shardName(archive string, index int, total int) string {
+	return fmt.Sprintf("%s.shard%dof%d", archive, index+1, total)
+}
+
+// splitShard splits a shard's file name into the archive's name, the shard's index (from 0) and the number of shards
+func splitShard(name string) (string, int, int, bool) {
+	match := shardSuffix.FindStringSubmatchIndex(name)
+	if match == nil {
+		return "", 0, 0, false
+	}
+	index, err := strconv.Atoi(name[match[2]:match[3]])
+	if err != nil {
+		return "", 0, 0, false
+	}
+	total, err := strconv.Atoi(name[match[4]:match[5]])
+	if err != nil || index < 1 || index > total {
+		return "", 0, 0, false
+	}
+	return name[:match[0]], index - 1, total, true
+}
+
+// IsSharded reports whether an archive is erasure coded, its parts are then shards that are spread over several destinations
+func (archive ArchiveInfo) IsSharded() bool {
+	if len(archive.Parts) == 0 {
+		return false
+	}
+	_, _, _, ok := splitShard(archive.Parts[0].Name)
+	return ok
+}
+
+// shardFooter is the last shardFooterSize bytes of every shard
+type shardFooter struct {
+	data      int
+	parity    int
+	index     int
+	blockSize int
+	size      int64 // The size of the archive, without the padding of the last stripe
+	sum       [sha256.Size]byte
+}
+
+func (f shardFooter) marshal() []byte {
+	b := make([]byte, shardFooterSize)
+	copy(b, shardMagic)
+	binary.BigEndian.PutUint16(b[8:], uint16(f.data))
+	binary.BigEndian.PutUint16(b[10:], uint16(f.parity))
+	binary.BigEndian.PutUint16(b[12:], uint16(f.index))
+	binary.BigEndian.PutUint32(b[16:], uint32(f.blockSize))
+	binary.BigEndian.PutUint64(b[24:], uint64(f.size))
+	copy(b[32:], f.sum[:])
+	return b
+}
+
+func parseShardFooter(b []byte) (shardFooter, error) {
+	if len(b) != shardFooterSize || string(b[:8]) != shardMagic {
+		return shardFooter{}, errors.New("it has no shard footer")
+	}
+	f := shardFooter{
+		data:      int(binary.BigEndian.Uint16(b[8:])),
+		parity:    int(binary.BigEndian.Uint16(b[10:])),
+		index:     int(binary.BigEndian.Uint16(b[12:])),
+		blockSize: int(binary.BigEndian.Uint32(b[16:])),
+		size:      int64(binary.BigEndian.Uint64(b[24:])),
+	}
+	copy(f.sum[:], b[32:])
+	if f.data < 1 || f.parity < 1 || f.data+f.parity > 255 || f.index >= f.data+f.parity || f.blockSize < 1 || f.size < 0 {
+		return shardFooter{}, errors.New("its footer is damaged")
+	}
+	return f, nil
+}
+
+// stripes returns the number of stripes the archive was cut into
+func (f shardFooter) stripes() int64 {
+	stripe := int64(f.data) * int64(f.blockSize)
+	return (f.size + stripe - 1) / stripe
+}
+
+// sameArchive reports whether two footers are from shards of the same archive
+func (f shardFooter) sameArchive(other shardFooter) bool {
+	return f.data == other.data && f.parity == other.parity && f.blockSize == other.blockSize && f.size == other.size
+}
+
+// shardWriter writes one shard, and hashes its blocks for the footer
+type shardWriter struct {
+	index   int
+	name    string
+	dest    Destination
+	writer  ArchiveWriter
+	result  *TargetResult // Where a failure is reported, when the shard is part of a new archive
+	hash    hash.Hash
+	written int64
+	closed  bool
+	err     error
+}
+
+func (s *shardWriter) Write(p []byte) (int, error) {
+	n, err := s.writer.Write(p)
+	s.hash.Write(p[:n])
+	s.written += int64(n)
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+// finish writes the footer and closes the shard
+func (s *shardWriter) finish(footer shardFooter) error {
+	footer.index = s.index
+	copy(footer.sum[:], s.hash.Sum(nil))
+	n, err := s.writer.Write(footer.marshal())
+	s.written += int64(n)
+	if err != nil {
+		s.err = err
+		s.writer.Abort()
+		return err
+	}
+	s.closed = true
+	return s.writer.Close()
+}
+
+// discard throws the shard away, whether or not it was finished
+func (s *shardWriter) discard() {
+	switch {
+	case s.closed:
+		s.dest.Delete(s.name)
+	case s.writer != nil && s.err == nil:
+		s.writer.Abort()
+	}
+}
+
+/*
+erasureWriter cuts an archive into stripes and writes them to its shards
+
+A shard whose write fails is aborted and left out of any further writes, the write only fails once more shards
+have failed than there are parity shards to make up for them.
+*/
+type erasureWriter struct {
+	rs       *reedSolomon
+	shards   []*shardWriter
+	stripe   []byte   // The data blocks of the stripe that is being filled
+	blocks   [][]byte // The data blocks (slices of stripe) followed by the parity blocks
+	buffered int
+	size     int64
+}
+
+func newErasureWriter(rs *reedSolomon, shards []*shardWriter) *erasureWriter {
+	e := &erasureWriter{rs: rs, shards: shards, stripe: make([]byte, rs.data*shardBlockSize)}
+	for i := 0; i < rs.data; i++ {
+		e.blocks = append(e.blocks, e.stripe[i*shardBlockSize:(i+1)*shardBlockSize])
+	}
+	for i := 0; i < rs.parity; i++ {
+		e.blocks = append(e.blocks, make([]byte, shardBlockSize))
+	}
+	return e
+}
+
+func (e *erasureWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(e.stripe[e.buffered:], p)
+		e.buffered += n
+		e.size += int64(n)
+		written += n
+		p = p[n:]
+		if e.buffered == len(e.stripe) {
+			err := e.flush()
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush encodes the current stripe and writes a block of it to every shard
+func (e *erasureWriter) flush() error {
+	for i := e.buffered; i < len(e.stripe); i++ {
+		e.stripe[i] = 0 // Padding for the last stripe
+	}
+	e.rs.encode(e.blocks)
+	for i, shard := range e.shards {
+		if shard.err != nil {
+			continue
+		}
+		_, err := shard.Write(e.blocks[i])
+		if err != nil {
+			shard.err = fmt.Errorf("writing: %w", err)
+			shard.writer.Abort()
+		}
+	}
+	e.buffered = 0
+	return e.check()
+}
+
+// Close writes the last stripe and finishes every shard
+func (e *erasureWriter) Close() error {
+	if e.buffered > 0 {
+		err := e.flush()
+		if err != nil {
+			return err
+		}
+	}
+	footer := shardFooter{data: e.rs.data, parity: e.rs.parity, blockSize: shardBlockSize, size: e.size}
+	for _, shard := range e.shards {
+		if shard.err != nil {
+			continue
+		}
+		err := shard.finish(footer)
+		if err != nil {
+			shard.err = fmt.Errorf("saving: %w", err)
+		}
+	}
+	return e.check()
+}
+
+// check returns an error when too many shards have failed for the archive to be rebuilt
+func (e *erasureWriter) check() error {
+	failed := 0
+	var lastErr error
+	for _, shard := range e.shards {
+		if shard.err != nil {
+			failed++
+			lastErr = shard.err
+		}
+	}
+	if failed > e.rs.parity {
+		return fmt.Errorf("%d of the %d shards failed, more than the %d parity shards can make up for, the last with: %w", failed, len(e.shards), e.rs.parity, lastErr)
+	}
+	return nil
+}
+
+// abort throws away every shard
+func (e *erasureWriter) abort() {
+	for _, shard := range e.shards {
+		shard.discard()
+	}
+}
+
+/*
+archiveShards writes an archive as erasure coded shards, shard i goes to dests[i % len(dests)]
+
+produce writes the archive, and results are those of Archive. A shard that fails marks its destination as failed,
+but the archive is kept as long as no more shards failed than there are parity shards, since repair can rebuild them.
+Otherwise every shard is thrown away and archiveShards returns an error.
+*/
+func archiveShards(erasure Erasure, name string, dests []Destination, results []TargetResult, produce func(io.Writer) error) error {
+	rs, err := newReedSolomon(erasure.Data, erasure.Parity)
+	if err != nil {
+		return err
+	}
+	total := erasure.Data + erasure.Parity
+	shards := make([]*shardWriter, total)
+	for i := range shards {
+		t := i % len(dests)
+		shard := &shardWriter{index: i, name: shardName(name, i, total), dest: dests[t], result: &results[t], hash: sha256.New()}
+		shards[i] = shard
+		if shard.dest == nil {
+			shard.err = results[t].Err // The destination could not be opened
+			continue
+		}
+		shard.writer, shard.err = shard.dest.Create(shard.name)
+	}
+
+	out := newErasureWriter(rs, shards)
+	err = out.check()
+	if err == nil {
+		err = produce(out)
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err == nil {
+		for _, shard := range shards {
+			if shard.err != nil {
+				continue
+			}
+			info, err := shard.dest.Stat(shard.name)
+			if err != nil {
+				shard.err = fmt.Errorf("checking: %w", err)
+			} else if info.Size != shard.written {
+				shard.err = fmt.Errorf("it is %d bytes, but %d were written", info.Size, shard.written)
+			}
+		}
+		err = out.check()
+	}
+	if err != nil {
+		out.abort()
+		return err
+	}
+
+	for _, shard := range shards {
+		switch {
+		case shard.err == nil:
+			shard.result.Size += shard.written
+		case shard.result.Err == nil:
+			shard.result.Err = fmt.Errorf("shard %d of %d: %w", shard.index+1, total, shard.err)
+		}
+	}
+	return nil
+}
+
+// shardReader reads the blocks of a shard, holding back the footer and hashing everything else
+type shardReader struct {
+	r     io.Reader
+	hash  hash.Hash
+	buf   []byte // Read from r, but not returned yet, the last shardFooterSize bytes could be the footer
+	chunk []byte
+	n     int64
+	eof   bool
+}
+
+func newShardReader(r io.Reader) *shardReader {
+	return &shardReader{r: r, hash: sha256.New(), chunk: make([]byte, 32<<10)}
+}
+
+func (s *shardReader) Read(p []byte) (int, error) {
+	for !s.eof && len(s.buf) < shardFooterSize+len(p) {
+		n, err := s.r.Read(s.chunk)
+		s.buf = append(s.buf, s.chunk[:n]...)
+		if err == io.EOF {
+			s.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.buf[:maxInt(len(s.buf)-shardFooterSize, 0)])
+	if n == 0 && s.eof && len(p) > 0 {
+		return 0, io.EOF
+	}
+	s.hash.Write(p[:n])
+	s.n += int64(n)
+	s.buf = append(s.buf[:0], s.buf[n:]...)
+	return n, nil
+}
+
+// footer checks a shard that has been read to the end against its footer, and returns the footer
+func (s *shardReader) footer() (shardFooter, error) {
+	footer, err := parseShardFooter(s.buf)
+	if err != nil {
+		return footer, err
+	}
+	if want := footer.stripes() * int64(footer.blockSize); s.n != want {
+		return footer, fmt.Errorf("it has %d bytes of blocks, but its footer says %d", s.n, want)
+	}
+	if !bytes.Equal(s.hash.Sum(nil), footer.sum[:]) {
+		return footer, errors.New("its checksum doesn't match, it is damaged")
+	}
+	return footer, nil
+}
+
+// ShardedArchive is an erasure coded archive, with its shards gathered from every destination of the vault
+type ShardedArchive struct {
+	Name    string
+	ModTime time.Time
+	Total   int      // The number of shards, data and parity
+	Shards  []*Shard // Indexed by shard, nil for the shards that weren't found
+	footer  shardFooter
+	checked bool
+}
+
+// Shard is one of the shards of a ShardedArchive
+type Shard struct {
+	Index  int // Counts from 0
+	Dest   Destination
+	Info   ArchiveInfo
+	Err    error // Why the shard can't be used, set by Check
+	footer shardFooter
+}
+
+/*
+FindShardedArchives gathers the erasure coded archives of a vault from its destinations, oldest first
+
+A destination that can't be listed doesn't stop the others, its shards simply count as missing.
+The error is for the destinations that couldn't be listed.
+*/
+func FindShardedArchives(vault Vault, dests []Destination) ([]*ShardedArchive, error) {
+	sharded := make(map[string]*ShardedArchive)
+	var errs []error
+	for _, dest := range dests {
+		archives, err := ListArchives(vault, dest)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("listing %s: %w", dest, err))
+			continue
+		}
+		for _, archive := range archives {
+			gatherShards(sharded, dest, archive)
+		}
+	}
+	return sortSharded(sharded), errors.Join(errs...)
+}
+
+// gatherShards adds the shards among an archive's parts to the archives in sharded
+func gatherShards(sharded map[string]*ShardedArchive, dest Destination, archive ArchiveInfo) {
+	for _, part := range archive.Parts {
+		name, index, total, ok := splitShard(part.Name)
+		if !ok {
+			continue
+		}
+		a := sharded[name]
+		if a == nil {
+			a = &ShardedArchive{Name: name, Total: total, Shards: make([]*Shard, total)}
+			sharded[name] = a
+		}
+		if total != a.Total || a.Shards[index] != nil {
+			continue // Left over from a different coding, or a copy
+		}
+		a.Shards[index] = &Shard{Index: index, Dest: dest, Info: part}
+		if part.ModTime.After(a.ModTime) {
+			a.ModTime = part.ModTime
+		}
+	}
+}
+
+func sortSharded(sharded map[string]*ShardedArchive) []*ShardedArchive {
+	archives := make([]*ShardedArchive, 0, len(sharded))
+	for _, archive := range sharded {
+		archives = append(archives, archive)
+	}
+	sort.Slice(archives, func(i, j int) bool {
+		if archives[i].ModTime.Equal(archives[j].ModTime) {
+			return archives[i].Name < archives[j].Name
+		}
+		return archives[i].ModTime.Before(archives[j].ModTime)
+	})
+	return archives
+}
+
+/*
+Check reads every shard of the archive, and sets Err on the ones that are damaged
+
+Check returns an error when too few shards are intact to rebuild the archive.
+*/
+func (a *ShardedArchive) Check() error {
+	var reference *shardFooter
+	for _, shard := range a.Shards {
+		if shard == nil {
+			continue
+		}
+		shard.footer, shard.Err = checkShard(shard)
+		if shard.Err != nil {
+			continue
+		}
+		if reference == nil {
+			reference = &shard.footer
+		} else if !shard.footer.sameArchive(*reference) {
+			shard.Err = errors.New("its footer doesn't match the other shards")
+		}
+	}
+	a.checked = true
+	if reference == nil {
+		return errors.New("none of its shards are intact")
+	}
+	if reference.data+reference.parity != a.Total {
+		return fmt.Errorf("its shards are named as %d, but their footers say %d", a.Total, reference.data+reference.parity)
+	}
+	a.footer = *reference
+	if intact := len(a.intact()); intact < a.footer.data {
+		return fmt.Errorf("only %d of its shards are intact, %d are needed to rebuild it", intact, a.footer.data)
+	}
+	return nil
+}
+
+func checkShard(shard *Shard) (shardFooter, error) {
+	reader, err := shard.Dest.Open(shard.Info.Name)
+	if err != nil {
+		return shardFooter{}, err
+	}
+	defer reader.Close()
+
+	sr := newShardReader(reader)
+	_, err = io.Copy(io.Discard, sr)
+	if err != nil {
+		return shardFooter{}, err
+	}
+	footer, err := sr.footer()
+	if err != nil {
+		return footer, err
+	}
+	if footer.index != shard.Index {
+		return footer, fmt.Errorf("its footer says it is shard %d", footer.index+1)
+	}
+	return footer, nil
+}
+
+// intact returns the indexes of the shards that Check found intact
+func (a *ShardedArchive) intact() []int {
+	var indexes []int
+	for i, shard := range a.Shards {
+		if shard != nil && shard.Err == nil {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// Missing returns the indexes of the shards that are missing, or that Check found damaged
+func (a *ShardedArchive) Missing() []int {
+	var indexes []int
+	for i, shard := range a.Shards {
+		if shard == nil || shard.Err != nil {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+/*
+decode rebuilds the archive from its intact shards, writes it to w (unless w is nil), and writes the shards in rebuild
+
+Check has to have been called first. Only as many intact shards as there are data shards are read, data shards first,
+so nothing has to be computed for an archive whose data shards are all intact.
+*/
+func (a *ShardedArchive) decode(w io.Writer, rebuild map[int]*shardWriter) error {
+	if !a.checked {
+		return errors.New("the shards have not been checked")
+	}
+	f := a.footer
+	rs, err := newReedSolomon(f.data, f.parity)
+	if err != nil {
+		return err
+	}
+	have := a.intact()
+	decoder, err := rs.decoder(have)
+	if err != nil {
+		return err
+	}
+	have = have[:f.data]
+
+	readers := make(map[int]*shardReader, len(have))
+	for _, i := range have {
+		shard := a.Shards[i]
+		reader, err := shard.Dest.Open(shard.Info.Name)
+		if err != nil {
+			return fmt.Errorf("shard %d: %w", i+1, err)
+		}
+		defer reader.Close()
+		readers[i] = newShardReader(reader)
+	}
+
+	var want []int
+	for i := 0; i < f.data+f.parity; i++ {
+		_, read := readers[i]
+		_, rebuilt := rebuild[i]
+		if !read && (rebuilt || (w != nil && i < f.data)) {
+			want = append(want, i)
+		}
+	}
+
+	blocks := make([][]byte, f.data+f.parity)
+	for i := range blocks {
+		blocks[i] = make([]byte, f.blockSize)
+	}
+	remaining := f.size
+	for s := int64(0); s < f.stripes(); s++ {
+		for _, i := range have {
+			_, err := io.ReadFull(readers[i], blocks[i])
+			if err != nil {
+				return fmt.Errorf("shard %d: %w", i+1, err)
+			}
+		}
+		decoder(blocks, want)
+
+		for d := 0; w != nil && d < f.data && remaining > 0; d++ {
+			n := int64(f.blockSize)
+			if remaining < n {
+				n = remaining
+			}
+			_, err := w.Write(blocks[d][:n])
+			if err != nil {
+				return err
+			}
+			remaining -= n
+		}
+		for i, shard := range rebuild {
+			_, err := shard.Write(blocks[i])
+			if err != nil {
+				return fmt.Errorf("writing shard %d: %w", i+1, err)
+			}
+		}
+	}
+
+	// The shards could have changed since they were checked, their checksums say whether the blocks that were used are right
+	for _, i := range have {
+		_, err := io.Copy(io.Discard, readers[i])
+		if err == nil {
+			_, err = readers[i].footer()
+		}
+		if err != nil {
+			return fmt.Errorf("shard %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// reader returns the rebuilt archive, decoded in the background as it is read
+func (a *ShardedArchive) reader() io.ReadCloser {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(a.decode(writer, nil))
+	}()
+	return reader
+}
+
+/*
+VerifyShardedArchive checks every shard of an erasure coded archive, then rebuilds the archive and reads every file in it
+
+The archive is intact as long as it can be rebuilt, so the shards Check found damaged or missing have to be looked at
+separately with Missing. VerifyShardedArchive returns the number of files in the archive.
+*/
+func VerifyShardedArchive(archive *ShardedArchive) (int, error) {
+	err := archive.Check()
+	if err != nil {
+		return 0, err
+	}
+	reader := archive.reader()
+	defer reader.Close()
+
+	files, err := readArchive(reader, archive.Name)
+	if err != nil {
+		return files, err
+	}
+	_, err = io.Copy(io.Discard, reader) // Padding after the end of the tar stream, and any error from decoding
+	return files, err
+}
+
+/*
+RepairShardedArchive rebuilds the missing and damaged shards of an archive from the intact ones
+
+Check has to have been called first. dests are the vault's destinations in order, a rebuilt shard goes to the one
+it was first written to, and a damaged shard is removed first. RepairShardedArchive returns the number of shards it rebuilt.
+*/
+func RepairShardedArchive(archive *ShardedArchive, dests []Destination) (int, error) {
+	missing := archive.Missing()
+	if len(missing) == 0 {
+		return 0, nil
+	}
+	if len(archive.intact()) < archive.footer.data {
+		return 0, fmt.Errorf("only %d of its shards are intact, %d are needed to rebuild it", len(archive.intact()), archive.footer.data)
+	}
+
+	rebuild := make(map[int]*shardWriter, len(missing))
+	discard := func() {
+		for _, shard := range rebuild {
+			shard.discard()
+		}
+	}
+	for _, i := range missing {
+		if shard := archive.Shards[i]; shard != nil {
+			err := shard.Dest.Delete(shard.Info.Name)
+			if err != nil {
+				discard()
+				return 0, fmt.Errorf("removing damaged shard %d: %w", i+1, err)
+			}
+			archive.Shards[i] = nil
+		}
+		shard := &shardWriter{index: i, name: shardName(archive.Name, i, archive.Total), dest: dests[i%len(dests)], hash: sha256.New()}
+		writer, err := shard.dest.Create(shard.name)
+		if err != nil {
+			discard()
+			return 0, fmt.Errorf("shard %d: %w", i+1, err)
+		}
+		shard.writer = writer
+		rebuild[i] = shard
+	}
+
+	err := archive.decode(nil, rebuild)
+	for _, shard := range rebuild {
+		if err == nil {
+			err = shard.finish(archive.footer)
+		}
+	}
+	if err != nil {
+		discard()
+		return 0, err
+	}
+
+	for i, shard := range rebuild {
+		if setter, ok := shard.dest.(modTimeSetter); ok && !archive.ModTime.IsZero() {
+			setter.setModTime(shard.name, archive.ModTime) // Keeps the shard in the same place for retention
+		}
+		archive.Shards[i] = &Shard{Index: i, Dest: shard.dest, Info: ArchiveInfo{Name: shard.name, Size: shard.written, ModTime: archive.ModTime}, footer: archive.footer}
+	}
+	return len(rebuild), nil
+}
@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeShardedArchive writes data as an erasure coded archive to local destinations, and returns them
+func writeShardedArchive(t *testing.T, erasure Erasure, name string, data []byte, destinations int) []Destination {
+	dests := make([]Destination, destinations)
+	for i := range dests {
+		dests[i] = localDestination{dir: t.TempDir()}
+	}
+	results := make([]TargetResult, len(dests))
+	err := archiveShards(erasure, name, dests, results, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range results {
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+	}
+	return dests
+}
+
+// findShardedArchive finds the one erasure coded archive in dests, and checks its shards
+func findShardedArchive(t *testing.T, dests []Destination) (*ShardedArchive, error) {
+	t.Helper()
+	archives, err := FindShardedArchives(Vault{Name: "notes"}, dests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archives) != 1 {
+		t.Fatalf("found %d erasure coded archives", len(archives))
+	}
+	return archives[0], archives[0].Check()
+}
+
+// shardPath is where shard i of an archive is in dests
+func shardPath(dests []Destination, name string, i int, total int) string {
+	return filepath.Join(dests[i%len(dests)].(localDestination).dir, shardName(name, i, total))
+}
+
+func TestRepairShardedArchive(t *testing.T) {
+	const name = "2024-01-02T03-04-05Z.tar"
+	erasure := Erasure{Data: 3, Parity: 2}
+	total := erasure.Data + erasure.Parity
+	data := randomBytes(t, 7*shardBlockSize+1234) // The last stripe is padded
+	dests := writeShardedArchive(t, erasure, name, data, 3)
+
+	originals := make([][]byte, total)
+	for i := range originals {
+		shard, err := os.ReadFile(shardPath(dests, name, i, total))
+		if err != nil {
+			t.Fatal(err)
+		}
+		originals[i] = shard
+	}
+
+	// A data shard is lost, and a byte of another is changed
+	err := os.Remove(shardPath(dests, name, 1, total))
+	if err != nil {
+		t.Fatal(err)
+	}
+	damaged := bytes.Clone(originals[2])
+	damaged[shardBlockSize+10] ^= 0x40
+	err = os.WriteFile(shardPath(dests, name, 2, total), damaged, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := findShardedArchive(t, dests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing := archive.Missing(); len(missing) != 2 || missing[0] != 1 || missing[1] != 2 {
+		t.Fatalf("Missing gave %v, expected shards 1 and 2", missing)
+	}
+	rebuilt, err := RepairShardedArchive(archive, dests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt != 2 {
+		t.Errorf("rebuilt %d shards, expected 2", rebuilt)
+	}
+
+	for i, original := range originals {
+		shard, err := os.ReadFile(shardPath(dests, name, i, total))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(shard, original) {
+			t.Errorf("shard %d isn't the same after the repair", i)
+		}
+	}
+	archive, err = findShardedArchive(t, dests)
+	if err != nil || len(archive.Missing()) != 0 {
+		t.Fatalf("after the repair Check gave %v, and %v are missing", err, archive.Missing())
+	}
+	reader := archive.reader()
+	got, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("the rebuilt archive is %d bytes (%v), expected the %d that were written", len(got), err, len(data))
+	}
+}
+
+func TestRepairShardedArchiveNeedsEnoughShards(t *testing.T) {
+	const name = "2024-01-02T03-04-05Z.tar"
+	erasure := Erasure{Data: 3, Parity: 2}
+	total := erasure.Data + erasure.Parity
+	dests := writeShardedArchive(t, erasure, name, randomBytes(t, 3*shardBlockSize), 5)
+
+	for _, i := range []int{0, 3, 4} { // One more than parity
+		err := os.Remove(shardPath(dests, name, i, total))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	archive, err := findShardedArchive(t, dests)
+	if err == nil {
+		t.Error("Check found enough shards")
+	}
+	_, err = RepairShardedArchive(archive, dests)
+	if err == nil {
+		t.Error("RepairShardedArchive rebuilt shards without enough intact ones")
+	}
+	for _, i := range []int{1, 2} {
+		if _, err := os.Stat(shardPath(dests, name, i, total)); err != nil {
+			t.Errorf("shard %d was removed: %s", i, err)
+		}
+	}
+}
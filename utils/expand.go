@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+/*
+ExpandPath turns a path from a config file into an absolute path
+
+args:
+
+	path string: The path as it was written in the config file
+	configDir string: The directory the config file is in, relative paths are resolved against it
+
+Expansion happens in this order:
+  - Environment variables, written as $NAME, ${NAME} or ${NAME:-default} (the default is used when NAME is unset or empty), $$ is a literal $
+  - Placeholders: {hostname}, {user} and {home}
+  - A leading ~ or ~/ (the current user's home directory) or ~name/ (another user's home directory)
+  - Relative paths are joined onto configDir
+
+ExpandPath returns an error for environment variables that are not set and have no default, and for unknown placeholders,
+rather than quietly producing a path that was not intended.
+*/
+func ExpandPath(path string, configDir string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+
+	path, err := ExpandValue(path)
+	if err != nil {
+		return "", err
+	}
+
+	path, err = expandHome(path)
+	if err != nil {
+		return "", err
+	}
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(configDir, path)
+	}
+	return filepath.Clean(path), nil
+}
+
+// ExpandDestination expands a destination, local paths go through ExpandPath while URLs only get environment variables and placeholders
+func ExpandDestination(destination string, configDir string) (string, error) {
+	if isURL(destination) {
+		return ExpandValue(destination)
+	}
+	return ExpandPath(destination, configDir)
+}
+
+// ExpandValue replaces environment variables and placeholders in a value that is not a local path, like a destination URL
+func ExpandValue(value string) (string, error) {
+	value, err := expandEnv(value)
+	if err != nil {
+		return "", err
+	}
+	return expandPlaceholders(value)
+}
+
+// expandEnv replaces environment variables, supporting ${NAME:-default}
+func expandEnv(path string) (string, error) {
+	var missing []string
+	path = os.Expand(path, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		name, fallback, hasDefault := strings.Cut(name, ":-")
+		value := os.Getenv(name)
+		if value == "" && hasDefault {
+			return fallback
+		}
+		if _, ok := os.LookupEnv(name); !ok {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set, set it or give it a default with ${%s:-default}", missing[0], missing[0])
+	}
+	return path, nil
+}
+
+// expandPlaceholders replaces {hostname}, {user} and {home}
+func expandPlaceholders(path string) (string, error) {
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(path, '{')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(path[start:], '}')
+		if end < 0 {
+			break
+		}
+		end += start
+
+		value, err := placeholder(path[start+1 : end])
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(path[:start])
+		b.WriteString(value)
+		path = path[end+1:]
+	}
+	b.WriteString(path)
+	return b.String(), nil
+}
+
+// placeholder returns the value of a single placeholder
+func placeholder(name string) (string, error) {
+	switch name {
+	case "hostname":
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", err
+		}
+		hostname, _, _ = strings.Cut(hostname, ".") // Just the machine name, without the domain
+		return hostname, nil
+	case "user":
+		usr, err := user.Current()
+		if err != nil {
+			return "", err
+		}
+		return usr.Username, nil
+	case "home":
+		usr, err := user.Current()
+		if err != nil {
+			return "", err
+		}
+		return usr.HomeDir, nil
+	default:
+		return "", fmt.Errorf("unknown placeholder {%s}, expected {hostname}, {user} or {home}", name)
+	}
+}
+
+// expandHome replaces a leading ~ or ~name with the matching home directory
+func expandHome(path string) (string, error) {
+	if !strings.HasPrefix(path, "~") {
+		return path, nil
+	}
+
+	name, rest, _ := strings.Cut(path[1:], string(filepath.Separator))
+	var usr *user.User
+	var err error
+	if name == "" {
+		usr, err = user.Current()
+	} else {
+		usr, err = user.Lookup(name)
+	}
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(usr.HomeDir, rest), nil
+}
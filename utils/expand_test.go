@@ -0,0 +1,86 @@
+//go:build !windows
+
+package utils
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExpandPath(t *testing.T) {
+	usr, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Skip(err)
+	}
+	hostname, _, _ = strings.Cut(hostname, ".")
+	t.Setenv("GAI_TEST_DIR", "/data/notes")
+	t.Setenv("GAI_TEST_EMPTY", "")
+	os.Unsetenv("GAI_TEST_UNSET")
+
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"/archive", "/archive", false},
+		{"/archive/../backups/", "/backups", false},
+		{"notes", "/etc/go-archive-it/notes", false},
+		{"../notes", "/etc/notes", false},
+		{"$GAI_TEST_DIR/daily", "/data/notes/daily", false},
+		{"${GAI_TEST_DIR}/daily", "/data/notes/daily", false},
+		{"${GAI_TEST_UNSET:-/fallback}/daily", "/fallback/daily", false},
+		{"${GAI_TEST_EMPTY:-/fallback}", "/fallback", false},
+		{"${GAI_TEST_DIR:-/fallback}", "/data/notes", false},
+		{"/cost/$$5", "/cost/$5", false},
+		{"/backups/{hostname}", "/backups/" + hostname, false},
+		{"/backups/{user}", "/backups/" + usr.Username, false},
+		{"{home}/notes", filepath.Join(usr.HomeDir, "notes"), false},
+		{"~", usr.HomeDir, false},
+		{"~/notes", filepath.Join(usr.HomeDir, "notes"), false},
+		{"~" + usr.Username + "/notes", filepath.Join(usr.HomeDir, "notes"), false},
+		{"$GAI_TEST_UNSET/notes", "", true},
+		{"$GAI_TEST_EMPTY/notes", "/notes", false}, // Set, even though it is empty
+		{"/backups/{host}", "", true},
+		{"~no-such-user-for-gai/notes", "", true},
+	}
+	for _, test := range tests {
+		got, err := ExpandPath(test.path, "/etc/go-archive-it")
+		switch {
+		case test.wantErr && err == nil:
+			t.Errorf("ExpandPath(%q) = %q, expected an error", test.path, got)
+		case !test.wantErr && err != nil:
+			t.Errorf("ExpandPath(%q): %s", test.path, err)
+		case got != test.want:
+			t.Errorf("ExpandPath(%q) = %q, expected %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestExpandDestination(t *testing.T) {
+	t.Setenv("GAI_TEST_BUCKET", "backups")
+	tests := []struct {
+		destination string
+		want        string
+	}{
+		{"s3://s3.example.com/$GAI_TEST_BUCKET/notes", "s3://s3.example.com/backups/notes"},
+		{"sftp://nas.local/~/archive", "sftp://nas.local/~/archive"}, // ~ is left for the server
+		{"webdav://cloud.example.com/remote.php/dav/files/alice/../archive", "webdav://cloud.example.com/remote.php/dav/files/alice/../archive"},
+		{"archive", "/etc/go-archive-it/archive"},
+	}
+	for _, test := range tests {
+		got, err := ExpandDestination(test.destination, "/etc/go-archive-it")
+		if err != nil {
+			t.Errorf("ExpandDestination(%q): %s", test.destination, err)
+		} else if got != test.want {
+			t.Errorf("ExpandDestination(%q) = %q, expected %q", test.destination, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Values of the git setting, for vaults that are git repositories
+const (
+	GitFiles  = "files"  // Tracked files, and untracked files that aren't ignored
+	GitBundle = "bundle" // A bundle of every ref, along with the changes that aren't committed yet
+)
+
+// Names of the files that a git bundle archive holds, next to the untracked files
+const (
+	gitBundleName = "repository.bundle"
+	gitPatchName  = "working-tree.patch"
+)
+
+/*
+gitArchive writes an archive of a vault that is a git repository to w, in the given format
+
+With git set to files, the archive holds the files that git would: tracked files, and untracked files that .gitignore
+doesn't ignore, so build output and dependencies are left out without excluding them by hand. The .git directory
+itself isn't archived.
+
+With git set to bundle, the archive holds a bundle of every ref (repository.bundle, see git-bundle), a patch with the
+changes to tracked files that aren't committed yet (working-tree.patch, only when there are any), and the untracked
+files that aren't ignored. It is restored with git clone repository.bundle, and git apply working-tree.patch.
+
+vault.Exclude applies to the files either way.
+*/
+func gitArchive(vault Vault, format string, w io.Writer, files *fileReader) error {
+	return compressed(format, w, func(w io.Writer) error {
+		tw := tar.NewWriter(w)
+		var err error
+		if vault.Git == GitBundle {
+			err = gitBundle(tw, vault, files)
+		} else {
+			paths, listErr := gitListFiles(vault.Path, "--cached", "--others", "--exclude-standard")
+			err = listErr
+			if err == nil {
+				err = addListed(tw, vault, paths, files)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		return tw.Close()
+	})
+}
+
+/*
+gitBundle adds a bundle of the repository, the uncommitted changes and the untracked files to the archive
+
+A repository without any refs yet (nothing was ever committed) has nothing to bundle, so the archive only has the patch,
+which then adds every tracked file. The same goes for HEAD on a branch without commits, its changes are against nothing.
+*/
+func gitBundle(tw *tar.Writer, vault Vault, files *fileReader) error {
+	out, err := os.CreateTemp("", "go-archive-it-*.bundle")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	var refs bytes.Buffer
+	err = runGit(vault.Path, &refs, "for-each-ref", "--count=1")
+	if err != nil {
+		return err
+	}
+	started := time.Now()
+	if refs.Len() > 0 {
+		err = runGit(vault.Path, out, "bundle", "create", "--quiet", "-", "--all")
+		if err != nil {
+			return err
+		}
+		err = addOutput(tw, gitBundleName, out, started)
+		if err != nil {
+			return err
+		}
+		_, err = out.Seek(0, io.SeekStart)
+		if err == nil {
+			err = out.Truncate(0)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	base, err := gitDiffBase(vault.Path)
+	if err != nil {
+		return err
+	}
+	err = runGit(vault.Path, out, "diff", base, "--binary")
+	if err != nil {
+		return err
+	}
+	if size, _ := out.Seek(0, io.SeekCurrent); size > 0 {
+		err = addOutput(tw, gitPatchName, out, started)
+		if err != nil {
+			return err
+		}
+	}
+
+	paths, err := gitListFiles(vault.Path, "--others", "--exclude-standard")
+	if err != nil {
+		return err
+	}
+	return addListed(tw, vault, paths, files)
+}
+
+// gitDiffBase returns what the uncommitted changes are against: HEAD, or the empty tree when HEAD has no commits yet
+func gitDiffBase(dir string) (string, error) {
+	err := runGit(dir, io.Discard, "rev-parse", "--verify", "--quiet", "HEAD")
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		return "HEAD", err
+	}
+	var tree bytes.Buffer
+	err = runGit(dir, &tree, "hash-object", "-t", "tree", "--stdin") // Of nothing, so it works for SHA-1 and SHA-256 repositories
+	return strings.TrimSpace(tree.String()), err
+}
+
+// runGit runs git in dir with its output going to w
+func runGit(dir string, w io.Writer, args ...string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("git %s: %w: %s", args[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+// gitListFiles lists files with git ls-files, relative to dir
+func gitListFiles(dir string, args ...string) ([]string, error) {
+	var out bytes.Buffer
+	err := runGit(dir, &out, append([]string{"ls-files", "-z"}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	seen := make(map[string]bool) // Files with merge conflicts are listed once for each side
+	for _, path := range strings.Split(out.String(), "\x00") {
+		if path != "" && !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// addListed adds files listed by git (relative to the vault) to the archive, along the lines of tarArchive
+func addListed(tw *tar.Writer, vault Vault, paths []string, files *fileReader) error {
+	for _, rel := range paths {
+		path := filepath.Join(vault.Path, filepath.FromSlash(rel))
+		if isExcludedListed(path, vault.Path, vault.Exclude) || isSQLiteCompanion(path) {
+			continue
+		}
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue // Tracked, but deleted from the working tree
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			log.Printf("[git] %s: %s is a submodule, it isn't archived, add it as a vault of its own", vault.Name, rel)
+			continue
+		}
+		err = addFile(tw, path, vault.Path, vault.Exclude, files)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isExcludedListed reports whether a file or any of the directories it is in is excluded, see isExcluded
+func isExcludedListed(path string, vaultPath string, exclude []string) bool {
+	for ; path != vaultPath && strings.HasPrefix(path, vaultPath); path = filepath.Dir(path) {
+		if isExcluded(path, vaultPath, exclude) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkGitRepository returns an error when a directory is not in a git working tree, or git isn't installed
+func checkGitRepository(dir string) error {
+	var out bytes.Buffer
+	err := runGit(dir, &out, "rev-parse", "--is-inside-work-tree")
+	if err == nil && strings.TrimSpace(out.String()) != "true" {
+		err = fmt.Errorf("it is not in a git working tree")
+	}
+	return err
+}
@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// git runs git in dir for a test, and returns its output
+func git(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %s: %s", strings.Join(args, " "), err, out)
+	}
+	return string(out)
+}
+
+// gitTest skips the test when git isn't installed, and keeps the user's git config out of it
+func gitTest(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	for _, name := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		t.Setenv(name, "Test")
+	}
+	for _, name := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(name, "test@example.com")
+	}
+}
+
+// writeTree writes files under dir, making the directories they are in
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		if err == nil {
+			err = os.WriteFile(path, []byte(data), 0o644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+/*
+gitRepository makes a repository with files that are committed, a submodule, files that are ignored, untracked and
+deleted, and a change that isn't committed yet
+*/
+func gitRepository(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	git(t, dir, "init", "-q")
+	writeTree(t, dir, map[string]string{
+		".gitignore":   "build/\n",
+		"a.md":         "first\n",
+		"notes/b.md":   "b\n",
+		"deleted.md":   "deleted\n",
+		"scratch.tmp":  "excluded, but tracked\n",
+		"lib/README":   "a submodule\n",
+		"build/out.js": "ignored\n",
+	})
+	git(t, filepath.Join(dir, "lib"), "init", "-q")
+	git(t, filepath.Join(dir, "lib"), "add", ".")
+	git(t, filepath.Join(dir, "lib"), "commit", "-q", "-m", "lib")
+	git(t, dir, "add", ".")
+	git(t, dir, "commit", "-q", "-m", "first")
+
+	writeTree(t, dir, map[string]string{"a.md": "second\n", "untracked.md": "untracked\n", "untracked.tmp": "excluded\n"})
+	err := os.Remove(filepath.Join(dir, "deleted.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// gitArchiveFiles archives a git vault as a tar archive, and returns the files in it and what was logged
+func gitArchiveFiles(t *testing.T, vault Vault) (map[string]string, string) {
+	t.Helper()
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	var archive bytes.Buffer
+	err := gitArchive(vault, FormatTar, &archive, newFileReader(vault))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tarFiles(t, archive.Bytes(), FormatTar), logged.String()
+}
+
+func TestGitFiles(t *testing.T) {
+	gitTest(t)
+	dir := gitRepository(t)
+	vault := Vault{Name: "app", Path: dir, Settings: Settings{Git: GitFiles, Exclude: []string{"*.tmp"}}}
+	files, logged := gitArchiveFiles(t, vault)
+	want := map[string]string{
+		".gitignore":   "build/\n",
+		"a.md":         "second\n", // As it is in the working tree
+		"notes/b.md":   "b\n",
+		"untracked.md": "untracked\n",
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("the archive has %v, expected %v", sortedNames(files), sortedNames(want))
+	}
+	if !strings.Contains(logged, "lib is a submodule, it isn't archived") {
+		t.Errorf("the submodule wasn't reported, the log has %q", logged)
+	}
+}
+
+func TestGitBundle(t *testing.T) {
+	gitTest(t)
+	dir := gitRepository(t)
+	vault := Vault{Name: "app", Path: dir, Settings: Settings{Git: GitBundle, Exclude: []string{"*.tmp"}}}
+	files, _ := gitArchiveFiles(t, vault)
+	if got := sortedNames(files); !reflect.DeepEqual(got, []string{gitBundleName, "untracked.md", gitPatchName}) {
+		t.Fatalf("the archive has %v", got)
+	}
+
+	// Restored the way the README says
+	restored := filepath.Join(t.TempDir(), "app")
+	writeTree(t, filepath.Dir(restored), map[string]string{gitBundleName: files[gitBundleName], gitPatchName: files[gitPatchName]})
+	git(t, filepath.Dir(restored), "clone", "-q", gitBundleName, "app")
+	git(t, restored, "apply", "../"+gitPatchName)
+	for name, want := range map[string]string{"a.md": "second\n", "notes/b.md": "b\n", "scratch.tmp": "excluded, but tracked\n"} {
+		if got, err := os.ReadFile(filepath.Join(restored, name)); err != nil || string(got) != want {
+			t.Errorf("%s was restored as %q (%v), expected %q", name, got, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(restored, "deleted.md")); !os.IsNotExist(err) {
+		t.Errorf("deleted.md was restored (%v)", err)
+	}
+}
+
+func TestGitWithoutCommits(t *testing.T) {
+	gitTest(t)
+	dir := t.TempDir()
+	git(t, dir, "init", "-q")
+	writeTree(t, dir, map[string]string{"a.md": "staged\n", "b.md": "untracked\n"})
+	git(t, dir, "add", "a.md")
+
+	vault := Vault{Name: "app", Path: dir, Settings: Settings{Git: GitFiles}}
+	files, _ := gitArchiveFiles(t, vault)
+	if want := map[string]string{"a.md": "staged\n", "b.md": "untracked\n"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("the archive has %v", files)
+	}
+
+	vault.Git = GitBundle
+	files, _ = gitArchiveFiles(t, vault)
+	if got := sortedNames(files); !reflect.DeepEqual(got, []string{"b.md", gitPatchName}) {
+		t.Fatalf("the archive has %v", got)
+	}
+	restored := t.TempDir()
+	git(t, restored, "init", "-q")
+	writeTree(t, restored, map[string]string{gitPatchName: files[gitPatchName]})
+	git(t, restored, "apply", gitPatchName)
+	if got, err := os.ReadFile(filepath.Join(restored, "a.md")); err != nil || string(got) != "staged\n" {
+		t.Errorf("a.md was restored as %q (%v)", got, err)
+	}
+
+	// Commits on another branch are bundled, while the changes are against nothing
+	git(t, dir, "commit", "-q", "-m", "first")
+	git(t, dir, "checkout", "-q", "--orphan", "empty")
+	files, _ = gitArchiveFiles(t, vault)
+	if got := sortedNames(files); !reflect.DeepEqual(got, []string{"b.md", gitBundleName, gitPatchName}) {
+		t.Errorf("on a branch without commits the archive has %v", got)
+	}
+}
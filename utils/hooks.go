@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DefaultHookTimeout is how long a hook may run when its vault doesn't set hooks.timeout
+const DefaultHookTimeout = 10 * time.Minute
+
+/*
+HookRun describes a vault's run to its hooks, through environment variables
+
+	GAI_HOOK           The hook that is running: pre, post, onSuccess or onFailure
+	GAI_VAULT_NAME     The vault's name
+	GAI_VAULT_PATH     The directory that is archived
+	GAI_ARCHIVE        The archive's file name, once it is known
+	GAI_ARCHIVE_PATHS  Where the archive was saved, one destination per line
+	GAI_STATUS         success or failure, once the archive was made (or a pre hook failed), or skipped when the vault
+	                   was unchanged (GAI_ARCHIVE is then its last archive, and onSuccess runs)
+	GAI_ERROR          What went wrong, on failure
+
+Post hooks run whether or not the archive was saved, so they can undo what the pre hooks did (like resuming a sync
+client), and look at GAI_STATUS for the outcome.
+*/
+type HookRun struct {
+	Vault   Vault
+	Results []TargetResult // Set once the vault was archived
+	Err     error          // Why the vault could not be archived, if it wasn't
+}
+
+// Failed reports whether the vault could not be archived to one of its destinations
+func (run HookRun) Failed() bool {
+	if run.Err != nil {
+		return true
+	}
+	for _, result := range run.Results {
+		if result.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// env returns the environment for one of the vault's hooks
+func (run HookRun) env(hook string) []string {
+	env := append(os.Environ(), "GAI_HOOK="+hook, "GAI_VAULT_NAME="+run.Vault.Name, "GAI_VAULT_PATH="+run.Vault.Path)
+
+	var paths []string
+	var errs []string
+	if run.Err != nil {
+		errs = append(errs, run.Err.Error())
+	}
+	for _, result := range run.Results {
+		if result.Err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", result.Destination, result.Err))
+			continue
+		}
+		paths = append(paths, strings.TrimSuffix(result.Destination, "/")+"/"+result.Name)
+	}
+	if len(run.Results) > 0 {
+		env = append(env, "GAI_ARCHIVE="+run.Results[0].Name, "GAI_ARCHIVE_PATHS="+strings.Join(paths, "\n"))
+	}
+	switch {
+	case run.Failed():
+		env = append(env, "GAI_STATUS=failure", "GAI_ERROR="+strings.Join(errs, "\n"))
+	case hook != "pre" && len(run.Results) > 0 && run.Results[0].Skipped:
+		env = append(env, "GAI_STATUS=skipped")
+	case hook != "pre":
+		env = append(env, "GAI_STATUS=success")
+	}
+	return env
+}
+
+/*
+RunHooks runs the vault's commands for one hook (pre, post, onSuccess or onFailure) in order with `sh -c`, in the vault's directory
+(or the home directory, for a command vault)
+
+Each command gets the environment described by HookRun, and is stopped once it runs longer than the vault's
+hooks.timeout, along with anything it started in the background (see killProcessGroup). The combined output of every
+command is logged. RunHooks stops at the first command that fails and returns an error describing it.
+*/
+func RunHooks(hook string, run HookRun) error {
+	var commands []string
+	switch hook {
+	case "pre":
+		commands = run.Vault.Hooks.Pre
+	case "post":
+		commands = run.Vault.Hooks.Post
+	case "onSuccess":
+		commands = run.Vault.Hooks.OnSuccess
+	case "onFailure":
+		commands = run.Vault.Hooks.OnFailure
+	default:
+		return fmt.Errorf("unknown hook %q", hook)
+	}
+	timeout := DefaultHookTimeout
+	if run.Vault.Hooks.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(run.Vault.Hooks.Timeout)
+		if err != nil {
+			return fmt.Errorf("hooks timeout: %w", err) // LoadConfig rejects these, so this should never happen
+		}
+	}
+
+	for _, command := range commands {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		cmd := exec.CommandContext(ctx, "sh", "-c", command)
+		cmd.Dir = run.Vault.workDir()
+		cmd.Env = run.env(hook)
+		killProcessGroup(cmd)
+		cmd.WaitDelay = 5 * time.Second // Commands started in the background can keep the output open after sh is killed
+		output, err := cmd.CombinedOutput()
+		timedOut := errors.Is(ctx.Err(), context.DeadlineExceeded)
+		cancel()
+		if len(output) > 0 {
+			log.Printf("[hook] %s %s %s:\n%s", run.Vault.Name, hook, command, output)
+		}
+		if timedOut {
+			return fmt.Errorf("%s hook %q was stopped after %s", hook, command, timeout)
+		}
+		if err != nil {
+			return fmt.Errorf("%s hook %q failed: %w", hook, command, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package utils
+
+import "os/exec"
+
+// killProcessGroup leaves cmd alone where there are no process groups, only the hook's shell is stopped
+func killProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+/*
+httpStallTimeout is how long a server can go without taking any of a request or sending any of its response, before
+the request is given up on
+
+A fixed timeout for the whole request would cut off large archives on slow connections, so only the time spent waiting
+for the server counts, see doHTTP.
+*/
+var httpStallTimeout = 2 * time.Minute
+
+// newHTTPClient returns a client for destinations that are reached over HTTP
+func newHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone() // Which already limits connecting and TLS handshakes
+	transport.ResponseHeaderTimeout = httpStallTimeout
+	return &http.Client{Transport: transport}
+}
+
+/*
+doHTTP sends a request, and cancels it once the server has stalled for httpStallTimeout
+
+The time spent waiting for the request body (an archive that is still being made) and for the response body to be
+read (by whatever it is being copied to) doesn't count, so a slow vault or a slow destination on the other end of a
+copy isn't taken for a server that stopped responding.
+*/
+func doHTTP(client *http.Client, req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	watch := &stallWatch{cancel: cancel}
+	watch.timer = time.AfterFunc(httpStallTimeout, watch.fire)
+	req = req.WithContext(ctx)
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &stallRequestBody{req.Body, watch}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		watch.stop()
+		return nil, watch.explain(err)
+	}
+	watch.timer.Stop() // Until the response body is read
+	resp.Body = &stallResponseBody{resp.Body, watch}
+	return resp, nil
+}
+
+// stallWatch cancels a request when its timer runs out, the timer only runs while the server is being waited for
+type stallWatch struct {
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	stalled atomic.Bool
+}
+
+func (w *stallWatch) fire() {
+	w.stalled.Store(true)
+	w.cancel()
+}
+
+func (w *stallWatch) stop() {
+	w.timer.Stop()
+	w.cancel()
+}
+
+// explain says that the server stalled, for errors that come from the request being cancelled
+func (w *stallWatch) explain(err error) error {
+	if err != nil && err != io.EOF && w.stalled.Load() {
+		return fmt.Errorf("the server stopped responding for %s: %w", httpStallTimeout, err)
+	}
+	return err
+}
+
+// stallRequestBody stops the timer while the request body is read, and starts it again while it is sent
+type stallRequestBody struct {
+	io.ReadCloser
+	watch *stallWatch
+}
+
+func (b *stallRequestBody) Read(p []byte) (int, error) {
+	b.watch.timer.Stop()
+	n, err := b.ReadCloser.Read(p)
+	b.watch.timer.Reset(httpStallTimeout)
+	return n, err
+}
+
+// stallResponseBody only runs the timer while the response body is being read
+type stallResponseBody struct {
+	io.ReadCloser
+	watch *stallWatch
+}
+
+func (b *stallResponseBody) Read(p []byte) (int, error) {
+	b.watch.timer.Reset(httpStallTimeout)
+	n, err := b.ReadCloser.Read(p)
+	b.watch.timer.Stop()
+	return n, b.watch.explain(err)
+}
+
+func (b *stallResponseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.watch.stop()
+	return err
+}
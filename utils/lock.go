@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// errLocked is returned by lockFile when another process holds the lock
+var errLocked = errors.New("locked")
+
+/*
+LockVault takes the vault's run lock, so that a scheduled run, watch and a run started by hand never archive the same
+vault at the same time, and returns the function that releases it
+
+The locks are files in the user's cache directory (like ~/.cache/go-archive-it/locks), locked with flock, so a lock
+is released by the system when the process holding it exits, however it exits. When the lock is held by another
+process, the error says which one. Where flock isn't available (Windows), vaults aren't locked.
+*/
+func LockVault(vault Vault) (func(), error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	dir = filepath.Join(dir, "go-archive-it", "locks")
+	err = os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+	// Vaults with the same name in different configs are told apart by what they archive
+	sum := sha256.Sum256([]byte(vault.Name + "\x00" + vault.Path + "\x00" + vault.Command))
+	name := filepath.Join(dir, fmt.Sprintf("%s-%x.lock", safeFileName(vault.Name), sum[:6]))
+
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	err = lockFile(file)
+	if err == errLocked {
+		holder, _ := io.ReadAll(file)
+		file.Close()
+		if pid := strings.TrimSpace(string(holder)); pid != "" {
+			return nil, fmt.Errorf("it is already being archived by another run (pid %s)", pid)
+		}
+		return nil, errors.New("it is already being archived by another run")
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("locking %s: %w", name, err)
+	}
+	// The pid is only there to be reported, the lock itself is what keeps other runs out
+	if file.Truncate(0) == nil {
+		file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return func() {
+		file.Truncate(0)
+		file.Close()
+	}, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package utils
+
+import "os"
+
+// lockFile doesn't lock anything where flock isn't available, so runs aren't kept from archiving a vault at the same time
+func lockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,185 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+/*
+VaultSlug derives a vault name from its path, for vaults that are not given a name in the config
+
+The path is made relative to the home directory when it is inside of it, and every character that is not a letter,
+digit, '.', '_' or '-' is replaced with '-'. So ~/work/notes becomes "work-notes" and /srv/notes becomes "srv-notes",
+which keeps vaults with the same base name apart while staying the same from one run to the next.
+*/
+func VaultSlug(path string, home string) string {
+	path = filepath.Clean(path)
+	if home != "" && isWithin(path, home) {
+		rel, err := filepath.Rel(home, path)
+		if err == nil {
+			path = rel
+		}
+		if path == "." {
+			return "home"
+		}
+	}
+
+	var b strings.Builder
+	dash := true // Avoids a leading dash, and more than one in a row
+	for _, r := range path {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			b.WriteRune(r)
+			dash = r == '-'
+		case !dash:
+			b.WriteRune('-')
+			dash = true
+		}
+	}
+
+	slug := strings.Trim(b.String(), "-.")
+	if slug == "" {
+		return "root"
+	}
+	return slug
+}
+
+// assignNames gives every vault that doesn't have a name one derived from its path
+func (config *Config) assignNames() {
+	home := ""
+	if usr, err := user.Current(); err == nil {
+		home = usr.HomeDir
+	}
+	for i := range config.Vaults {
+		if config.Vaults[i].Name == "" {
+			config.Vaults[i].Name = VaultSlug(config.Vaults[i].Path, home)
+		}
+	}
+}
+
+// legacyArchiveDir is where archives for a vault were stored in a destination before vaults had names
+func legacyArchiveDir(vault Vault, destination string) string {
+	return filepath.Join(destination, filepath.Base(vault.Path))
+}
+
+// localTarget is a vault along with one of its local destinations
+type localTarget struct {
+	vault       Vault
+	destination string
+}
+
+// localTargets lists the local destinations of every vault, remote destinations were added after the old layout was gone
+func localTargets(config Config) []localTarget {
+	var targets []localTarget
+	for _, vault := range config.Vaults {
+		if vault.Path == "" {
+			continue // Command vaults came after the old layout too
+		}
+		for _, target := range vault.Destinations {
+			if !isURL(target.Destination) {
+				targets = append(targets, localTarget{vault, target.Destination})
+			}
+		}
+	}
+	return targets
+}
+
+/*
+MigrateArchives moves archive directories from the old layout, named after the base name of the vault's path,
+to the directory named after the vault
+
+If the new directory already exists (because the vault was archived before migrating) the archives are moved into it.
+Directories that were shared by more than one vault are left alone, since there is no way to tell whose archives are whose,
+and a warning is logged for each of them instead. So are directories that another vault now uses under its own name.
+*/
+func MigrateArchives(config Config) error {
+	claimed := make(map[string]bool) // Directories that belong to a vault under the new layout
+	sharing := make(map[string][]Vault)
+	targets := localTargets(config)
+	for _, target := range targets {
+		claimed[filepath.Join(target.destination, target.vault.Name)] = true
+		old := legacyArchiveDir(target.vault, target.destination)
+		sharing[old] = append(sharing[old], target.vault)
+	}
+
+	warned := make(map[string]bool)
+	for _, target := range targets {
+		old := legacyArchiveDir(target.vault, target.destination)
+		current := filepath.Join(target.destination, target.vault.Name)
+		if old == current || claimed[old] {
+			continue
+		}
+		if _, err := os.Stat(old); err != nil {
+			continue // Nothing to move
+		}
+		if len(sharing[old]) > 1 {
+			if !warned[old] {
+				warned[old] = true
+				names := make([]string, 0, len(sharing[old]))
+				for _, v := range sharing[old] {
+					names = append(names, v.Path)
+				}
+				log.Printf("%s holds archives for %s, move them into the right vault directories by hand", old, strings.Join(names, ", "))
+			}
+			continue
+		}
+
+		err := mergeDir(old, current)
+		if err != nil {
+			return fmt.Errorf("moving %s to %s: %w", old, current, err)
+		}
+		log.Printf("Moved %s to %s", old, current)
+	}
+	return nil
+}
+
+// mergeDir moves every file from src into dst (creating it if needed) and removes src once it is empty
+func mergeDir(src string, dst string) error {
+	if _, err := os.Stat(dst); os.IsNotExist(err) {
+		return os.Rename(src, dst)
+	}
+
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		target := filepath.Join(dst, entry.Name())
+		if _, err := os.Lstat(target); err == nil {
+			return fmt.Errorf("%s already exists", target)
+		}
+		err = os.Rename(filepath.Join(src, entry.Name()), target)
+		if err != nil {
+			return err
+		}
+	}
+	return os.Remove(src)
+}
+
+// CheckLegacyArchives logs a hint for every vault that still has archives in the old layout
+func CheckLegacyArchives(config Config) {
+	claimed := make(map[string]bool)
+	targets := localTargets(config)
+	for _, target := range targets {
+		claimed[filepath.Join(target.destination, target.vault.Name)] = true
+	}
+
+	for _, target := range targets {
+		old := legacyArchiveDir(target.vault, target.destination)
+		current := filepath.Join(target.destination, target.vault.Name)
+		if old == current || claimed[old] {
+			continue
+		}
+		if _, err := os.Stat(old); err != nil {
+			continue
+		}
+		if _, err := os.Stat(current); err == nil {
+			continue
+		}
+		log.Printf("Archives for %s are still in %s, run `go-archive-it config migrate` to move them to %s", target.vault.Path, old, current)
+	}
+}
@@ -0,0 +1,97 @@
+//go:build !windows
+
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVaultSlug(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/home/alice/work/notes", "work-notes"},
+		{"/home/alice/work/notes/", "work-notes"},
+		{"/home/alice", "home"},
+		{"/home/alice/My Notes (old)", "My-Notes-old"},
+		{"/home/alice/.dotfiles", "dotfiles"},
+		{"/home/alice/a//b", "a-b"},
+		{"/home/alicesmith/notes", "home-alicesmith-notes"}, // Not inside /home/alice
+		{"/srv/notes", "srv-notes"},
+		{"/srv/notes.v2_old-1", "srv-notes.v2_old-1"},
+		{"/srv/日記", "srv"},
+		{"/", "root"},
+	}
+	for _, test := range tests {
+		if got := VaultSlug(test.path, "/home/alice"); got != test.want {
+			t.Errorf("VaultSlug(%q) = %q, expected %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestMigrateArchives(t *testing.T) {
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "archive")
+	mkdir := func(path string) string {
+		t.Helper()
+		err := os.MkdirAll(path, 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	touch := func(path string) {
+		t.Helper()
+		err := os.WriteFile(path, nil, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+
+	// notes was archived to archive/notes, and is now named work-notes
+	notes := mkdir(filepath.Join(dir, "work", "notes"))
+	touch(filepath.Join(mkdir(filepath.Join(dest, "notes")), "2024-05-01T09:00:00Z.tar.gz"))
+	// photos already has archives under its new name, and some left in the old directory
+	photos := mkdir(filepath.Join(dir, "photos"))
+	touch(filepath.Join(mkdir(filepath.Join(dest, "photos")), "2024-05-01T09:00:00Z.tar"))
+	touch(filepath.Join(mkdir(filepath.Join(dest, "my-photos")), "2024-06-01T09-00-00Z.tar"))
+	// Two vaults named src shared archive/src, so whose archives are whose can't be told
+	a := mkdir(filepath.Join(dir, "a", "src"))
+	b := mkdir(filepath.Join(dir, "b", "src"))
+	touch(filepath.Join(mkdir(filepath.Join(dest, "src")), "2024-05-01T09:00:00Z.tar.gz"))
+
+	target := []Target{{Destination: dest, Retention: 5}}
+	config := Config{Vaults: []Vault{
+		{Name: "work-notes", Path: notes, Settings: Settings{Destinations: target}},
+		{Name: "my-photos", Path: photos, Settings: Settings{Destinations: target}},
+		{Name: "a-src", Path: a, Settings: Settings{Destinations: target}},
+		{Name: "b-src", Path: b, Settings: Settings{Destinations: target}},
+	}}
+	err := MigrateArchives(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{
+		"work-notes/2024-05-01T09:00:00Z.tar.gz",
+		"my-photos/2024-05-01T09:00:00Z.tar",
+		"my-photos/2024-06-01T09-00-00Z.tar",
+		"src/2024-05-01T09:00:00Z.tar.gz",
+	} {
+		if !exists(filepath.Join(dest, path)) {
+			t.Errorf("%s is missing after migrating", path)
+		}
+	}
+	for _, path := range []string{"notes", "photos", "a-src", "b-src"} {
+		if exists(filepath.Join(dest, path)) {
+			t.Errorf("%s is still there after migrating", path)
+		}
+	}
+}
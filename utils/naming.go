@@ -0,0 +1,255 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+/*
+DefaultNaming is the naming template used when a vault doesn't set its own
+
+It gives names like 2006-01-02T15-04-05Z.tar.gz, which sort by time and can be written to FAT/exFAT drives and SMB shares.
+*/
+const DefaultNaming = "{utc}"
+
+// Default time layouts for the {utc} and {local} tokens, neither has characters that are unsafe in file names
+const (
+	defaultUTCLayout   = "2006-01-02T15-04-05Z"
+	defaultLocalLayout = "2006-01-02T15-04-05-0700"
+)
+
+// legacyName matches the RFC3339 names that archives were given before naming templates
+var legacyName = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(Z|[+-]\d{2}:\d{2})\.(tar|tar\.gz|tar\.zst)$`)
+
+// namingToken is one {name} or {name:arg} in a naming template, or a run of literal text when name is empty
+type namingToken struct {
+	name    string
+	arg     string
+	literal string
+}
+
+/*
+parseNaming splits a naming template into tokens
+
+The tokens are:
+  - {utc} or {utc:LAYOUT}: The time the archive was started in UTC, LAYOUT is a Go time layout (e.g. 20060102-150405)
+  - {local} or {local:LAYOUT}: The same, in local time
+  - {hostname}: The name of the machine, without the domain
+  - {vault}: The name of the vault
+  - {seq} or {seq:WIDTH}: A sequence number, the lowest one that doesn't collide with an existing archive, zero padded to WIDTH
+  - {tag}: The tag given with -t, or nothing
+*/
+func parseNaming(template string) ([]namingToken, error) {
+	var tokens []namingToken
+	for template != "" {
+		start := strings.IndexByte(template, '{')
+		if start < 0 {
+			tokens = append(tokens, namingToken{literal: template})
+			break
+		}
+		if start > 0 {
+			tokens = append(tokens, namingToken{literal: template[:start]})
+		}
+		end := strings.IndexByte(template[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed { in naming template")
+		}
+		end += start
+
+		name, arg, _ := strings.Cut(template[start+1:end], ":")
+		switch name {
+		case "utc", "local", "hostname", "vault", "tag":
+		case "seq":
+			if arg != "" {
+				if width, err := strconv.Atoi(arg); err != nil || width < 1 || width > 9 {
+					return nil, fmt.Errorf("{seq:%s} needs a width between 1 and 9", arg)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unknown token {%s} in naming template, expected {utc}, {local}, {hostname}, {vault}, {seq} or {tag}", name)
+		}
+		tokens = append(tokens, namingToken{name: name, arg: arg})
+		template = template[end+1:]
+	}
+
+	for _, token := range tokens {
+		if token.name == "utc" || token.name == "local" || token.name == "seq" {
+			return tokens, nil
+		}
+	}
+	return nil, fmt.Errorf("naming template needs a {utc}, {local} or {seq} token so that archives get different names")
+}
+
+// CheckNaming reports whether a naming template can be used
+func CheckNaming(template string) error {
+	_, err := parseNaming(template)
+	return err
+}
+
+// renderNaming fills in a naming template, leaving the result safe to use as a file name
+func renderNaming(tokens []namingToken, vault Vault, tag string, now time.Time, seq int) string {
+	var b strings.Builder
+	for _, token := range tokens {
+		switch token.name {
+		case "":
+			b.WriteString(token.literal)
+		case "utc":
+			b.WriteString(now.UTC().Format(layoutOr(token.arg, defaultUTCLayout)))
+		case "local":
+			b.WriteString(now.Local().Format(layoutOr(token.arg, defaultLocalLayout)))
+		case "hostname":
+			hostname, _ := placeholder("hostname")
+			b.WriteString(hostname)
+		case "vault":
+			b.WriteString(vault.Name)
+		case "seq":
+			width := 1
+			if token.arg != "" {
+				width, _ = strconv.Atoi(token.arg)
+			}
+			b.WriteString(fmt.Sprintf("%0*d", width, seq))
+		case "tag":
+			b.WriteString(tag)
+		}
+	}
+	return strings.Trim(safeFileName(b.String()), "-_. ") // Empty tokens at the ends would leave stray separators
+}
+
+func layoutOr(layout string, fallback string) string {
+	if layout == "" {
+		return fallback
+	}
+	return layout
+}
+
+// safeFileName replaces the characters that FAT, exFAT, NTFS and SMB don't allow in file names
+func safeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '-'
+		}
+		return r
+	}, name)
+}
+
+/*
+ArchiveName picks the file name for a new archive
+
+args:
+
+	vault Vault: The vault being archived, its Naming and Format are used
+	tag string: The value for {tag}
+	now time.Time: The time the archive was started
+	exists func(string) bool: Reports whether an archive with a given name is already stored
+
+When the name is already taken the sequence number is increased, or a -2, -3, ... suffix is added if the template has no {seq} token.
+*/
+func ArchiveName(vault Vault, tag string, now time.Time, exists func(string) bool) (string, error) {
+	tokens, err := parseNaming(namingOr(vault.Naming))
+	if err != nil {
+		return "", err
+	}
+	extension := "." + vault.Format
+
+	hasSeq := false
+	for _, token := range tokens {
+		hasSeq = hasSeq || token.name == "seq"
+	}
+
+	for seq := 1; seq < 100000; seq++ {
+		name := renderNaming(tokens, vault, tag, now, seq)
+		if !hasSeq && seq > 1 {
+			name = fmt.Sprintf("%s-%d", name, seq)
+		}
+		if !exists(name + extension) {
+			return name + extension, nil
+		}
+	}
+	return "", fmt.Errorf("could not find a free archive name for %s", vault.Name)
+}
+
+func namingOr(template string) string {
+	if template == "" {
+		return DefaultNaming
+	}
+	return template
+}
+
+/*
+archivePattern returns a regular expression that matches the names of archives made with a vault's naming template
+
+Cleanup uses it to tell archives apart from anything else in the archive directory. Times are matched loosely
+(runs of digits and runs of letters), since the layout can't be turned back into an exact pattern.
+*/
+func archivePattern(vault Vault) (*regexp.Regexp, error) {
+	tokens, err := parseNaming(namingOr(vault.Naming))
+	if err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	b.WriteString(`^[-_. ]*`)
+	for _, token := range tokens {
+		switch token.name {
+		case "":
+			if strings.Trim(token.literal, "-_. ") == "" {
+				b.WriteString(`[-_. ]*`) // Separators next to an empty {tag} are trimmed by renderNaming
+			} else {
+				b.WriteString(regexp.QuoteMeta(safeFileName(token.literal)))
+			}
+		case "utc", "local":
+			layout := layoutOr(token.arg, defaultUTCLayout)
+			if token.name == "local" {
+				layout = layoutOr(token.arg, defaultLocalLayout)
+			}
+			b.WriteString(loosePattern(safeFileName(time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC).Format(layout))))
+		case "hostname":
+			b.WriteString(`[^/]*?`) // Archives from other machines sharing the directory count as well
+		case "vault":
+			b.WriteString(regexp.QuoteMeta(safeFileName(vault.Name)))
+		case "seq":
+			b.WriteString(`\d+`)
+		case "tag":
+			b.WriteString(`[^/]*?`)
+		}
+	}
+	b.WriteString(`[-_. ]*?(-\d+)?\.(tar|tar\.gz|tar\.zst)$`)
+	return regexp.Compile(b.String())
+}
+
+// loosePattern turns an example time into a pattern, with runs of digits and letters matching any run of the same kind
+func loosePattern(example string) string {
+	var b strings.Builder
+	runes := []rune(example)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		j := i + 1
+		switch {
+		case unicode.IsDigit(r):
+			for j < len(runes) && unicode.IsDigit(runes[j]) {
+				j++
+			}
+			b.WriteString(`\d+`)
+		case unicode.IsLetter(r):
+			for j < len(runes) && unicode.IsLetter(runes[j]) {
+				j++
+			}
+			b.WriteString(`[A-Za-z]+`)
+		case r == '+' || r == '-':
+			b.WriteString(`[-+]`) // Time zone offsets can go either way
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+		i = j
+	}
+	return b.String()
+}
+
+// isArchive reports whether a file in a vault's archive directory is one of its archives
+func isArchive(name string, pattern *regexp.Regexp) bool {
+	return legacyName.MatchString(name) || pattern.MatchString(name)
+}
@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckNaming(t *testing.T) {
+	valid := []string{"{utc}", "{local:20060102}", "{seq}", "{vault}-{seq:4}", "{hostname}_{utc}_{tag}", "backup {utc:2006-01-02}"}
+	invalid := []string{"", "{vault}", "{tag}-{hostname}", "{utc", "{date}", "{seq:0}", "{seq:10}", "{seq:x}"}
+	for _, template := range valid {
+		if err := CheckNaming(template); err != nil {
+			t.Errorf("CheckNaming(%q): %s", template, err)
+		}
+	}
+	for _, template := range invalid {
+		if CheckNaming(template) == nil {
+			t.Errorf("CheckNaming(%q) accepted it", template)
+		}
+	}
+}
+
+func TestArchiveName(t *testing.T) {
+	now := time.Date(2024, 5, 1, 9, 30, 15, 0, time.UTC)
+	none := func(string) bool { return false }
+	tests := []struct {
+		naming string
+		tag    string
+		format string
+		taken  []string
+		want   string
+	}{
+		{"", "", FormatTarGz, nil, "2024-05-01T09-30-15Z.tar.gz"},
+		{"{utc:2006-01-02 15:04}", "", FormatTar, nil, "2024-05-01 09-30.tar"}, // : isn't allowed on FAT or SMB
+		{"{vault}-{seq:3}", "", FormatTarZst, nil, "notes-001.tar.zst"},
+		{"{vault}-{seq:3}", "", FormatTarZst, []string{"notes-001.tar.zst", "notes-002.tar.zst"}, "notes-003.tar.zst"},
+		{"{utc}", "", FormatTarGz, []string{"2024-05-01T09-30-15Z.tar.gz"}, "2024-05-01T09-30-15Z-2.tar.gz"},
+		{"{utc}_{tag}", "weekly", FormatTarGz, nil, "2024-05-01T09-30-15Z_weekly.tar.gz"},
+		{"{utc}_{tag}", "", FormatTarGz, nil, "2024-05-01T09-30-15Z.tar.gz"}, // No stray separator
+		{"{tag}/{utc}", "a/b", FormatTar, nil, "a-b-2024-05-01T09-30-15Z.tar"},
+	}
+	for _, test := range tests {
+		vault := Vault{Name: "notes", Settings: Settings{Naming: test.naming, Format: test.format}}
+		exists := none
+		if test.taken != nil {
+			exists = func(name string) bool {
+				for _, taken := range test.taken {
+					if name == taken {
+						return true
+					}
+				}
+				return false
+			}
+		}
+		got, err := ArchiveName(vault, test.tag, now, exists)
+		if err != nil {
+			t.Errorf("ArchiveName(%q): %s", test.naming, err)
+		} else if got != test.want {
+			t.Errorf("ArchiveName(%q) = %q, expected %q", test.naming, got, test.want)
+		}
+	}
+}
+
+func TestArchivePatternMatchesArchiveNames(t *testing.T) {
+	namings := []string{
+		"",
+		"{utc}",
+		"{local}",
+		"{local:Mon 02 Jan 2006 15.04}",
+		"{vault}-{utc:20060102-150405}",
+		"{hostname}_{utc}",
+		"{utc}_{tag}",
+		"{tag}-{seq:5}",
+		"backup {seq}",
+	}
+	zones := []*time.Location{time.UTC, time.FixedZone("east", 5*3600+30*60), time.FixedZone("west", -7*3600)}
+	times := []time.Time{
+		time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		time.Date(2024, 12, 31, 23, 59, 59, 0, time.UTC),
+	}
+	local := time.Local
+	t.Cleanup(func() { time.Local = local })
+
+	for _, naming := range namings {
+		vault := Vault{Name: "work-notes", Settings: Settings{Naming: naming, Format: FormatTarGz}}
+		pattern, err := archivePattern(vault)
+		if err != nil {
+			t.Fatalf("archivePattern(%q): %s", naming, err)
+		}
+		for _, zone := range zones {
+			time.Local = zone
+			for _, now := range times {
+				for _, tag := range []string{"", "weekly"} {
+					for _, collide := range []bool{false, true} { // So that -2 suffixes and sequence numbers are matched as well
+						tries := 0
+						name, err := ArchiveName(vault, tag, now, func(string) bool { tries++; return collide && tries == 1 })
+						if err != nil {
+							t.Fatal(err)
+						}
+						if !isArchive(name, pattern) {
+							t.Errorf("naming %q in %s: %q isn't matched by %s", naming, zone, name, pattern)
+						}
+					}
+				}
+			}
+		}
+
+		for _, other := range []string{
+			"notes.txt",
+			"2024-01-02T03-04-05Z.tar.gz.recovery",
+			"2024-01-02T03-04-05Z.tar.gz.manifest",
+			"2024-01-02T03-04-05Z.tar.gz.part001",
+			"2024-01-02T03-04-05Z.zip",
+		} {
+			if isArchive(other, pattern) {
+				t.Errorf("naming %q: %q is taken for an archive", naming, other)
+			}
+		}
+	}
+}
+
+func TestArchivePatternKeepsVaultsApart(t *testing.T) {
+	notes := Vault{Name: "notes", Settings: Settings{Naming: "{vault}-{utc}", Format: FormatTar}}
+	pattern, err := archivePattern(notes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{
+		"notes-2024-01-02T03-04-05Z.tar":        true,
+		"notes-2024-01-02T03-04-05Z-2.tar":      true,
+		"2024-01-02T03:04:05Z.tar":              true, // Named before naming templates
+		"photos-2024-01-02T03-04-05Z.tar":       false,
+		"notes-old-2024-01-02T03-04-05Z.tar":    false,
+		"notes-2024-01-02T03-04-05Z.tar.backup": false,
+	} {
+		if got := isArchive(name, pattern); got != want {
+			t.Errorf("isArchive(%q) = %v, expected %v", name, got, want)
+		}
+	}
+}
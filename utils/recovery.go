@@ -0,0 +1,761 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+/*
+Recovery data
+
+With recovery set, every archive gets a NAME.recovery file next to it with Reed-Solomon parity for the archive, in the
+spirit of PAR2. The archive is cut into blocks, and the blocks are coded in groups: with recovery set to 10 (percent),
+a group of 200 blocks gets 20 parity blocks, so any 20 damaged blocks in the group can be rebuilt. The SHA-256 of every
+block is stored as well, which is how the damaged ones are found.
+
+The file is a header, a record for each group (the hashes of its blocks and of its parity blocks, a checksum of
+those hashes, then the parity blocks), and a trailer with the archive's size.
+*/
+
+const (
+	recoveryBlockSize  = 64 << 10
+	recoveryMaxGroup   = 200 // Data blocks in a group, unless the code can't fit that many next to the parity
+	recoveryHeaderSize = 32
+	recoveryMagic      = "GAIREC1\x00"
+	recoverySuffix     = ".recovery"
+)
+
+// ErrRecoveryDamaged is returned by VerifyArchive when an archive's recovery data is damaged, see RebuildRecovery
+var ErrRecoveryDamaged = errors.New("its recovery data is damaged")
+
+// recoveryGroupSize returns the number of data blocks in each group, so that a group and its parity fit in the 255 blocks of the code
+func recoveryGroupSize(percent int) int {
+	k := recoveryMaxGroup
+	for k+recoveryParity(k, percent) > 255 {
+		k--
+	}
+	return k
+}
+
+// recoveryParity returns the number of parity blocks for a group of data blocks
+func recoveryParity(data int, percent int) int {
+	return maxInt((data*percent+99)/100, 1)
+}
+
+// recoveryEncoder writes the recovery data for an archive as the archive is written to it
+type recoveryEncoder struct {
+	w        *bufio.Writer
+	percent  int
+	group    []byte // The data blocks of the group that is being filled
+	buffered int
+	size     int64
+	parity   [][]byte
+	codes    map[[2]int]*reedSolomon
+}
+
+// newRecoveryEncoder returns an encoder that writes recovery data to w, with percent of the archive's size in parity
+func newRecoveryEncoder(w io.Writer, percent int) (*recoveryEncoder, error) {
+	e := &recoveryEncoder{w: bufio.NewWriterSize(w, 1<<20), percent: percent, codes: make(map[[2]int]*reedSolomon)}
+	groupSize := recoveryGroupSize(percent)
+	e.group = make([]byte, groupSize*recoveryBlockSize)
+
+	header := make([]byte, recoveryHeaderSize)
+	copy(header, recoveryMagic)
+	binary.BigEndian.PutUint32(header[8:], recoveryBlockSize)
+	binary.BigEndian.PutUint16(header[12:], uint16(groupSize))
+	binary.BigEndian.PutUint16(header[14:], uint16(percent))
+	_, err := e.w.Write(header)
+	return e, err
+}
+
+func (e *recoveryEncoder) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(e.group[e.buffered:], p)
+		e.buffered += n
+		e.size += int64(n)
+		written += n
+		p = p[n:]
+		if e.buffered == len(e.group) {
+			err := e.writeGroup()
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// writeGroup writes the record for the blocks that are buffered
+func (e *recoveryEncoder) writeGroup() error {
+	k := (e.buffered + recoveryBlockSize - 1) / recoveryBlockSize
+	m := recoveryParity(k, e.percent)
+	rs := e.codes[[2]int{k, m}]
+	if rs == nil {
+		var err error
+		rs, err = newReedSolomon(k, m)
+		if err != nil {
+			return err
+		}
+		e.codes[[2]int{k, m}] = rs
+	}
+	for i := e.buffered; i < k*recoveryBlockSize; i++ {
+		e.group[i] = 0 // Padding for the last block
+	}
+	for len(e.parity) < m {
+		e.parity = append(e.parity, make([]byte, recoveryBlockSize))
+	}
+
+	blocks := make([][]byte, k+m)
+	record := make([]byte, 8, 8+(k+m+1)*sha256.Size)
+	binary.BigEndian.PutUint16(record[0:], uint16(k))
+	binary.BigEndian.PutUint16(record[2:], uint16(m))
+	for i := 0; i < k; i++ {
+		blocks[i] = e.group[i*recoveryBlockSize : (i+1)*recoveryBlockSize]
+		sum := sha256.Sum256(blocks[i][:minInt(recoveryBlockSize, e.buffered-i*recoveryBlockSize)])
+		record = append(record, sum[:]...)
+	}
+	copy(blocks[k:], e.parity[:m])
+	rs.encode(blocks)
+	for _, block := range blocks[k:] {
+		sum := sha256.Sum256(block)
+		record = append(record, sum[:]...)
+	}
+	sum := sha256.Sum256(record)
+	record = append(record, sum[:]...)
+
+	_, err := e.w.Write(record)
+	for _, block := range blocks[k:] {
+		if err == nil {
+			_, err = e.w.Write(block)
+		}
+	}
+	e.buffered = 0
+	return err
+}
+
+// Close writes the last group and the trailer
+func (e *recoveryEncoder) Close() error {
+	if e.buffered > 0 {
+		err := e.writeGroup()
+		if err != nil {
+			return err
+		}
+	}
+	trailer := make([]byte, 16, 16+sha256.Size) // A record without blocks
+	binary.BigEndian.PutUint64(trailer[8:], uint64(e.size))
+	sum := sha256.Sum256(trailer)
+	_, err := e.w.Write(append(trailer, sum[:]...))
+	if err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+// recoveryIndex is what the recovery data says about an archive
+type recoveryIndex struct {
+	blockSize int
+	groupSize int // Data blocks in every group but the last
+	size      int64
+	hashes    [][sha256.Size]byte // Of every data block
+	groups    []recoveryGroup
+}
+
+type recoveryGroup struct {
+	first        int // The group's first data block
+	data         int
+	parityHashes [][sha256.Size]byte
+	parityOK     []bool
+	parity       [][]byte // Only kept for the groups readRecovery is asked to keep
+}
+
+// blockLength returns the length of a data block, only the last one can be short
+func (index *recoveryIndex) blockLength(block int) int {
+	return int(minInt64(int64(index.blockSize), index.size-int64(block)*int64(index.blockSize)))
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// repairable reports whether every group has enough intact parity blocks to rebuild its damaged blocks
+func (index *recoveryIndex) repairable(damaged []int) bool {
+	counts := make(map[int]int)
+	for _, block := range damaged {
+		counts[block/index.groupSize]++
+	}
+	for g, count := range counts {
+		intact := 0
+		for _, ok := range index.groups[g].parityOK {
+			if ok {
+				intact++
+			}
+		}
+		if count > intact {
+			return false
+		}
+	}
+	return true
+}
+
+// readRecovery reads an archive's recovery data, keeping the parity blocks of the groups that keep asks for (keep may be nil)
+func readRecovery(r io.Reader, keep func(group int) bool) (*recoveryIndex, error) {
+	br := bufio.NewReaderSize(r, 1<<20)
+	header := make([]byte, recoveryHeaderSize)
+	_, err := io.ReadFull(br, header)
+	if err != nil {
+		return nil, err
+	}
+	if string(header[:8]) != recoveryMagic {
+		return nil, errors.New("it has no recovery header")
+	}
+	index := &recoveryIndex{blockSize: int(binary.BigEndian.Uint32(header[8:])), groupSize: int(binary.BigEndian.Uint16(header[12:]))}
+	if index.blockSize < 1 || index.groupSize < 1 || index.groupSize > 254 {
+		return nil, errors.New("its header is damaged")
+	}
+
+	block := make([]byte, index.blockSize)
+	for g := 0; ; g++ {
+		counts := make([]byte, 8)
+		_, err := io.ReadFull(br, counts)
+		if err != nil {
+			return nil, fmt.Errorf("group %d: %w", g+1, err)
+		}
+		k, m := int(binary.BigEndian.Uint16(counts[0:])), int(binary.BigEndian.Uint16(counts[2:]))
+
+		if k == 0 && m == 0 {
+			trailer := make([]byte, 8+sha256.Size)
+			_, err := io.ReadFull(br, trailer)
+			if err != nil {
+				return nil, fmt.Errorf("trailer: %w", err)
+			}
+			sum := sha256.Sum256(append(counts, trailer[:8]...))
+			if !bytes.Equal(sum[:], trailer[8:]) {
+				return nil, errors.New("its trailer is damaged")
+			}
+			index.size = int64(binary.BigEndian.Uint64(trailer))
+			blocks := (index.size + int64(index.blockSize) - 1) / int64(index.blockSize)
+			if int64(len(index.hashes)) != blocks {
+				return nil, fmt.Errorf("it has %d blocks, but its trailer says the archive has %d", len(index.hashes), blocks)
+			}
+			return index, nil
+		}
+
+		short := g > 0 && index.groups[g-1].data != index.groupSize // Only the last group can be short
+		if k < 1 || k > index.groupSize || m < 1 || k+m > 255 || short {
+			return nil, fmt.Errorf("group %d is damaged", g+1)
+		}
+		hashes := make([]byte, (k+m+1)*sha256.Size)
+		_, err = io.ReadFull(br, hashes)
+		if err != nil {
+			return nil, fmt.Errorf("group %d: %w", g+1, err)
+		}
+		sum := sha256.Sum256(append(counts, hashes[:(k+m)*sha256.Size]...))
+		if !bytes.Equal(sum[:], hashes[(k+m)*sha256.Size:]) {
+			return nil, fmt.Errorf("group %d is damaged", g+1)
+		}
+
+		group := recoveryGroup{first: len(index.hashes), data: k}
+		for i := 0; i < k+m; i++ {
+			var hash [sha256.Size]byte
+			copy(hash[:], hashes[i*sha256.Size:])
+			if i < k {
+				index.hashes = append(index.hashes, hash)
+			} else {
+				group.parityHashes = append(group.parityHashes, hash)
+			}
+		}
+		kept := keep != nil && keep(g)
+		for i := 0; i < m; i++ {
+			_, err := io.ReadFull(br, block)
+			if err != nil {
+				return nil, fmt.Errorf("group %d: %w", g+1, err)
+			}
+			group.parityOK = append(group.parityOK, sha256.Sum256(block) == group.parityHashes[i])
+			if kept {
+				group.parity = append(group.parity, append([]byte(nil), block...))
+			}
+		}
+		index.groups = append(index.groups, group)
+	}
+}
+
+// damagedParity returns the number of parity blocks that don't match their hashes
+func (index *recoveryIndex) damagedParity() int {
+	damaged := 0
+	for _, group := range index.groups {
+		for _, ok := range group.parityOK {
+			if !ok {
+				damaged++
+			}
+		}
+	}
+	return damaged
+}
+
+// loadRecovery reads the recovery data of an archive from a destination, see readRecovery
+func loadRecovery(dest Destination, archive ArchiveInfo, keep func(group int) bool) (*recoveryIndex, error) {
+	reader, err := dest.Open(archive.Name + recoverySuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return readRecovery(reader, keep)
+}
+
+// HasRecovery reports whether an archive has recovery data stored next to it
+func (archive ArchiveInfo) HasRecovery() bool {
+	for _, sidecar := range archive.Sidecars {
+		if sidecar.Name == archive.Name+recoverySuffix {
+			return true
+		}
+	}
+	return false
+}
+
+// DamagedError is returned by VerifyArchive when an archive's recovery data shows that some of its blocks are damaged
+type DamagedError struct {
+	Blocks     int  // The number of damaged blocks
+	Total      int  // The number of blocks in the archive
+	Extra      bool // The archive is longer than it was when it was made
+	Repairable bool // Whether RepairArchive can rebuild the archive
+	Err        error
+}
+
+func (e *DamagedError) Error() string {
+	message := fmt.Sprintf("%d of %d blocks are damaged", e.Blocks, e.Total)
+	if e.Blocks == 0 && e.Extra {
+		message = "it is longer than it was when it was made"
+	}
+	if e.Repairable {
+		message += ", run repair to rebuild it from its recovery data"
+	} else {
+		message += ", too many to rebuild from its recovery data"
+	}
+	if e.Err != nil {
+		message += fmt.Sprintf(" (%s)", e.Err)
+	}
+	return message
+}
+
+func (e *DamagedError) Unwrap() error {
+	return e.Err
+}
+
+// blockChecker compares the blocks of an archive with the hashes in its recovery data, as the archive is written to it
+type blockChecker struct {
+	index    *recoveryIndex
+	block    []byte
+	buffered int
+	blocks   int // Blocks checked so far
+	extra    bool
+	damaged  []int
+}
+
+func newBlockChecker(index *recoveryIndex) *blockChecker {
+	return &blockChecker{index: index, block: make([]byte, index.blockSize)}
+}
+
+func (c *blockChecker) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := copy(c.block[c.buffered:], p)
+		c.buffered += n
+		p = p[n:]
+		if c.buffered == len(c.block) {
+			c.check()
+		}
+	}
+	return written, nil
+}
+
+func (c *blockChecker) check() {
+	if c.blocks >= len(c.index.hashes) {
+		c.extra = true
+	} else {
+		length := c.index.blockLength(c.blocks)
+		if c.buffered > length {
+			c.extra = true
+		}
+		if c.buffered < length || sha256.Sum256(c.block[:length]) != c.index.hashes[c.blocks] {
+			c.damaged = append(c.damaged, c.blocks)
+		}
+	}
+	c.blocks++
+	c.buffered = 0
+}
+
+// finish checks the last block, counts the blocks that were never written as damaged, and returns the damage if there is any
+func (c *blockChecker) finish(err error) *DamagedError {
+	if c.buffered > 0 {
+		c.check()
+	}
+	for ; c.blocks < len(c.index.hashes); c.blocks++ {
+		c.damaged = append(c.damaged, c.blocks)
+	}
+	if len(c.damaged) == 0 && !c.extra {
+		return nil
+	}
+	return &DamagedError{Blocks: len(c.damaged), Total: len(c.index.hashes), Extra: c.extra, Repairable: c.index.repairable(c.damaged), Err: err}
+}
+
+/*
+RepairArchive rebuilds the damaged blocks of an archive from its recovery data, and returns the number of blocks it rebuilt
+
+The repaired archive is put together in a temporary file and checked against the recovery data, then it replaces
+the damaged archive in the destination. If that fails after the damaged archive was removed, the error says where the
+temporary file was kept.
+*/
+func RepairArchive(dest Destination, archive ArchiveInfo) (int, error) {
+	index, err := loadRecovery(dest, archive, nil)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrRecoveryDamaged, err)
+	}
+
+	reader, err := openArchive(dest, archive)
+	if err != nil {
+		return 0, err
+	}
+	checker := newBlockChecker(index)
+	_, err = io.Copy(checker, reader)
+	reader.Close()
+	if err != nil {
+		return 0, err
+	}
+	damage := checker.finish(nil)
+	if damage == nil {
+		return 0, nil
+	}
+	if !damage.Repairable {
+		return 0, damage
+	}
+
+	damagedGroups := make(map[int]bool)
+	for _, block := range checker.damaged {
+		damagedGroups[block/index.groupSize] = true
+	}
+	index, err = loadRecovery(dest, archive, func(group int) bool { return damagedGroups[group] })
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrRecoveryDamaged, err)
+	}
+
+	tmp, err := os.CreateTemp("", "go-archive-it-repair-*")
+	if err != nil {
+		return 0, err
+	}
+	keep := false
+	defer func() {
+		tmp.Close()
+		if !keep {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	reader, err = openArchive(dest, archive)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	rebuilt, err := rebuildBlocks(reader, tmp, index)
+	if err != nil {
+		return 0, err
+	}
+
+	names, err := replaceArchive(dest, archive, io.NewSectionReader(tmp, 0, index.size))
+	if err != nil {
+		keep = true
+		return 0, fmt.Errorf("saving the repaired archive: %w, it was kept at %s", err, tmp.Name())
+	}
+	if setter, ok := dest.(modTimeSetter); ok && !archive.ModTime.IsZero() {
+		for _, name := range names {
+			setter.setModTime(name, archive.ModTime) // Keeps the archive in the same place for retention
+		}
+	}
+	return rebuilt, nil
+}
+
+// rebuildBlocks copies an archive from r to w a group at a time, rebuilding the damaged blocks, and returns how many it rebuilt
+func rebuildBlocks(r io.Reader, w io.Writer, index *recoveryIndex) (int, error) {
+	bs := index.blockSize
+	blocks := make([][]byte, 255)
+	for i := range blocks {
+		blocks[i] = make([]byte, bs)
+	}
+
+	rebuilt := 0
+	for g, group := range index.groups {
+		var have, want []int
+		for i := 0; i < group.data; i++ {
+			block := group.first + i
+			length := index.blockLength(block)
+			n, err := io.ReadFull(r, blocks[i][:length])
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return rebuilt, err
+			}
+			for j := n; j < bs; j++ {
+				blocks[i][j] = 0
+			}
+			if n == length && sha256.Sum256(blocks[i][:length]) == index.hashes[block] {
+				have = append(have, i)
+			} else {
+				want = append(want, i)
+			}
+		}
+
+		if len(want) > 0 {
+			if len(group.parity) == 0 {
+				return rebuilt, fmt.Errorf("group %d changed while it was being repaired", g+1)
+			}
+			for j, ok := range group.parityOK {
+				if ok {
+					copy(blocks[group.data+j], group.parity[j])
+					have = append(have, group.data+j)
+				}
+			}
+			rs, err := newReedSolomon(group.data, len(group.parityOK))
+			if err != nil {
+				return rebuilt, err
+			}
+			decoder, err := rs.decoder(have)
+			if err != nil {
+				return rebuilt, fmt.Errorf("group %d: %w", g+1, err)
+			}
+			decoder(blocks, want)
+			for _, i := range want {
+				block := group.first + i
+				if sha256.Sum256(blocks[i][:index.blockLength(block)]) != index.hashes[block] {
+					return rebuilt, fmt.Errorf("block %d could not be rebuilt", block+1)
+				}
+			}
+			rebuilt += len(want)
+		}
+
+		for i := 0; i < group.data; i++ {
+			_, err := w.Write(blocks[i][:index.blockLength(group.first+i)])
+			if err != nil {
+				return rebuilt, err
+			}
+		}
+	}
+	return rebuilt, nil
+}
+
+/*
+RebuildRecovery makes new recovery data for an archive from the archive itself, with percent of its size in parity
+
+This is for when the recovery data is damaged, and only works on an archive that can be shown to be intact without it.
+What is left of the old recovery data is used for that (see salvageRecovery): a block that it still has the hash of has
+to match it. The blocks it no longer vouches for are covered by the checksums of a compressed archive, but a plain tar
+has none, so its recovery data is only rebuilt when every block can be checked.
+
+The new recovery data is saved under a temporary name first, and replaces the old only once all of it is in the destination.
+*/
+func RebuildRecovery(dest Destination, archive ArchiveInfo, percent int) error {
+	tmp, err := os.CreateTemp("", "go-archive-it-*"+recoverySuffix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	name := archive.Name + recoverySuffix
+	var old *recoveryIndex
+	var known []bool
+	if archive.HasRecovery() {
+		reader, err := dest.Open(name)
+		if err != nil {
+			return err
+		}
+		old, known = salvageRecovery(reader, archive.Size)
+		reader.Close()
+	}
+
+	encoder, err := newRecoveryEncoder(tmp, percent)
+	if err != nil {
+		return err
+	}
+	reader, err := openArchive(dest, archive)
+	if err != nil {
+		return err
+	}
+	counter := &countingReader{r: reader}
+	r := io.TeeReader(counter, encoder)
+	var checker *blockChecker
+	if old != nil {
+		checker = newBlockChecker(old)
+		r = io.TeeReader(r, checker)
+	}
+	_, err = readArchive(r, archive.Name) // Checks the checksums of a compressed archive
+	if err == nil {
+		_, err = io.Copy(io.Discard, r)
+	}
+	reader.Close()
+	if err == nil && archive.Size > 0 && counter.n != archive.Size {
+		err = fmt.Errorf("read %d bytes, but %s reports %d", counter.n, dest, archive.Size)
+	}
+	if err != nil {
+		return fmt.Errorf("the archive is damaged: %w", err)
+	}
+
+	blocks := int((counter.n + recoveryBlockSize - 1) / recoveryBlockSize)
+	unchecked := blocks
+	if checker != nil {
+		checker.finish(nil)
+		unchecked = 0
+		for _, block := range checker.damaged {
+			if known[block] {
+				return fmt.Errorf("the archive is damaged, block %d doesn't match its recovery data", block+1)
+			}
+			unchecked++
+		}
+	}
+	if unchecked > 0 && strings.HasSuffix(archive.Name, "."+FormatTar) {
+		return fmt.Errorf("%d of %d blocks of the archive can't be checked without its recovery data, and a tar archive has no checksums of its own", unchecked, blocks)
+	}
+	err = encoder.Close()
+	if err != nil {
+		return err
+	}
+
+	temp := "." + name + ".new"
+	err = uploadFile(dest, temp, tmp)
+	if err != nil {
+		return err
+	}
+	err = replaceFile(dest, temp, name, tmp, archive.HasRecovery())
+	if err != nil {
+		return err
+	}
+	if setter, ok := dest.(modTimeSetter); ok && !archive.ModTime.IsZero() {
+		return setter.setModTime(name, archive.ModTime)
+	}
+	return nil
+}
+
+/*
+salvageRecovery reads what can still be trusted of damaged recovery data, for an archive of the given size
+
+Every group's record has a checksum of its own, and where each record is follows from the header and the archive's size,
+so a damaged record (or damaged parity) only loses the hashes of its own group. known tells which blocks' hashes were read.
+The index is nil when the header is damaged, and it has no parity.
+*/
+func salvageRecovery(r io.Reader, size int64) (index *recoveryIndex, known []bool) {
+	br := bufio.NewReaderSize(r, 1<<20)
+	header := make([]byte, recoveryHeaderSize)
+	_, err := io.ReadFull(br, header)
+	if err != nil || string(header[:8]) != recoveryMagic {
+		return nil, nil
+	}
+	index = &recoveryIndex{blockSize: int(binary.BigEndian.Uint32(header[8:])), groupSize: int(binary.BigEndian.Uint16(header[12:])), size: size}
+	percent := int(binary.BigEndian.Uint16(header[14:]))
+	if index.blockSize < 1 || index.groupSize < 1 || index.groupSize > 254 || percent < 1 || size < 1 {
+		return nil, nil
+	}
+
+	blocks := int((size + int64(index.blockSize) - 1) / int64(index.blockSize))
+	index.hashes = make([][sha256.Size]byte, blocks)
+	known = make([]bool, blocks)
+	readable := true
+	for first := 0; first < blocks; first += index.groupSize {
+		k := minInt(index.groupSize, blocks-first)
+		m := recoveryParity(k, percent)
+		index.groups = append(index.groups, recoveryGroup{first: first, data: k})
+		if !readable {
+			continue
+		}
+		record := make([]byte, 8+(k+m+1)*sha256.Size)
+		_, err := io.ReadFull(br, record)
+		if err == nil {
+			_, err = br.Discard(m * index.blockSize)
+		}
+		readable = err == nil
+
+		hashes := record[8 : 8+(k+m)*sha256.Size]
+		sum := sha256.Sum256(record[:len(record)-sha256.Size])
+		counts := int(binary.BigEndian.Uint16(record[0:])) == k && int(binary.BigEndian.Uint16(record[2:])) == m
+		if !counts || !bytes.Equal(sum[:], record[len(record)-sha256.Size:]) {
+			continue
+		}
+		for i := 0; i < k; i++ {
+			copy(index.hashes[first+i][:], hashes[i*sha256.Size:])
+			known[first+i] = true
+		}
+	}
+	return index, known
+}
+
+// replacer is implemented by destinations that can move a file over another one
+type replacer interface {
+	replace(from string, to string) error
+}
+
+/*
+replaceFile moves a file that was uploaded under a temporary name to its own, replacing the file that is there (if exists is set)
+
+Destinations that can't move files get the local copy uploaded again under its own name, and only then is the temporary file removed.
+*/
+func replaceFile(dest Destination, temp string, name string, local *os.File, exists bool) error {
+	if r, ok := dest.(replacer); ok {
+		err := r.replace(temp, name)
+		if err != nil {
+			dest.Delete(temp)
+		}
+		return err
+	}
+	if exists {
+		err := dest.Delete(name)
+		if err != nil {
+			dest.Delete(temp)
+			return err
+		}
+	}
+	err := uploadFile(dest, name, local)
+	if err != nil {
+		return fmt.Errorf("%w, a copy was kept as %s", err, temp)
+	}
+	return dest.Delete(temp)
+}
+
+// uploadFile copies a local file to a destination, see upload
+func uploadFile(dest Destination, name string, file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return upload(dest, name, io.NewSectionReader(file, 0, info.Size()))
+}
+
+// upload copies part of a local file to a destination, and checks its size once it is saved
+func upload(dest Destination, name string, r *io.SectionReader) error {
+	writer, err := dest.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, r)
+	if err != nil {
+		writer.Abort()
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+	saved, err := dest.Stat(name)
+	if err != nil {
+		return err
+	}
+	if saved.Size != r.Size() {
+		return fmt.Errorf("%s is %d bytes, but %d were written", name, saved.Size, r.Size())
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const recoveredArchive = "2024-01-02T03-04-05Z.tar"
+
+/*
+writeRecoveredArchive writes a tar archive with 10% recovery data to a local destination, and returns the destination,
+the archive's contents and the number of parity blocks it has
+*/
+func writeRecoveredArchive(t *testing.T) (localDestination, []byte, int) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	content := randomBytes(t, 38*recoveryBlockSize+5000)
+	err := tw.WriteHeader(&tar.Header{Name: "notes.md", Mode: 0o644, Size: int64(len(content))})
+	if err == nil {
+		_, err = tw.Write(content)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest, index := saveWithRecovery(t, recoveredArchive, archive.Bytes())
+	if len(index.groups) != 1 {
+		t.Fatalf("the recovery data has %d groups", len(index.groups))
+	}
+	return dest, archive.Bytes(), len(index.groups[0].parityOK)
+}
+
+// saveWithRecovery stores an archive with 10% recovery data in a new local destination
+func saveWithRecovery(t *testing.T, name string, archive []byte) (localDestination, *recoveryIndex) {
+	var recovery bytes.Buffer
+	encoder, err := newRecoveryEncoder(&recovery, 10)
+	if err == nil {
+		_, err = encoder.Write(archive)
+	}
+	if err == nil {
+		err = encoder.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := newLocalDestination(t, map[string]string{
+		name:                  string(archive),
+		name + recoverySuffix: recovery.String(),
+	})
+
+	index, err := readRecovery(&recovery, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dest, index
+}
+
+// findArchive returns the archive from ListArchives, with its recovery data as a sidecar
+func findArchive(t *testing.T, dest Destination) ArchiveInfo {
+	t.Helper()
+	archives, err := ListArchives(Vault{Name: "notes"}, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archives) != 1 || !archives[0].HasRecovery() {
+		t.Fatalf("ListArchives gave %+v", archives)
+	}
+	return archives[0]
+}
+
+// flipBytes changes a byte of a file at each of the offsets, counting back from the end for negative ones
+func flipBytes(t *testing.T, file string, offsets ...int) {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, offset := range offsets {
+		if offset < 0 {
+			offset += len(data)
+		}
+		data[offset] ^= 0xff
+	}
+	err = os.WriteFile(file, data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepairArchive(t *testing.T) {
+	block := func(i int) int { return i*recoveryBlockSize + 100 }
+	tests := []struct {
+		name       string
+		damage     func(file string, parity int) // Damages the archive
+		blocks     func(parity int) int          // How many blocks are damaged
+		repairable bool
+	}{
+		{
+			"one block",
+			func(file string, parity int) { flipBytes(t, file, block(3)) },
+			func(int) int { return 1 },
+			true,
+		},
+		{
+			"a byte at each end of a block",
+			func(file string, parity int) { flipBytes(t, file, block(5)-100, block(6)-101) },
+			func(int) int { return 1 },
+			true,
+		},
+		{
+			"as many blocks as there are parity blocks, and the short last block",
+			func(file string, parity int) {
+				offsets := []int{-1}
+				for i := 0; i < parity-1; i++ {
+					offsets = append(offsets, block(i*7))
+				}
+				flipBytes(t, file, offsets...)
+			},
+			func(parity int) int { return parity },
+			true,
+		},
+		{
+			"the end cut off",
+			func(file string, parity int) {
+				info, err := os.Stat(file)
+				if err == nil {
+					err = os.Truncate(file, info.Size()-recoveryBlockSize)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			func(int) int { return 2 }, // The short last block and the one before it
+			true,
+		},
+		{
+			"one more block than there are parity blocks",
+			func(file string, parity int) {
+				var offsets []int
+				for i := 0; i <= parity; i++ {
+					offsets = append(offsets, block(i*3))
+				}
+				flipBytes(t, file, offsets...)
+			},
+			func(parity int) int { return parity + 1 },
+			false,
+		},
+	}
+	for _, test := range tests {
+		dest, original, parity := writeRecoveredArchive(t)
+		file := filepath.Join(dest.dir, recoveredArchive)
+		test.damage(file, parity)
+		damaged, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		archive := findArchive(t, dest)
+		_, err = VerifyArchive(dest, archive)
+		var damage *DamagedError
+		if !errors.As(err, &damage) {
+			t.Errorf("%s: VerifyArchive gave %v, expected a *DamagedError", test.name, err)
+			continue
+		}
+		if damage.Blocks != test.blocks(parity) || damage.Repairable != test.repairable {
+			t.Errorf("%s: VerifyArchive found %d damaged blocks (repairable %v), expected %d (%v)", test.name, damage.Blocks, damage.Repairable, test.blocks(parity), test.repairable)
+		}
+
+		rebuilt, err := RepairArchive(dest, archive)
+		got, readErr := os.ReadFile(file)
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		if !test.repairable {
+			if !errors.As(err, &damage) {
+				t.Errorf("%s: RepairArchive gave %v, expected a *DamagedError", test.name, err)
+			}
+			if !bytes.Equal(got, damaged) {
+				t.Errorf("%s: RepairArchive changed an archive it couldn't repair", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if rebuilt != test.blocks(parity) {
+			t.Errorf("%s: rebuilt %d blocks, expected %d", test.name, rebuilt, test.blocks(parity))
+		}
+		if !bytes.Equal(got, original) {
+			t.Errorf("%s: the repaired archive isn't the original", test.name)
+		}
+		if _, err := VerifyArchive(dest, findArchive(t, dest)); err != nil {
+			t.Errorf("%s: after the repair VerifyArchive gave %s", test.name, err)
+		}
+	}
+}
+
+func TestDamagedRecoveryData(t *testing.T) {
+	// The recovery data is a header, the counts and hashes of the group, then its parity blocks
+	tests := []struct {
+		name      string
+		offset    func(data, parity int) int
+		readable  bool // Whether RepairArchive can still use the recovery data
+		checkable bool // Whether what is left of it still has the hash of every block, so RebuildRecovery can check the archive
+	}{
+		{"header", func(int, int) int { return 2 }, false, false},
+		{"hashes", func(int, int) int { return recoveryHeaderSize + 8 + 40 }, false, false},
+		{"parity block", func(data, parity int) int { return recoveryHeaderSize + 8 + (data+parity+1)*sha256.Size + 10 }, true, true},
+		{"trailer", func(int, int) int { return -1 }, false, true},
+	}
+	for _, test := range tests {
+		dest, original, parity := writeRecoveredArchive(t)
+		data := (len(original) + recoveryBlockSize - 1) / recoveryBlockSize
+		flipBytes(t, filepath.Join(dest.dir, recoveredArchive+recoverySuffix), test.offset(data, parity))
+
+		archive := findArchive(t, dest)
+		files, err := VerifyArchive(dest, archive)
+		if !errors.Is(err, ErrRecoveryDamaged) || files != 1 {
+			t.Errorf("%s: VerifyArchive gave %d files and %v, expected the recovery data to be damaged", test.name, files, err)
+		}
+		_, err = RepairArchive(dest, archive)
+		if test.readable && err != nil || !test.readable && !errors.Is(err, ErrRecoveryDamaged) {
+			t.Errorf("%s: RepairArchive gave %v", test.name, err)
+		}
+
+		recoveryFile := filepath.Join(dest.dir, recoveredArchive+recoverySuffix)
+		damaged, err := os.ReadFile(recoveryFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = RebuildRecovery(dest, archive, 10)
+		if !test.checkable {
+			// A tar archive has no checksums, so there is nothing else to check it against
+			if err == nil || !strings.Contains(err.Error(), "can't be checked") {
+				t.Errorf("%s: RebuildRecovery gave %v, expected it to refuse an archive it can't check", test.name, err)
+			}
+			if got, _ := os.ReadFile(recoveryFile); !bytes.Equal(got, damaged) {
+				t.Errorf("%s: RebuildRecovery replaced the recovery data of an archive it couldn't check", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readFiles(t, dest); len(got) != 2 {
+			t.Errorf("%s: after RebuildRecovery the destination has %d files", test.name, len(got))
+		}
+		if _, err := VerifyArchive(dest, findArchive(t, dest)); err != nil {
+			t.Errorf("%s: after RebuildRecovery VerifyArchive gave %s", test.name, err)
+		}
+		got, err := os.ReadFile(filepath.Join(dest.dir, recoveredArchive))
+		if err != nil || !bytes.Equal(got, original) {
+			t.Errorf("%s: the archive changed (%v)", test.name, err)
+		}
+	}
+}
+
+func TestRebuildRecoveryChecksTheArchive(t *testing.T) {
+	var archive bytes.Buffer
+	zw := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(zw)
+	content := randomBytes(t, 20*recoveryBlockSize)
+	err := tw.WriteHeader(&tar.Header{Name: "notes.md", Mode: 0o644, Size: int64(len(content))})
+	if err == nil {
+		_, err = tw.Write(content)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	const name = "2024-01-02T03-04-05Z.tar.gz"
+
+	tests := []struct {
+		name     string
+		recovery int // Offset of the damage to the recovery data
+		archive  int // Offset of the damage to the archive, 0 for none
+		rebuilt  bool
+		moves    bool // Whether the destination can move the new recovery data into place, rather than upload it again
+	}{
+		{"compressed", 2, 0, true, true}, // gzip checks every block that the recovery data no longer has the hash of
+		{"uploaded again", 2, 0, true, false},
+		{"damaged and compressed", 2, 3*recoveryBlockSize + 10, false, true},
+		{"damaged, with hashes", -1, 3*recoveryBlockSize + 10, false, true},
+	}
+	for _, test := range tests {
+		dest, _ := saveWithRecovery(t, name, archive.Bytes())
+		recoveryFile := filepath.Join(dest.dir, name+recoverySuffix)
+		flipBytes(t, recoveryFile, test.recovery)
+		if test.archive != 0 {
+			flipBytes(t, filepath.Join(dest.dir, name), test.archive)
+		}
+		damaged, err := os.ReadFile(recoveryFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var d Destination = dest
+		if !test.moves {
+			d = failingDestination{Destination: dest} // Hides replace
+		}
+		err = RebuildRecovery(d, findArchive(t, dest), 10)
+		if !test.rebuilt {
+			if err == nil || !strings.Contains(err.Error(), "the archive is damaged") {
+				t.Errorf("%s: RebuildRecovery gave %v, expected the archive to be damaged", test.name, err)
+			}
+			if got, _ := os.ReadFile(recoveryFile); !bytes.Equal(got, damaged) {
+				t.Errorf("%s: RebuildRecovery replaced the recovery data of a damaged archive", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if got := readFiles(t, dest); len(got) != 2 {
+			t.Errorf("%s: after RebuildRecovery the destination has %d files", test.name, len(got))
+		}
+		if _, err := VerifyArchive(dest, findArchive(t, dest)); err != nil {
+			t.Errorf("%s: after RebuildRecovery VerifyArchive gave %s", test.name, err)
+		}
+	}
+}
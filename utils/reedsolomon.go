@@ -0,0 +1,214 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+Reed-Solomon erasure coding over GF(2^8)
+
+Data is split into k blocks, and m parity blocks are computed from them so that any k of the k+m blocks are enough
+to get the data back. The code is systematic: the first k blocks are the data itself, so nothing has to be decoded
+while every data block is there.
+*/
+
+// gfExp and gfLog are the exponent and logarithm tables for GF(2^8) with the polynomial x^8 + x^4 + x^3 + x^2 + 1 (0x11d)
+var gfExp, gfLog = gfTables()
+
+func gfTables() ([512]byte, [256]byte) {
+	var exp [512]byte
+	var log [256]byte
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < 512; i++ {
+		exp[i] = exp[i-255] // Saves a modulo in gfMul
+	}
+	return exp, log
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInverse(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfPow raises a to the power n
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])*n)%255]
+}
+
+// gfMatrix is a matrix over GF(2^8), stored as rows
+type gfMatrix [][]byte
+
+func newMatrix(rows, cols int) gfMatrix {
+	m := make(gfMatrix, rows)
+	for i := range m {
+		m[i] = make([]byte, cols)
+	}
+	return m
+}
+
+func (m gfMatrix) multiply(other gfMatrix) gfMatrix {
+	result := newMatrix(len(m), len(other[0]))
+	for i := range m {
+		for j := range other[0] {
+			var sum byte
+			for k := range other {
+				sum ^= gfMul(m[i][k], other[k][j])
+			}
+			result[i][j] = sum
+		}
+	}
+	return result
+}
+
+// invert returns the inverse of a square matrix, by Gauss-Jordan elimination
+func (m gfMatrix) invert() (gfMatrix, error) {
+	n := len(m)
+	work := newMatrix(n, 2*n) // m on the left, the identity on the right
+	for i := range m {
+		copy(work[i], m[i])
+		work[i][n+i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("matrix is singular")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		scale := gfInverse(work[col][col])
+		for j := range work[col] {
+			work[col][j] = gfMul(work[col][j], scale)
+		}
+		for row := 0; row < n; row++ {
+			if row == col || work[row][col] == 0 {
+				continue
+			}
+			factor := work[row][col]
+			for j := range work[row] {
+				work[row][j] ^= gfMul(factor, work[col][j])
+			}
+		}
+	}
+
+	inverse := newMatrix(n, n)
+	for i := range inverse {
+		copy(inverse[i], work[i][n:])
+	}
+	return inverse, nil
+}
+
+/*
+reedSolomon encodes and decodes blocks with k data and m parity shards
+
+The encoding matrix is a Vandermonde matrix turned systematic: multiplying it by the inverse of its top k rows makes those
+rows the identity, while keeping every set of k rows invertible.
+*/
+type reedSolomon struct {
+	data   int
+	parity int
+	matrix gfMatrix // (data+parity) x data
+}
+
+func newReedSolomon(data, parity int) (*reedSolomon, error) {
+	if data < 1 || parity < 1 || data+parity > 255 {
+		return nil, fmt.Errorf("erasure coding needs at least 1 data and 1 parity shard, and no more than 255 in total, got %d and %d", data, parity)
+	}
+	vandermonde := newMatrix(data+parity, data)
+	for i := range vandermonde {
+		for j := range vandermonde[i] {
+			vandermonde[i][j] = gfPow(byte(i), j)
+		}
+	}
+	top, err := gfMatrix(vandermonde[:data]).invert()
+	if err != nil {
+		return nil, err
+	}
+	return &reedSolomon{data: data, parity: parity, matrix: vandermonde.multiply(top)}, nil
+}
+
+// mulAdd adds c * in to out, a byte at a time
+func mulAdd(out []byte, in []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	logC := int(gfLog[c])
+	for i, b := range in {
+		if b != 0 {
+			out[i] ^= gfExp[logC+int(gfLog[b])]
+		}
+	}
+}
+
+// encode fills in the parity blocks from the data blocks, every block must be the same size
+func (rs *reedSolomon) encode(blocks [][]byte) {
+	for p := rs.data; p < rs.data+rs.parity; p++ {
+		out := blocks[p]
+		for i := range out {
+			out[i] = 0
+		}
+		for d := 0; d < rs.data; d++ {
+			mulAdd(out, blocks[d], rs.matrix[p][d])
+		}
+	}
+}
+
+/*
+decoder returns a function that rebuilds blocks from the k blocks listed in have
+
+The returned function takes all of the blocks, with the ones in have filled in, and fills in the ones listed in want (which must not be in have).
+The matrix inversion is only done once, so the decoder can be reused for every stripe of an archive.
+*/
+func (rs *reedSolomon) decoder(have []int) (func(blocks [][]byte, want []int), error) {
+	if len(have) < rs.data {
+		return nil, fmt.Errorf("only %d of the %d shards needed are intact", len(have), rs.data)
+	}
+	have = have[:rs.data]
+
+	sub := newMatrix(rs.data, rs.data)
+	for i, index := range have {
+		copy(sub[i], rs.matrix[index])
+	}
+	inverse, err := sub.invert()
+	if err != nil {
+		return nil, err
+	}
+	// Every block is a row of the encoding matrix times the data, and the data is the inverse times the blocks in have
+	rebuild := rs.matrix.multiply(inverse)
+
+	return func(blocks [][]byte, want []int) {
+		for _, i := range want {
+			out := blocks[i]
+			for j := range out {
+				out[j] = 0
+			}
+			for j, index := range have {
+				mulAdd(out, blocks[index], rebuild[i][j])
+			}
+		}
+	}, nil
+}
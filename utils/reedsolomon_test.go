@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"bytes"
+	"math/bits"
+	"math/rand"
+	"testing"
+)
+
+func TestGFInverse(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if got := gfMul(byte(a), gfInverse(byte(a))); got != 1 {
+			t.Errorf("%d times its inverse is %d", a, got)
+		}
+	}
+}
+
+func TestNewReedSolomonLimits(t *testing.T) {
+	for _, coding := range [][2]int{{0, 1}, {1, 0}, {200, 56}} {
+		if _, err := newReedSolomon(coding[0], coding[1]); err == nil {
+			t.Errorf("%d data and %d parity shards were accepted", coding[0], coding[1])
+		}
+	}
+	if _, err := newReedSolomon(200, 55); err != nil {
+		t.Error(err)
+	}
+}
+
+// encodedBlocks returns a stripe of random data blocks, with its parity blocks filled in
+func encodedBlocks(rs *reedSolomon, size int, random *rand.Rand) [][]byte {
+	blocks := make([][]byte, rs.data+rs.parity)
+	for i := range blocks {
+		blocks[i] = make([]byte, size)
+		if i < rs.data {
+			random.Read(blocks[i])
+		}
+	}
+	rs.encode(blocks)
+	return blocks
+}
+
+func TestReedSolomonRebuildsAnyLostShards(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for _, coding := range [][2]int{{1, 1}, {1, 3}, {2, 1}, {3, 2}, {4, 4}, {6, 3}, {10, 4}} {
+		rs, err := newReedSolomon(coding[0], coding[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		total := rs.data + rs.parity
+		original := encodedBlocks(rs, 100, random)
+
+		// Every set of up to parity shards, as a bit mask of the lost shards
+		for lost := uint(0); lost < 1<<total; lost++ {
+			if bits.OnesCount(lost) > rs.parity {
+				continue
+			}
+			var have, want []int
+			blocks := make([][]byte, total)
+			for i := range blocks {
+				blocks[i] = bytes.Clone(original[i])
+				if lost&(1<<i) != 0 {
+					want = append(want, i)
+					random.Read(blocks[i]) // Rebuilding has to overwrite whatever is there
+				} else {
+					have = append(have, i)
+				}
+			}
+			decode, err := rs.decoder(have)
+			if err != nil {
+				t.Fatalf("%d+%d losing %v: %s", rs.data, rs.parity, want, err)
+			}
+			decode(blocks, want)
+			for i := range blocks {
+				if !bytes.Equal(blocks[i], original[i]) {
+					t.Errorf("%d+%d losing %v: block %d isn't the same", rs.data, rs.parity, want, i)
+				}
+			}
+		}
+	}
+}
+
+func TestReedSolomonNeedsDataShards(t *testing.T) {
+	for _, coding := range [][2]int{{1, 1}, {3, 2}, {10, 4}} {
+		rs, err := newReedSolomon(coding[0], coding[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Losing parity+1 shards leaves one fewer than the data shards
+		have := make([]int, 0, rs.data-1)
+		for i := rs.parity + 1; i < rs.data+rs.parity; i++ {
+			have = append(have, i)
+		}
+		_, err = rs.decoder(have)
+		if err == nil {
+			t.Errorf("%d+%d decoded from %d shards", rs.data, rs.parity, len(have))
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package utils
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+/*
+OpenArchive finds one of a vault's archives in any of its destinations, and opens it for reading
+
+name is the archive's file name, or "" for the newest archive. An erasure coded archive has its shards checked, and is
+rebuilt from them as it is read (see ShardedArchive), any other archive is read from the first destination that has it
+(skipping the ones it can't be opened from, like a volume set with a missing volume).
+The archive is returned along with the reader, its name says how the archive is compressed.
+*/
+func OpenArchive(vault Vault, name string) (io.ReadCloser, ArchiveInfo, error) {
+	var dests []Destination
+	var errs []error
+	closeAll := func() {
+		for _, dest := range dests {
+			dest.Close()
+		}
+	}
+
+	var found ArchiveInfo
+	var foundIn Destination
+	var copies []archiveCopy // Every destination that has the archive that was found
+	sharded := make(map[string]*ShardedArchive)
+	for _, target := range vault.AllDestinations() {
+		dest, err := OpenDestination(target.Destination, vault.Name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		dests = append(dests, dest)
+
+		archives, err := ListArchives(vault, dest)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("listing %s: %w", dest, err))
+			continue
+		}
+		for _, archive := range archives {
+			if archive.IsSharded() {
+				gatherShards(sharded, dest, archive)
+				continue
+			}
+			if name != "" && archive.Name != name {
+				continue
+			}
+			if foundIn != nil && archive.Name == found.Name {
+				copies = append(copies, archiveCopy{dest, archive})
+			} else if foundIn == nil || archive.ModTime.After(found.ModTime) {
+				found, foundIn, copies = archive, dest, []archiveCopy{{dest, archive}}
+			}
+		}
+	}
+
+	var shards *ShardedArchive
+	for _, archive := range sortSharded(sharded) {
+		if (name == "" || archive.Name == name) && (foundIn == nil || archive.ModTime.After(found.ModTime)) {
+			shards = archive
+			found = ArchiveInfo{Name: archive.Name, ModTime: archive.ModTime}
+		}
+	}
+
+	switch {
+	case shards != nil:
+		err := shards.Check()
+		if err != nil {
+			closeAll()
+			return nil, found, fmt.Errorf("%s: %w", found.Name, err)
+		}
+		found.Size = shards.footer.size
+		return archiveReader{ReadCloser: shards.reader(), dests: dests}, found, nil
+	case foundIn != nil:
+		var openErrs []error
+		for _, candidate := range copies {
+			reader, err := openArchive(candidate.dest, candidate.archive)
+			if err == nil {
+				return archiveReader{ReadCloser: reader, dests: dests}, candidate.archive, nil
+			}
+			openErrs = append(openErrs, fmt.Errorf("%s: %w", candidate.dest, err))
+		}
+		closeAll()
+		return nil, found, fmt.Errorf("%s: %w", found.Name, errors.Join(openErrs...))
+	}
+
+	closeAll()
+	if name != "" {
+		errs = append([]error{fmt.Errorf("%s has no archive named %s", vault.Name, name)}, errs...)
+	} else {
+		errs = append([]error{fmt.Errorf("%s has no archives", vault.Name)}, errs...)
+	}
+	return nil, found, errors.Join(errs...)
+}
+
+type archiveCopy struct {
+	dest    Destination
+	archive ArchiveInfo
+}
+
+// archiveReader closes the destinations an archive was found in along with the archive
+type archiveReader struct {
+	io.ReadCloser
+	dests []Destination
+}
+
+func (r archiveReader) Close() error {
+	err := r.ReadCloser.Close()
+	for _, dest := range r.dests {
+		dest.Close()
+	}
+	return err
+}
+
+/*
+Extract unpacks an archive into dir, and returns the number of files in it
+
+The archive is decompressed based on name's extension. Entries that would end up outside of dir are refused, and so are
+entries that aren't files or directories (the archives go-archive-it makes only hold files). Files are never overwritten,
+and get back their permissions and modification times.
+*/
+func Extract(r io.Reader, name string, dir string) (int, error) {
+	r, done, err := decompress(r, name)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	files := 0
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			_, err = io.Copy(io.Discard, r) // Reading to the end makes the decompressor check its checksum
+			return files, err
+		}
+		if err != nil {
+			return files, err
+		}
+		if !filepath.IsLocal(filepath.FromSlash(header.Name)) {
+			return files, fmt.Errorf("%s would be extracted outside of %s", header.Name, dir)
+		}
+		path := filepath.Join(dir, filepath.FromSlash(header.Name))
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0o755)
+		case tar.TypeReg:
+			err = extractFile(tr, header, path)
+			files++
+		default:
+			err = fmt.Errorf("not a file or a directory")
+		}
+		if err != nil {
+			return files, fmt.Errorf("%s: %w", header.Name, err)
+		}
+	}
+}
+
+func extractFile(r io.Reader, header *tar.Header, path string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, header.FileInfo().Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(path, header.ModTime, header.ModTime)
+}
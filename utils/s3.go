@@ -0,0 +1,523 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3PartSize is the size of each part of a multipart upload, it is also how much of an archive is held in memory at once
+const s3PartSize = 16 << 20
+
+// s3MaxParts is the most parts S3 accepts in a single multipart upload, which caps archives at s3PartSize * s3MaxParts
+const s3MaxParts = 10000
+
+/*
+s3Destination stores archives in an S3 compatible bucket (AWS S3, MinIO, Backblaze B2, ...)
+
+Archives are streamed with multipart uploads, so only one part is kept in memory and nothing is written to local disk.
+*/
+type s3Destination struct {
+	client *http.Client
+	bucket string
+	prefix string // Ends with a / unless it is empty
+	creds  s3Credentials
+	region string
+
+	endpoint  *url.URL
+	pathStyle bool
+}
+
+type s3Credentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+/*
+newS3Destination parses an s3://bucket/prefix destination
+
+The options are given as query parameters:
+  - endpoint: The URL of the S3 API, e.g. http://localhost:9000 for MinIO or https://s3.us-west-004.backblazeb2.com for B2 (defaults to AWS)
+  - region: The region of the bucket (defaults to $AWS_REGION, $AWS_DEFAULT_REGION, then us-east-1)
+  - profile: The profile to read from the credentials file (defaults to $AWS_PROFILE, then default)
+  - credentials: The path to the credentials file (defaults to $AWS_SHARED_CREDENTIALS_FILE, then ~/.aws/credentials)
+  - path-style: Set to false to put the bucket in the host name instead of the path, the default when no endpoint is given
+
+Credentials are taken from $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY and $AWS_SESSION_TOKEN when they are set,
+and from the credentials file otherwise.
+*/
+func newS3Destination(u *url.URL, vaultName string) (*s3Destination, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("s3 destination %s has no bucket", u.Redacted())
+	}
+	query := u.Query()
+
+	d := &s3Destination{
+		client: newHTTPClient(),
+		bucket: u.Host,
+		prefix: strings.Trim(path.Join(strings.Trim(u.Path, "/"), vaultName), "/") + "/",
+		region: firstNonEmpty(query.Get("region"), os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1"),
+	}
+
+	endpoint := query.Get("endpoint")
+	d.pathStyle = endpoint != ""
+	if endpoint == "" {
+		endpoint = "https://s3." + d.region + ".amazonaws.com"
+	}
+	var err error
+	d.endpoint, err = url.Parse(endpoint)
+	if err != nil || d.endpoint.Host == "" {
+		return nil, fmt.Errorf("bad s3 endpoint %q", endpoint)
+	}
+	if style := query.Get("path-style"); style != "" {
+		d.pathStyle, err = strconv.ParseBool(style)
+		if err != nil {
+			return nil, fmt.Errorf("bad value for path-style: %q", style)
+		}
+	}
+
+	d.creds, err = loadS3Credentials(query.Get("credentials"), query.Get("profile"))
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// loadS3Credentials reads credentials from the environment, or from an AWS style credentials file
+func loadS3Credentials(file string, profile string) (s3Credentials, error) {
+	if os.Getenv("AWS_ACCESS_KEY_ID") != "" && file == "" && profile == "" {
+		return s3Credentials{
+			accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	if file == "" {
+		file = os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	}
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return s3Credentials{}, err
+		}
+		file = filepath.Join(home, ".aws", "credentials")
+	}
+	file, err := ExpandPath(file, "")
+	if err != nil {
+		return s3Credentials{}, err
+	}
+	profile = firstNonEmpty(profile, os.Getenv("AWS_PROFILE"), "default")
+
+	f, err := os.Open(file)
+	if err != nil {
+		return s3Credentials{}, fmt.Errorf("no s3 credentials in the environment, and %w", err)
+	}
+	defer f.Close()
+
+	// The credentials file is ini formatted: [profile] sections of key = value lines
+	var creds s3Credentials
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != profile {
+			continue
+		}
+		key, value, _ := strings.Cut(line, "=")
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			creds.accessKey = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			creds.secretKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			creds.sessionToken = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return s3Credentials{}, err
+	}
+	if creds.accessKey == "" || creds.secretKey == "" {
+		return s3Credentials{}, fmt.Errorf("no s3 credentials for profile %s in %s", profile, file)
+	}
+	return creds, nil
+}
+
+func (d *s3Destination) String() string {
+	return "s3://" + d.bucket + "/" + strings.TrimSuffix(d.prefix, "/")
+}
+
+// objectURL returns the URL for a key in the bucket (or the bucket itself when key is empty)
+func (d *s3Destination) objectURL(key string, query url.Values) *url.URL {
+	u := *d.endpoint
+	if d.pathStyle {
+		u.Path = "/" + d.bucket + "/" + key
+	} else {
+		u.Host = d.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+// s3EscapePath encodes a path the way Signature Version 4 expects, every byte except unreserved characters and / is escaped
+func s3EscapePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// do signs and sends a request, and turns error responses into errors
+func (d *s3Destination) do(method string, key string, query url.Values, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, d.objectURL(key, query).String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = int64(len(body))
+	}
+	d.sign(req, body, time.Now().UTC())
+
+	resp, err := doHTTP(d.client, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var s3Err struct {
+			Code    string
+			Message string
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		xml.Unmarshal(data, &s3Err)
+		return nil, &s3Error{method: method, key: key, statusCode: resp.StatusCode, status: resp.Status, code: s3Err.Code, message: s3Err.Message}
+	}
+	return resp, nil
+}
+
+// s3Error is an error response from the S3 API
+type s3Error struct {
+	method     string
+	key        string
+	statusCode int
+	status     string
+	code       string
+	message    string
+}
+
+func (e *s3Error) Error() string {
+	if e.code != "" {
+		return fmt.Sprintf("s3 %s %s: %s: %s", e.method, e.key, e.code, e.message)
+	}
+	return fmt.Sprintf("s3 %s %s: %s", e.method, e.key, e.status)
+}
+
+func (e *s3Error) httpStatus() int {
+	return e.statusCode
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req
+func (d *s3Destination) sign(req *http.Request, body []byte, now time.Time) {
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if d.creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", d.creds.sessionToken)
+	}
+
+	headers := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		headers = append(headers, strings.ToLower(name))
+	}
+	sort.Strings(headers)
+	var canonicalHeaders strings.Builder
+	for _, name := range headers {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+	signedHeaders := strings.Join(headers, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + d.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+d.creds.secretKey), day)
+	key = hmacSHA256(key, d.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		d.creds.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func (d *s3Destination) Close() error {
+	d.client.CloseIdleConnections()
+	return nil
+}
+
+func (d *s3Destination) Create(name string) (ArchiveWriter, error) {
+	return &s3Writer{d: d, key: d.prefix + name, buf: make([]byte, 0, s3PartSize)}, nil
+}
+
+func (d *s3Destination) List() ([]ArchiveInfo, error) {
+	var archives []ArchiveInfo
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {d.prefix}, "delimiter": {"/"}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := d.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range result.Contents {
+			archives = append(archives, ArchiveInfo{
+				Name:    strings.TrimPrefix(object.Key, d.prefix),
+				Size:    object.Size,
+				ModTime: object.LastModified,
+			})
+		}
+		if !result.IsTruncated {
+			return archives, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (d *s3Destination) Stat(name string) (ArchiveInfo, error) {
+	resp, err := d.do(http.MethodHead, d.prefix+name, nil, nil)
+	if hasStatus(err, http.StatusNotFound) {
+		return ArchiveInfo{}, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	if err != nil {
+		return ArchiveInfo{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return ArchiveInfo{Name: name, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (d *s3Destination) Open(name string) (io.ReadCloser, error) {
+	resp, err := d.do(http.MethodGet, d.prefix+name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (d *s3Destination) Delete(name string) error {
+	resp, err := d.do(http.MethodDelete, d.prefix+name, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+/*
+s3Writer uploads an archive as it is written
+
+Data is collected into parts of s3PartSize. Archives smaller than one part are sent with a single PUT when the writer is closed,
+anything larger starts a multipart upload with the first full part, which is completed on Close or aborted on Abort.
+*/
+type s3Writer struct {
+	d        *s3Destination
+	key      string
+	buf      []byte
+	uploadID string
+	parts    []s3Part
+}
+
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+		if len(w.buf) == cap(w.buf) {
+			err := w.flushPart()
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flushPart uploads the buffered data as the next part, starting the multipart upload if needed
+func (w *s3Writer) flushPart() error {
+	if w.uploadID == "" {
+		resp, err := w.d.do(http.MethodPost, w.key, url.Values{"uploads": {""}}, nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			UploadId string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		w.uploadID = result.UploadId
+	}
+	if len(w.parts) == s3MaxParts {
+		return fmt.Errorf("archive is too large for an s3 multipart upload (more than %d parts of %d bytes)", s3MaxParts, s3PartSize)
+	}
+
+	number := len(w.parts) + 1
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {w.uploadID}}
+	resp, err := w.d.do(http.MethodPut, w.key, query, w.buf)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	w.parts = append(w.parts, s3Part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	w.buf = w.buf[:0]
+	return nil
+}
+
+func (w *s3Writer) Close() error {
+	if w.uploadID == "" {
+		resp, err := w.d.do(http.MethodPut, w.key, nil, w.buf)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	if len(w.buf) > 0 {
+		err := w.flushPart()
+		if err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: w.parts})
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	resp, err := w.d.do(http.MethodPost, w.key, url.Values{"uploadId": {w.uploadID}}, body)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	defer resp.Body.Close()
+
+	// CompleteMultipartUpload can fail after sending a 200 status, in which case the body holds an error
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var s3Err struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(data, &s3Err) == nil && s3Err.Code != "" {
+		w.Abort()
+		return fmt.Errorf("s3 completing upload of %s: %s: %s", w.key, s3Err.Code, s3Err.Message)
+	}
+	return nil
+}
+
+func (w *s3Writer) Abort() error {
+	w.buf = nil
+	if w.uploadID == "" {
+		return nil
+	}
+	resp, err := w.d.do(http.MethodDelete, w.key, url.Values{"uploadId": {w.uploadID}}, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
@@ -0,0 +1,353 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshDialTimeout is how long connecting to an sftp destination can take, so that a server that is down fails the destination
+const sshDialTimeout = 30 * time.Second
+
+// defaultSSHKeys are the private keys that are tried when an sftp destination doesn't name one
+var defaultSSHKeys = []string{"~/.ssh/id_ed25519", "~/.ssh/id_ecdsa", "~/.ssh/id_rsa"}
+
+/*
+sftpDestination stores archives on a server over SFTP
+
+Archives are uploaded to a hidden temporary file as they are produced, and renamed into place once they are complete.
+The connection is opened the first time it is needed, and shared by everything done with the destination.
+*/
+type sftpDestination struct {
+	addr   string
+	config *ssh.ClientConfig
+	keys   *sshKeys
+	dir    string
+
+	once   sync.Once
+	conn   *ssh.Client
+	client *sftp.Client
+	err    error
+}
+
+/*
+newSFTPDestination parses an sftp://user@host:port/path destination
+
+The user defaults to the current user and the port to 22. A path without a leading // is relative to the user's home directory
+on the server, sftp://nas//srv/backups is an absolute path. The options are given as query parameters:
+  - key: A private key to log in with, instead of ~/.ssh/id_ed25519, ~/.ssh/id_ecdsa and ~/.ssh/id_rsa (keys with a passphrase should be added to an SSH agent instead)
+  - known_hosts: The known_hosts file to check the server's host key against (defaults to ~/.ssh/known_hosts)
+
+Keys from the SSH agent ($SSH_AUTH_SOCK) are tried first. The server's host key must be in known_hosts, connect with ssh once to add it.
+*/
+func newSFTPDestination(u *url.URL, vaultName string) (*sftpDestination, error) {
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("sftp destination %s has no host", u.Redacted())
+	}
+	query := u.Query()
+
+	username := u.User.Username()
+	if username == "" {
+		usr, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		username = usr.Username
+	}
+	port := u.Port()
+	if port == "" {
+		port = "22"
+	}
+
+	knownHostsFile, err := ExpandPath(firstNonEmpty(query.Get("known_hosts"), "~/.ssh/known_hosts"), "")
+	if err != nil {
+		return nil, err
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading known_hosts: %w", err)
+	}
+
+	keys, err := loadSSHKeys(query.Get("key"))
+	if err != nil {
+		return nil, err
+	}
+
+	dir := strings.TrimPrefix(u.Path, "/") // sftp://host/backups is relative to the home directory, sftp://host//backups is not
+	return &sftpDestination{
+		addr: net.JoinHostPort(u.Hostname(), port),
+		config: &ssh.ClientConfig{
+			User:            username,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeysCallback(keys.signers)},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         sshDialTimeout,
+		},
+		keys: keys,
+		dir:  path.Join(dir, vaultName),
+	}, nil
+}
+
+/*
+sshKeys are the keys an sftp destination logs in with, the SSH agent's and then the key files that can be read
+
+They are all offered through one method, the ssh package doesn't try a second publickey method once the first has been
+turned down, so the key files would never be tried when the agent only has keys for other servers.
+*/
+type sshKeys struct {
+	socket string   // The SSH agent's, empty when there is none
+	agent  net.Conn // Opened the first time the keys are needed, so that a destination that never connects doesn't open it
+	files  []ssh.Signer
+}
+
+// loadSSHKeys reads the key file, or the default keys when it is empty
+func loadSSHKeys(keyFile string) (*sshKeys, error) {
+	keys := defaultSSHKeys
+	if keyFile != "" {
+		keys = []string{keyFile}
+	}
+	var signers []ssh.Signer
+	for _, key := range keys {
+		file, err := ExpandPath(key, "")
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			if keyFile != "" {
+				return nil, fmt.Errorf("reading ssh key: %w", err)
+			}
+			continue // The default keys don't all have to exist
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			if keyFile != "" {
+				return nil, fmt.Errorf("reading ssh key %s: %w", file, err)
+			}
+			continue
+		}
+		signers = append(signers, signer)
+	}
+
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" && len(signers) == 0 {
+		return nil, fmt.Errorf("no ssh keys found, start an ssh agent or set key= on the sftp destination")
+	}
+	return &sshKeys{socket: socket, files: signers}, nil
+}
+
+// signers returns the agent's keys followed by the key files, or only the key files when the agent can't be reached
+func (k *sshKeys) signers() ([]ssh.Signer, error) {
+	if k.socket == "" {
+		return k.files, nil
+	}
+	if k.agent == nil {
+		conn, err := net.Dial("unix", k.socket)
+		if err != nil {
+			return k.files, nil // The key files can still work
+		}
+		k.agent = conn
+	}
+	agentSigners, err := agent.NewClient(k.agent).Signers()
+	if err != nil {
+		return k.files, nil
+	}
+	return append(agentSigners, k.files...), nil
+}
+
+// Close closes the connection to the agent, if it was opened
+func (k *sshKeys) Close() error {
+	if k.agent == nil {
+		return nil
+	}
+	return k.agent.Close()
+}
+
+// connect opens the SSH connection and SFTP session the first time it is called
+func (d *sftpDestination) connect() (*sftp.Client, error) {
+	d.once.Do(func() {
+		conn, err := ssh.Dial("tcp", d.addr, d.config)
+		if err != nil {
+			d.err = fmt.Errorf("connecting to %s: %w", d.addr, err)
+			return
+		}
+		d.client, d.err = sftp.NewClient(conn, sftp.UseConcurrentWrites(true))
+		if d.err != nil {
+			conn.Close()
+			return
+		}
+		d.conn = conn
+	})
+	return d.client, d.err
+}
+
+func (d *sftpDestination) String() string {
+	return "sftp://" + d.config.User + "@" + d.addr + "/" + d.dir
+}
+
+// Close closes the SFTP session, then the SSH connection it runs over (which closing the session leaves open) and the agent
+func (d *sftpDestination) Close() error {
+	var err error
+	if d.client != nil {
+		err = d.client.Close()
+	}
+	if d.conn != nil {
+		if closeErr := d.conn.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if closeErr := d.keys.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (d *sftpDestination) Create(name string) (ArchiveWriter, error) {
+	client, err := d.connect()
+	if err != nil {
+		return nil, err
+	}
+	err = client.MkdirAll(d.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	final := path.Join(d.dir, name)
+	if _, err := client.Lstat(final); err == nil {
+		return nil, fmt.Errorf("%s already exists", final)
+	}
+	temp := path.Join(d.dir, "."+name+".partial")
+	file, err := client.OpenFile(temp, os.O_CREATE|os.O_EXCL|os.O_WRONLY)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpWriter{client: client, file: file, buf: bufio.NewWriterSize(file, 1<<20), temp: temp, final: final}, nil
+}
+
+func (d *sftpDestination) List() ([]ArchiveInfo, error) {
+	client, err := d.connect()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := client.ReadDir(d.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	archives := make([]ArchiveInfo, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), ".partial") {
+			continue
+		}
+		archives = append(archives, ArchiveInfo{Name: entry.Name(), Size: entry.Size(), ModTime: entry.ModTime()})
+	}
+	return archives, nil
+}
+
+func (d *sftpDestination) Stat(name string) (ArchiveInfo, error) {
+	client, err := d.connect()
+	if err != nil {
+		return ArchiveInfo{}, err
+	}
+	info, err := client.Stat(path.Join(d.dir, name))
+	if err != nil {
+		return ArchiveInfo{}, err
+	}
+	return ArchiveInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (d *sftpDestination) setModTime(name string, modTime time.Time) error {
+	client, err := d.connect()
+	if err != nil {
+		return err
+	}
+	return client.Chtimes(path.Join(d.dir, name), modTime, modTime)
+}
+
+func (d *sftpDestination) replace(from string, to string) error {
+	client, err := d.connect()
+	if err != nil {
+		return err
+	}
+	from, to = path.Join(d.dir, from), path.Join(d.dir, to)
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		return client.PosixRename(from, to)
+	}
+	// Plain SFTP renames never replace a file
+	err = client.Remove(to)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return client.Rename(from, to)
+}
+
+func (d *sftpDestination) Open(name string) (io.ReadCloser, error) {
+	client, err := d.connect()
+	if err != nil {
+		return nil, err
+	}
+	return client.Open(path.Join(d.dir, name))
+}
+
+func (d *sftpDestination) Delete(name string) error {
+	client, err := d.connect()
+	if err != nil {
+		return err
+	}
+	return client.Remove(path.Join(d.dir, name))
+}
+
+// sftpWriter renames its temporary file to the final name on Close
+type sftpWriter struct {
+	client *sftp.Client
+	file   *sftp.File
+	buf    *bufio.Writer // Tar writes in small pieces, batching them up lets the sftp client send many packets at once
+	temp   string
+	final  string
+}
+
+func (w *sftpWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *sftpWriter) Close() error {
+	err := w.buf.Flush()
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	err = w.file.Close()
+	if err != nil {
+		w.client.Remove(w.temp)
+		return err
+	}
+	if _, ok := w.client.HasExtension("posix-rename@openssh.com"); ok {
+		err = w.client.PosixRename(w.temp, w.final)
+	} else {
+		err = w.client.Rename(w.temp, w.final)
+	}
+	if err != nil {
+		w.client.Remove(w.temp)
+	}
+	return err
+}
+
+func (w *sftpWriter) Abort() error {
+	w.file.Close()
+	return w.client.Remove(w.temp)
+}
@@ -0,0 +1,409 @@
+//go:build !windows
+
+package utils
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// fakeSFTP is an SSH server with an in-memory SFTP filesystem, that lets in one key
+type fakeSFTP struct {
+	addr    string
+	hostKey ssh.Signer
+	files   sftp.Handlers
+	open    atomic.Int32 // Connections that the client hasn't closed
+}
+
+/*
+newFakeSFTP starts a server that accepts the authorized key
+
+It listens on loopback TCP rather than a net.Pipe, both ends of an SSH connection send their version at the same time,
+which deadlocks on a pipe that doesn't buffer anything.
+*/
+func newFakeSFTP(t *testing.T, authorized ed25519.PrivateKey) *fakeSFTP {
+	hostKey := newSSHSigner(t, newSSHKey(t))
+	authorizedKey := newSSHSigner(t, authorized).PublicKey().Marshal()
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), authorizedKey) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	f := &fakeSFTP{addr: listener.Addr().String(), hostKey: hostKey, files: sftp.InMemHandler()}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn, config)
+		}
+	}()
+	return f
+}
+
+func (f *fakeSFTP) serve(conn net.Conn, config *ssh.ServerConfig) {
+	f.open.Add(1)
+	defer f.open.Add(-1)
+	defer conn.Close()
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				req.Reply(req.Type == "subsystem" && string(req.Payload[4:]) == "sftp", nil)
+			}
+		}()
+		go func() {
+			server := sftp.NewRequestServer(channel, f.files)
+			server.Serve()
+			server.Close()
+		}()
+	}
+}
+
+// knownHosts writes a known_hosts file with the server's host key
+func (f *fakeSFTP) knownHosts(t *testing.T) string {
+	return writeKnownHosts(t, f.addr, f.hostKey.PublicKey())
+}
+
+func writeKnownHosts(t *testing.T, addr string, key ssh.PublicKey) string {
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, key)
+	err := os.WriteFile(file, []byte(line+"\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func newSSHKey(t *testing.T) ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newSSHSigner(t *testing.T, key ed25519.PrivateKey) ssh.Signer {
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// writeSSHKey writes a private key the way ssh-keygen does
+func writeSSHKey(t *testing.T, key ed25519.PrivateKey) string {
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "id_ed25519")
+	err = os.WriteFile(file, pem.EncodeToMemory(block), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// startSSHAgent serves an agent holding the keys on $SSH_AUTH_SOCK, and returns how many connections to it are open
+func startSSHAgent(t *testing.T, keys ...ed25519.PrivateKey) *atomic.Int32 {
+	keyring := agent.NewKeyring()
+	for _, key := range keys {
+		err := keyring.Add(agent.AddedKey{PrivateKey: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	var open atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			open.Add(1)
+			go func() {
+				agent.ServeAgent(keyring, conn)
+				conn.Close()
+				open.Add(-1)
+			}()
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", socket)
+	return &open
+}
+
+// waitForZero waits a while for a count of open connections to drop to zero
+func waitForZero(open *atomic.Int32) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if open.Load() == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// openSFTP opens a destination on the server for the notes vault, with the options from query
+func openSFTP(t *testing.T, f *fakeSFTP, query url.Values) (*sftpDestination, error) {
+	u := &url.URL{Scheme: "sftp", User: url.User("alice"), Host: f.addr, Path: "//backups", RawQuery: query.Encode()}
+	d, err := newSFTPDestination(u, "notes")
+	if err == nil {
+		t.Cleanup(func() { d.Close() })
+	}
+	return d, err
+}
+
+func TestSFTPUploadsToATemporaryFile(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	key := newSSHKey(t)
+	f := newFakeSFTP(t, key)
+	d, err := openSFTP(t, f, url.Values{"key": {writeSSHKey(t, key)}, "known_hosts": {f.knownHosts(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := randomBytes(t, 3<<20+123) // More than the writer buffers
+	w, err := d.Create("2024.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := d.connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Lstat("/backups/notes/.2024.tar.partial"); err != nil {
+		t.Errorf("the temporary file isn't there while writing: %s", err)
+	}
+	if _, err := client.Lstat("/backups/notes/2024.tar"); err == nil {
+		t.Error("the archive has its final name before it is complete")
+	}
+	archives, err := d.List()
+	if err != nil || len(archives) != 0 {
+		t.Errorf("List gave %+v, %v while writing, expected nothing", archives, err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Lstat("/backups/notes/.2024.tar.partial"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("the temporary file is left after Close: %v", err)
+	}
+	_, err = d.Create("2024.tar")
+	if err == nil {
+		t.Error("Create replaced an existing archive")
+	}
+	checkRoundtrip(t, d, "2024.tar", data)
+}
+
+func TestSFTPAbortRemovesTheTemporaryFile(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	key := newSSHKey(t)
+	f := newFakeSFTP(t, key)
+	d, err := openSFTP(t, f, url.Values{"key": {writeSSHKey(t, key)}, "known_hosts": {f.knownHosts(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := d.Create("2024.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write(randomBytes(t, 2<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Abort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := d.connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := client.ReadDir("/backups/notes")
+	if err != nil || len(entries) != 0 {
+		t.Errorf("the vault's directory has %d files after Abort (%v)", len(entries), err)
+	}
+	writeArchiveTo(t, d, "2024.tar", []byte("again")) // The name is free to be used again
+}
+
+func TestSFTPChecksTheHostKey(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	key := newSSHKey(t)
+	f := newFakeSFTP(t, key)
+	keyFile := writeSSHKey(t, key)
+	impostor := newSSHSigner(t, newSSHKey(t)).PublicKey()
+
+	tests := map[string]string{
+		"an unknown host":         writeKnownHosts(t, "example.com:22", impostor),
+		"a different key":         writeKnownHosts(t, f.addr, impostor),
+		"the host key on another": writeKnownHosts(t, "127.0.0.2:22", f.hostKey.PublicKey()),
+	}
+	for name, knownHosts := range tests {
+		d, err := openSFTP(t, f, url.Values{"key": {keyFile}, "known_hosts": {knownHosts}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = d.List()
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			t.Errorf("%s: List gave %v, expected the host key to be turned down", name, err)
+		}
+	}
+}
+
+func TestSFTPTriesTheAgentAndKeyFiles(t *testing.T) {
+	right, wrong := newSSHKey(t), newSSHKey(t)
+	tests := []struct {
+		name       string
+		agent      []ed25519.PrivateKey // nil is no agent
+		key        ed25519.PrivateKey   // Given with key=
+		defaultKey ed25519.PrivateKey   // In defaultSSHKeys
+		ok         bool
+	}{
+		{"agent", []ed25519.PrivateKey{right}, nil, nil, true},
+		{"key file", nil, right, nil, true},
+		{"default key", nil, nil, right, true},
+		{"key file after the agent's keys", []ed25519.PrivateKey{wrong}, right, nil, true},
+		{"default key after the agent's keys", []ed25519.PrivateKey{wrong}, nil, right, true},
+		{"agent before a key file", []ed25519.PrivateKey{right}, wrong, nil, true},
+		{"empty agent", []ed25519.PrivateKey{}, right, nil, true},
+		{"wrong keys", []ed25519.PrivateKey{wrong}, wrong, wrong, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeSFTP(t, right)
+			t.Setenv("SSH_AUTH_SOCK", "")
+			if test.agent != nil {
+				startSSHAgent(t, test.agent...)
+			}
+			defaults := defaultSSHKeys
+			t.Cleanup(func() { defaultSSHKeys = defaults })
+			defaultSSHKeys = []string{filepath.Join(t.TempDir(), "missing")}
+			if test.defaultKey != nil {
+				defaultSSHKeys = append(defaultSSHKeys, writeSSHKey(t, test.defaultKey))
+			}
+			query := url.Values{"known_hosts": {f.knownHosts(t)}}
+			if test.key != nil {
+				query.Set("key", writeSSHKey(t, test.key))
+			}
+
+			d, err := openSFTP(t, f, query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = d.List()
+			if test.ok && err != nil {
+				t.Errorf("List: %s", err)
+			}
+			if !test.ok && (err == nil || !strings.Contains(err.Error(), "unable to authenticate")) {
+				t.Errorf("List gave %v, expected logging in to fail", err)
+			}
+		})
+	}
+}
+
+func TestSFTPKeyErrors(t *testing.T) {
+	f := newFakeSFTP(t, newSSHKey(t))
+	knownHosts := f.knownHosts(t)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	defaults := defaultSSHKeys
+	t.Cleanup(func() { defaultSSHKeys = defaults })
+	defaultSSHKeys = []string{filepath.Join(t.TempDir(), "missing")}
+
+	_, err := openSFTP(t, f, url.Values{"known_hosts": {knownHosts}})
+	if err == nil || !strings.Contains(err.Error(), "no ssh keys found") {
+		t.Errorf("without any keys: %v", err)
+	}
+	_, err = openSFTP(t, f, url.Values{"known_hosts": {knownHosts}, "key": {filepath.Join(t.TempDir(), "missing")}})
+	if err == nil || !strings.Contains(err.Error(), "reading ssh key") {
+		t.Errorf("with a missing key=: %v", err)
+	}
+	_, err = openSFTP(t, f, url.Values{"known_hosts": {knownHosts}, "key": {knownHosts}})
+	if err == nil || !strings.Contains(err.Error(), "reading ssh key") {
+		t.Errorf("with a key= that isn't a key: %v", err)
+	}
+}
+
+func TestSFTPCloseClosesTheConnection(t *testing.T) {
+	key := newSSHKey(t)
+	f := newFakeSFTP(t, key)
+	agents := startSSHAgent(t, key)
+
+	d, err := openSFTP(t, f, url.Values{"known_hosts": {f.knownHosts(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agents.Load() != 0 {
+		t.Error("the agent was connected to before the destination was used")
+	}
+	_, err = d.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.open.Load() != 1 || agents.Load() != 1 {
+		t.Fatalf("%d connections to the server and %d to the agent are open, expected 1 of each", f.open.Load(), agents.Load())
+	}
+
+	err = d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !waitForZero(&f.open) {
+		t.Error("the connection to the server was left open")
+	}
+	if !waitForZero(agents) {
+		t.Error("the connection to the agent was left open")
+	}
+}
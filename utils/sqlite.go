@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+/*
+SQLite databases
+
+A database that is being written to can't be copied byte by byte: the copy mixes pages from before and after each
+write, and recent changes may only be in its -wal file. Files that start with the SQLite header are copied with
+SQLite's online backup API instead (through the sqlite3 command line tool), which gives a consistent snapshot that
+includes the -wal file. The snapshot is stored under the database's own name, and its -wal, -shm and -journal
+companions are left out of the archive, so the archived database opens cleanly on its own. A database that can't be
+snapshotted is archived as it is, and reported like a file that kept changing while it was read.
+*/
+
+var sqliteMagic = []byte("SQLite format 3\x00")
+
+var sqliteCompanions = []string{"-wal", "-shm", "-journal"}
+
+var (
+	sqliteOnce sync.Once
+	sqliteTool string // The path of the sqlite3 tool, "" if it isn't installed
+)
+
+// isSQLite reports whether a file is a SQLite database, based on its header
+func isSQLite(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	header := make([]byte, len(sqliteMagic))
+	_, err = file.ReadAt(header, 0)
+	return err == nil && bytes.Equal(header, sqliteMagic)
+}
+
+// isSQLiteCompanion reports whether a file is the -wal, -shm or -journal file of a SQLite database
+func isSQLiteCompanion(path string) bool {
+	for _, suffix := range sqliteCompanions {
+		if database, ok := strings.CutSuffix(path, suffix); ok {
+			return isSQLite(database)
+		}
+	}
+	return false
+}
+
+/*
+snapshotSQLite makes a consistent copy of a SQLite database in a temporary file, which the caller has to remove
+
+The database is opened read-only, so nothing is written to it (not even the recovery of a crashed write). Writers are
+waited on for up to 10 seconds. An error is returned when the sqlite3 tool isn't installed.
+*/
+func snapshotSQLite(path string) (*os.File, error) {
+	sqliteOnce.Do(func() {
+		sqliteTool, _ = exec.LookPath("sqlite3")
+	})
+	if sqliteTool == "" {
+		return nil, errors.New("the sqlite3 tool is not installed")
+	}
+
+	snapshot, err := os.CreateTemp("", "go-archive-it-*.sqlite")
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(snapshot.Name(), "'") { // .backup takes the file name in quotes
+		snapshot.Close()
+		os.Remove(snapshot.Name())
+		return nil, fmt.Errorf("the temporary file %s can't be used by sqlite3", snapshot.Name())
+	}
+
+	cmd := exec.Command(sqliteTool, "-readonly", "-batch", "-bail", "-cmd", ".timeout 10000", path, fmt.Sprintf(".backup '%s'", snapshot.Name()))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		snapshot.Close()
+		os.Remove(snapshot.Name())
+		return nil, fmt.Errorf("sqlite3 .backup: %w: %s", err, bytes.TrimSpace(output))
+	}
+	return snapshot, nil
+}
+
+/*
+addSQLite adds a snapshot of a SQLite database to the archive, under the database's name
+
+If the snapshot can't be made, the database is copied as it is along with the companions that exclude doesn't leave out.
+Nothing makes that copy consistent, so the database is reported with the files that didn't hold still (see fileReader).
+*/
+func addSQLite(tw *tar.Writer, name string, vaultPath string, exclude []string, files *fileReader) error {
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	snapshot, err := snapshotSQLite(name)
+	if err == nil {
+		defer os.Remove(snapshot.Name())
+		defer snapshot.Close()
+		snapshotInfo, err := snapshot.Stat()
+		if err != nil {
+			return err
+		}
+		return addFileFrom(tw, name, vaultPath, info, snapshot, snapshotInfo.Size())
+	}
+
+	log.Printf("[sqlite] %s: %s, copying it as it is", name, err)
+	err = copyFile(tw, name, vaultPath, files)
+	if err != nil {
+		return err
+	}
+	for _, suffix := range sqliteCompanions {
+		companion := name + suffix
+		if isExcluded(companion, vaultPath, exclude) {
+			continue
+		}
+		if _, err := os.Stat(companion); err == nil {
+			err = copyFile(tw, companion, vaultPath, files)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	rel, err := filepath.Rel(vaultPath, name)
+	if err != nil {
+		return err
+	}
+	files.markUnstable(rel)
+	return nil
+}
@@ -0,0 +1,230 @@
+//go:build !windows
+
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// sqlite3 returns the path of the sqlite3 tool, and skips the test when it isn't installed
+func sqlite3(t *testing.T) string {
+	t.Helper()
+	tool, err := exec.LookPath("sqlite3")
+	if err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+	return tool
+}
+
+// useSQLiteTool has snapshotSQLite use tool ("" for none) until the test is over
+func useSQLiteTool(t *testing.T, tool string) {
+	sqliteOnce.Do(func() {})
+	previous := sqliteTool
+	sqliteTool = tool
+	t.Cleanup(func() { sqliteTool = previous })
+}
+
+/*
+openWAL creates a database in WAL mode with rows in it, and keeps it open in sqlite3 until the test is over
+
+Automatic checkpoints are off, so the rows are only in the -wal file, the database file itself doesn't have them yet.
+*/
+func openWAL(t *testing.T, path string, rows int) {
+	t.Helper()
+	cmd := exec.Command(sqlite3(t), "-batch", path)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		stdin.Close()
+		cmd.Wait()
+	})
+
+	script := "PRAGMA journal_mode=WAL;\nPRAGMA wal_autocheckpoint=0;\nCREATE TABLE notes(body TEXT);\n"
+	for i := 0; i < rows; i++ {
+		script += "INSERT INTO notes VALUES ('" + strings.Repeat("note ", 100) + "');\n"
+	}
+	_, err = io.WriteString(stdin, script+".print ready\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bufio.NewScanner(stdout)
+	for lines.Scan() && lines.Text() != "ready" {
+	}
+	if lines.Err() != nil {
+		t.Fatal(lines.Err())
+	}
+}
+
+// countRows returns the number of rows in the notes table of a database, or -1 when it doesn't have one
+func countRows(t *testing.T, path string) int {
+	t.Helper()
+	out, err := exec.Command(sqlite3(t), "-readonly", path, "SELECT count(*) FROM notes;").Output()
+	if err != nil {
+		return -1
+	}
+	var count int
+	_, err = fmt.Sscan(string(out), &count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestIsSQLite(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"app.db":         string(sqliteMagic) + strings.Repeat("\x00", 100),
+		"app.db-wal":     "",
+		"app.db-shm":     "",
+		"app.db-journal": "",
+		"app.db-other":   "",
+		"short.db":       "SQLite",
+		"note.md":        "SQLite format 3 is what the header says",
+		"note.md-wal":    "",
+		"orphan.db-wal":  "", // Its database is gone
+	}
+	for name, data := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name      string
+		database  bool
+		companion bool
+	}{
+		{"app.db", true, false},
+		{"app.db-wal", false, true},
+		{"app.db-shm", false, true},
+		{"app.db-journal", false, true},
+		{"app.db-other", false, false},
+		{"short.db", false, false},
+		{"note.md", false, false},
+		{"note.md-wal", false, false},
+		{"orphan.db-wal", false, false},
+		{"gone.db", false, false},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		if got := isSQLite(path); got != test.database {
+			t.Errorf("isSQLite(%s) = %t", test.name, got)
+		}
+		if got := isSQLiteCompanion(path); got != test.companion {
+			t.Errorf("isSQLiteCompanion(%s) = %t", test.name, got)
+		}
+	}
+}
+
+func TestSnapshotSQLite(t *testing.T) {
+	useSQLiteTool(t, sqlite3(t))
+	dir := t.TempDir()
+	db := filepath.Join(dir, "app.db")
+	openWAL(t, db, 50)
+
+	// The rows are only in the -wal file, so copying the database file alone would lose them
+	copied := filepath.Join(t.TempDir(), "copy.db")
+	data, err := os.ReadFile(db)
+	if err == nil {
+		err = os.WriteFile(copied, data, 0o644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows := countRows(t, copied); rows > 0 {
+		t.Fatalf("the database file already has %d rows, they aren't only in the -wal file", rows)
+	}
+
+	snapshot, err := snapshotSQLite(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot.Close()
+	defer os.Remove(snapshot.Name())
+	if rows := countRows(t, snapshot.Name()); rows != 50 {
+		t.Errorf("the snapshot has %d rows, expected 50", rows)
+	}
+	after, err := os.ReadFile(db)
+	if err != nil || !bytes.Equal(after, data) {
+		t.Errorf("making the snapshot changed the database (%v)", err)
+	}
+}
+
+// archivedFiles makes a tar archive of a directory, and returns the names of the files in it and the fileReader
+func archivedFiles(t *testing.T, dir string, exclude []string) (map[string]string, *fileReader) {
+	t.Helper()
+	var archive bytes.Buffer
+	files := &fileReader{retries: 1}
+	err := tarArchive(dir, &archive, exclude, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tarFiles(t, archive.Bytes(), FormatTar), files
+}
+
+func TestArchiveSQLite(t *testing.T) {
+	tool := sqlite3(t)
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "note.md"), []byte("some notes\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := filepath.Join(dir, "app.db")
+	openWAL(t, db, 50)
+
+	// The snapshot stands in for the database and its companions
+	useSQLiteTool(t, tool)
+	archived, files := archivedFiles(t, dir, nil)
+	if got := sortedNames(archived); !reflect.DeepEqual(got, []string{"app.db", "note.md"}) {
+		t.Errorf("the archive has %v", got)
+	}
+	if len(files.unstable) > 0 {
+		t.Errorf("%v were reported as unstable", files.unstable)
+	}
+	restored := filepath.Join(t.TempDir(), "app.db")
+	err = os.WriteFile(restored, []byte(archived["app.db"]), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows := countRows(t, restored); rows != 50 {
+		t.Errorf("the archived database has %d rows, expected 50", rows)
+	}
+
+	// Without sqlite3 the database is copied as it is, and reported
+	tests := []struct {
+		exclude []string
+		want    []string
+	}{
+		{nil, []string{"app.db", "app.db-shm", "app.db-wal", "note.md"}},
+		{[]string{"*-shm"}, []string{"app.db", "app.db-wal", "note.md"}},
+	}
+	useSQLiteTool(t, "")
+	for _, test := range tests {
+		archived, files := archivedFiles(t, dir, test.exclude)
+		if got := sortedNames(archived); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("excluding %v without sqlite3, the archive has %v, expected %v", test.exclude, got, test.want)
+		}
+		if !reflect.DeepEqual(files.unstable, []string{"app.db"}) {
+			t.Errorf("without sqlite3, %v were reported as unstable", files.unstable)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+/*
+Files that change while they are archived
+
+A tar header holds the file's size, and has to be written before the file itself. A file that is saved while it is
+being copied (like a note in an open editor) either makes the tar writer fail, or ends up torn in the archive. So each
+file is read into a spool first, and its size, modification time and change time are compared before and after. A
+file that changed is read again, up to fileReader.retries times, and only a read that nothing happened during goes
+into the archive. A file that keeps changing is archived as it was last read, and reported.
+*/
+
+// DefaultFileRetries is how many times a file that changed while it was read is read again, when fileRetries isn't set
+const DefaultFileRetries = 3
+
+// spoolMemory is the size up to which files are spooled in memory, bigger ones go to a temporary file
+const spoolMemory = 16 << 20
+
+// fileSpooled is called once a file was read into its spool, before it is checked for changes (tests change files in it)
+var fileSpooled = func(name string) {}
+
+// fileReader reads the files of a vault for its archive, and keeps track of the ones that wouldn't hold still
+type fileReader struct {
+	retries  int
+	unstable []string // Relative to the vault
+}
+
+// newFileReader returns a fileReader with the vault's fileRetries
+func newFileReader(vault Vault) *fileReader {
+	retries := vault.FileRetries
+	if retries == 0 {
+		retries = DefaultFileRetries
+	}
+	return &fileReader{retries: retries}
+}
+
+// report adds the files that wouldn't hold still to the results of an archive
+func (r *fileReader) report(results []TargetResult) {
+	for i := range results {
+		results[i].Unstable = r.unstable
+	}
+}
+
+// markUnstable adds a file to the ones that are reported as not holding still, once
+func (r *fileReader) markUnstable(rel string) {
+	for _, unstable := range r.unstable {
+		if unstable == rel {
+			return
+		}
+	}
+	r.unstable = append(r.unstable, rel)
+}
+
+// fileState is what is compared to find out whether a file changed while it was read
+type fileState struct {
+	size       int64
+	modTime    time.Time
+	changeTime time.Time // Also changes when a file is replaced by renaming another one over it, or its permissions change
+}
+
+func statFile(name string) (fileState, os.FileInfo, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return fileState{}, nil, err
+	}
+	return fileState{info.Size(), info.ModTime(), changeTime(info)}, info, nil
+}
+
+func (a fileState) equal(b fileState) bool {
+	return a.size == b.size && a.modTime.Equal(b.modTime) && a.changeTime.Equal(b.changeTime)
+}
+
+/*
+read reads a file into a spool, which the caller has to close, and returns it along with the file's info from
+right before it was read
+
+A file that changed while it was read is read again after a short pause. When it changed every time, the last read
+is returned, and the file is added to r.unstable.
+*/
+func (r *fileReader) read(name string, rel string) (*spool, os.FileInfo, error) {
+	for attempt := 0; ; attempt++ {
+		before, info, err := statFile(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		s, err := spoolFile(name, before.size)
+		if err != nil {
+			return nil, nil, err
+		}
+		fileSpooled(name)
+		after, _, err := statFile(name)
+		if err != nil {
+			s.Close()
+			return nil, nil, err
+		}
+		if before.equal(after) && s.size == before.size {
+			return s, info, nil
+		}
+		if attempt >= r.retries {
+			r.markUnstable(rel)
+			return s, info, nil
+		}
+		s.Close()
+		time.Sleep(time.Duration(attempt+1) * 100 * time.Millisecond) // Gives whatever is writing to it the time to finish
+	}
+}
+
+// spool holds a copy of a file, in memory or in a temporary file
+type spool struct {
+	buf  *bytes.Reader
+	file *os.File
+	size int64
+}
+
+// spoolFile copies a file into a spool, size is what the file's size was just before
+func spoolFile(name string, size int64) (*spool, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if size <= spoolMemory {
+		var buf bytes.Buffer
+		buf.Grow(int(size) + bytes.MinRead) // Reading to the end needs room past the last byte
+		_, err := buf.ReadFrom(file)
+		if err != nil {
+			return nil, err
+		}
+		return &spool{buf: bytes.NewReader(buf.Bytes()), size: int64(buf.Len())}, nil
+	}
+
+	tmp, err := os.CreateTemp("", "go-archive-it-*.spool")
+	if err != nil {
+		return nil, err
+	}
+	n, err := io.Copy(tmp, file)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("spooling %s: %w", name, err)
+	}
+	return &spool{file: tmp, size: n}, nil
+}
+
+func (s *spool) Read(p []byte) (int, error) {
+	if s.file != nil {
+		return s.file.Read(p)
+	}
+	return s.buf.Read(p)
+}
+
+func (s *spool) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
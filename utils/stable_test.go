@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// changeWhileRead has fileSpooled call change with the number of reads so far, until the test is over
+func changeWhileRead(t *testing.T, change func(reads int)) {
+	reads := 0
+	fileSpooled = func(string) {
+		change(reads)
+		reads++
+	}
+	t.Cleanup(func() { fileSpooled = func(string) {} })
+}
+
+// version is what a file that changes while it is read holds after it was written n times, it grows every time
+func version(n int) string {
+	return fmt.Sprintf("version %d\n", n) + strings.Repeat("x", n)
+}
+
+// readSpool reads a whole spool and closes it
+func readSpool(t *testing.T, s *spool) string {
+	t.Helper()
+	defer s.Close()
+	data, err := io.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFileReaderRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		changes  int // How many reads the file changes during
+		retries  int
+		want     int // The version that is archived
+		reads    int
+		unstable bool
+	}{
+		{"unchanged", 0, 3, 0, 1, false},
+		{"settles after a retry", 1, 3, 1, 2, false},
+		{"settles on the last retry", 3, 3, 3, 4, false},
+		{"never settles", 100, 3, 3, 4, true},
+		{"never settles, without retries", 100, 1, 1, 2, true},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "note.md")
+		err := os.WriteFile(path, []byte(version(0)), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reads := 0
+		changeWhileRead(t, func(read int) {
+			reads++
+			if read < test.changes {
+				err := os.WriteFile(path, []byte(version(read+1)), 0o644)
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		})
+
+		files := &fileReader{retries: test.retries}
+		s, info, err := files.read(path, "note.md")
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		want := version(test.want)
+		if got := readSpool(t, s); got != want || s.size != int64(len(want)) {
+			t.Errorf("%s: read %q (%d bytes), expected %q", test.name, got, s.size, want)
+		}
+		if info.Size() != int64(len(want)) {
+			t.Errorf("%s: the info is of a %d byte file, not of the one that was read", test.name, info.Size())
+		}
+		if reads != test.reads {
+			t.Errorf("%s: read the file %d times, expected %d", test.name, reads, test.reads)
+		}
+		if got := files.unstable != nil; got != test.unstable || test.unstable && !reflect.DeepEqual(files.unstable, []string{"note.md"}) {
+			t.Errorf("%s: %v were reported as unstable", test.name, files.unstable)
+		}
+	}
+}
+
+func TestArchiveReportsUnstableFiles(t *testing.T) {
+	vault := archiveVault(t, Target{Destination: t.TempDir(), Retention: 3})
+	vault.FileRetries = 1
+	path := filepath.Join(vault.Path, "note.md")
+	changeWhileRead(t, func(read int) {
+		err := os.WriteFile(path, []byte(version(read+1)), 0o644)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	results, err := Archive(vault, "", false)
+	if err != nil || results[0].Err != nil {
+		t.Fatalf("Archive gave %v, %v", err, results)
+	}
+	if !reflect.DeepEqual(results[0].Unstable, []string{"note.md"}) {
+		t.Errorf("%v were reported as unstable", results[0].Unstable)
+	}
+	archive, err := os.ReadFile(filepath.Join(vault.Destinations[0].Destination, vault.Name, results[0].Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tarFiles(t, archive, FormatTar)["note.md"]; got != version(1) { // As it was last read
+		t.Errorf("the archive has %q", got)
+	}
+}
+
+func TestSpoolFile(t *testing.T) {
+	dir := t.TempDir()
+	for _, size := range []int{0, 100, spoolMemory, spoolMemory + 1, spoolMemory + 5000} {
+		data := randomBytes(t, size)
+		path := filepath.Join(dir, "file")
+		err := os.WriteFile(path, data, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := spoolFile(path, int64(size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		inFile := size > spoolMemory
+		if got := s.file != nil; got != inFile {
+			t.Errorf("a %d byte file was spooled to a temporary file: %t", size, got)
+		}
+		var temp string
+		if s.file != nil {
+			temp = s.file.Name()
+		}
+		if got := readSpool(t, s); s.size != int64(size) || !bytes.Equal([]byte(got), data) {
+			t.Errorf("spooling a %d byte file gave %d bytes that don't match", size, s.size)
+		}
+		if _, err := os.Stat(temp); temp != "" && !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("closing the spool left %s behind", temp)
+		}
+	}
+
+	// A file that grew since its size was taken is spooled whole
+	path := filepath.Join(dir, "grown")
+	err := os.WriteFile(path, []byte("some notes, and then some more"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := spoolFile(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readSpool(t, s); got != "some notes, and then some more" {
+		t.Errorf("spooling a file that grew gave %q", got)
+	}
+}
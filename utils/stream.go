@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+/*
+StreamArchive writes an archive of a vault to w instead of its destinations, e.g. to pipe it into ssh or mbuffer
+
+format is the archive's format, or "" for the vault's. Nothing is saved, so the vault's destinations, retention,
+recovery data, volumes and erasure coding don't apply. Files that kept changing while they were read are logged.
+*/
+func StreamArchive(vault Vault, format string, w io.Writer) error {
+	if format == "" {
+		format = vault.Format
+	}
+	switch format {
+	case FormatTar, FormatTarGz, FormatTarZst:
+	default:
+		return fmt.Errorf("unknown archive format %q", format)
+	}
+	bw := bufio.NewWriterSize(w, 1<<20)
+	files := newFileReader(vault)
+	err := writeArchive(vault, format, bw, files)
+	if err != nil {
+		return fmt.Errorf("creating %s archive: %w", format, err)
+	}
+	for _, file := range files.unstable {
+		log.Printf("[[ UNSTABLE ]] %s/%s kept changing while it was read", vault.Name, file)
+	}
+	return bw.Flush()
+}
+
+/*
+SniffFormat finds out the format of an archive that is being read from r, from its first bytes
+
+An archive read from a pipe has no name to tell how it is compressed, so gzip and zstd are recognized by their magic
+numbers, and anything else is taken to be a plain tar. The returned reader still starts at the beginning of the archive.
+*/
+func SniffFormat(r io.Reader) (string, io.Reader, error) {
+	br := bufio.NewReaderSize(r, 1<<20)
+	magic, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return "", nil, err
+	}
+	if len(magic) == 0 {
+		return "", nil, errors.New("there is no archive to read, it is empty")
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return FormatTarGz, br, nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return FormatTarZst, br, nil
+	default:
+		return FormatTar, br, nil
+	}
+}
+
+// StreamName is the name of an archive of the given format that has no name of its own, for Extract and VerifyStream
+func StreamName(format string) string {
+	return "stdin." + format
+}
+
+/*
+VerifyStream reads an archive from r and checks that it is intact, like VerifyArchive
+
+The format is found with SniffFormat, and returned along with the number of files in the archive.
+*/
+func VerifyStream(r io.Reader) (int, string, error) {
+	format, r, err := SniffFormat(r)
+	if err != nil {
+		return 0, "", err
+	}
+	files, err := readArchive(r, StreamName(format))
+	if err == nil {
+		_, err = io.Copy(io.Discard, r) // Padding after the end of the tar stream
+	}
+	return files, format, err
+}
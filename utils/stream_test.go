@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readTree returns the files under dir by their slash separated paths, with their contents
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		files[filepath.ToSlash(rel)] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// streamVault makes a vault with a few files in it
+func streamVault(t *testing.T) (Vault, map[string]string) {
+	t.Helper()
+	files := map[string]string{
+		"note.md":          "some notes\n",
+		"daily/monday.md":  strings.Repeat("a long day\n", 5000),
+		"daily/tuesday.md": "",
+	}
+	dir := t.TempDir()
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		if err == nil {
+			err = os.WriteFile(path, []byte(data), 0o644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return Vault{Name: "notes", Path: dir, Settings: Settings{Format: FormatTarGz}}, files
+}
+
+func TestStreamArchive(t *testing.T) {
+	vault, files := streamVault(t)
+	for _, format := range []string{"", FormatTar, FormatTarGz, FormatTarZst} {
+		want := format
+		if format == "" {
+			want = vault.Format // The vault's own
+		}
+		var archive bytes.Buffer
+		err := StreamArchive(vault, format, &archive)
+		if err != nil {
+			t.Fatalf("StreamArchive(%q): %s", format, err)
+		}
+
+		count, got, err := VerifyStream(bytes.NewReader(archive.Bytes()))
+		if err != nil || got != want || count != len(files) {
+			t.Errorf("VerifyStream of a %q stream gave %d files of %s (%v), expected %d of %s", format, count, got, err, len(files), want)
+		}
+
+		// What restore - does with an archive piped to stdin
+		got, r, err := SniffFormat(bytes.NewReader(archive.Bytes()))
+		if err != nil || got != want {
+			t.Fatalf("SniffFormat of a %q stream gave %s (%v), expected %s", format, got, err, want)
+		}
+		dir := filepath.Join(t.TempDir(), "restored")
+		count, err = Extract(r, StreamName(got), dir)
+		if err != nil || count != len(files) {
+			t.Errorf("extracting a %q stream gave %d files (%v), expected %d", format, count, err, len(files))
+		}
+		if restored := readTree(t, dir); !reflect.DeepEqual(restored, files) {
+			t.Errorf("a %q stream restored %d files that don't match the vault", format, len(restored))
+		}
+	}
+
+	if err := StreamArchive(vault, "zip", io.Discard); err == nil {
+		t.Error("StreamArchive made a zip archive")
+	}
+}
+
+func TestVerifyStreamFindsDamage(t *testing.T) {
+	vault, _ := streamVault(t)
+	for _, format := range []string{FormatTar, FormatTarGz, FormatTarZst} {
+		var archive bytes.Buffer
+		err := StreamArchive(vault, format, &archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := archive.Bytes()
+
+		if _, _, err := VerifyStream(bytes.NewReader(data[:len(data)/2])); err == nil {
+			t.Errorf("VerifyStream found nothing wrong with half of a %s stream", format)
+		}
+		if format == FormatTar {
+			continue // Only the headers of a tar archive have checksums
+		}
+		damaged := bytes.Clone(data)
+		damaged[len(damaged)/2] ^= 0xff
+		if _, _, err := VerifyStream(bytes.NewReader(damaged)); err == nil {
+			t.Errorf("VerifyStream found nothing wrong with a damaged %s stream", format)
+		}
+	}
+
+	// Anything without the magic number of gzip or zstd is taken for a tar archive, and has to be one
+	if _, _, err := VerifyStream(strings.NewReader("not an archive at all, just some text that was piped in by mistake")); err == nil {
+		t.Error("VerifyStream took text for an archive")
+	}
+}
+
+func TestEmptyStream(t *testing.T) {
+	_, _, err := SniffFormat(strings.NewReader(""))
+	if err == nil || !strings.Contains(err.Error(), "it is empty") {
+		t.Errorf("SniffFormat of an empty stream gave %v", err)
+	}
+	_, _, err = VerifyStream(strings.NewReader(""))
+	if err == nil || !strings.Contains(err.Error(), "it is empty") {
+		t.Errorf("VerifyStream of an empty stream gave %v", err)
+	}
+
+	// Shorter than a magic number is still read in full
+	format, r, err := SniffFormat(strings.NewReader("\x1f"))
+	if err != nil || format != FormatTar {
+		t.Fatalf("SniffFormat of a single byte gave %s (%v)", format, err)
+	}
+	if data, _ := io.ReadAll(r); string(data) != "\x1f" {
+		t.Errorf("SniffFormat lost the start of the stream, read %q", data)
+	}
+}
@@ -0,0 +1,269 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"time"
+)
+
+// modTimeSetter is implemented by destinations that can set an archive's modification time
+type modTimeSetter interface {
+	setModTime(name string, modTime time.Time) error
+}
+
+/*
+CopyArchive copies an archive from one destination to another, and checks that the copy is intact
+
+The archive is hashed with SHA-256 while it is copied, then read back from dst and hashed again. A copy that
+doesn't match is deleted from dst, so a bad copy never counts towards retention or stops the next sync from trying again.
+
+Destinations that can set modification times (local directories and SFTP) give the copy the original's, so that retention
+sees the archives in the order they were made. Elsewhere the copy is as new as the time it was copied.
+An archive that is stored as several files is copied a part at a time, and the files that belong with it are copied too.
+If one of them fails to copy, the ones that were copied before it are removed from dst.
+*/
+func CopyArchive(src Destination, dst Destination, archive ArchiveInfo) error {
+	return copyFiles(src, dst, archiveFiles(archive))
+}
+
+// archiveFiles returns the files an archive is stored as (its parts, or just the archive), followed by its sidecars
+func archiveFiles(archive ArchiveInfo) []ArchiveInfo {
+	files := archive.Parts
+	if len(files) == 0 {
+		files = []ArchiveInfo{{Name: archive.Name, Size: archive.Size, ModTime: archive.ModTime}}
+	}
+	return append(append([]ArchiveInfo{}, files...), archive.Sidecars...)
+}
+
+/*
+copyFiles copies each of the files with copyOne
+
+When one of them fails, the ones that were already copied are removed again, so dst is never left with some of the
+volumes of an archive that look like all of them, or sidecars without their archive.
+*/
+func copyFiles(src Destination, dst Destination, files []ArchiveInfo) error {
+	for i, file := range files {
+		err := copyOne(src, dst, file)
+		if err != nil {
+			for _, copied := range files[:i] {
+				dst.Delete(copied.Name)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// copyOne copies a single file and checks the copy, see CopyArchive
+func copyOne(src Destination, dst Destination, archive ArchiveInfo) error {
+	reader, err := src.Open(archive.Name)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	writer, err := dst.Create(archive.Name)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(writer, hash), reader)
+	if err == nil && archive.Size > 0 && n != archive.Size {
+		err = fmt.Errorf("read %d bytes, but %s reports %d", n, src, archive.Size)
+	}
+	if err != nil {
+		writer.Abort()
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+	want := hash.Sum(nil)
+
+	got, err := hashStored(dst, archive.Name)
+	if err != nil {
+		return fmt.Errorf("reading back the copy: %w", err)
+	}
+	if !bytes.Equal(got, want) {
+		dst.Delete(archive.Name)
+		return fmt.Errorf("the copy in %s doesn't match the original, it was removed", dst)
+	}
+
+	if setter, ok := dst.(modTimeSetter); ok && !archive.ModTime.IsZero() {
+		return setter.setModTime(archive.Name, archive.ModTime)
+	}
+	return nil
+}
+
+// hashStored returns the SHA-256 hash of a file in a destination
+func hashStored(dest Destination, name string) ([]byte, error) {
+	reader, err := dest.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, reader)
+	if err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// sameFile reports whether a file holds the same bytes in both destinations
+func sameFile(src Destination, dst Destination, name string) (bool, error) {
+	want, err := hashStored(src, name)
+	if err != nil {
+		return false, err
+	}
+	got, err := hashStored(dst, name)
+	if err != nil {
+		return false, fmt.Errorf("reading %s from %s: %w", name, dst, err)
+	}
+	return bytes.Equal(got, want), nil
+}
+
+/*
+MoveArchive moves an archive from one destination to another with CopyArchive, and removes it from src once the copy
+has been checked. Files that dst already has with the same size (from an earlier move that was interrupted, or a sync)
+aren't copied again, see completeArchive. They are hashed and compared with the ones in src first, and one that doesn't
+match is reported rather than replaced.
+
+Nothing is removed from src until every file of the archive is in dst, so a move that fails part of the way leaves the
+whole archive in src. The sidecars are removed before the archive itself, so a move that is interrupted while removing
+leaves an archive that the next move finishes, rather than sidecars without an archive.
+*/
+func MoveArchive(src Destination, dst Destination, archive ArchiveInfo) error {
+	files := archiveFiles(archive)
+	sizes := make(map[string]int64, len(files))
+	for _, file := range files {
+		info, err := dst.Stat(file.Name)
+		switch {
+		case err == nil:
+			sizes[file.Name] = info.Size
+		case !errors.Is(err, fs.ErrNotExist):
+			return err
+		}
+		if err != nil || info.Size != file.Size {
+			continue
+		}
+		// completeArchive leaves it alone, and it is all that is left of the file once src is removed
+		same, err := sameFile(src, dst, file.Name)
+		if err != nil {
+			return err
+		}
+		if !same {
+			return fmt.Errorf("%s already has a different %s", dst, file.Name)
+		}
+	}
+	_, err := completeArchive(src, dst, archive, sizes)
+	if err != nil {
+		return err
+	}
+
+	for i := len(files) - 1; i >= 0; i-- { // Sidecars first
+		err := src.Delete(files[i].Name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+completeArchive copies the files of an archive that dst is missing, or only has part of
+
+sizes holds the sizes of the files that dst has. A file that dst has at the same size is left alone, one that is smaller
+was cut short by an earlier copy and is copied again. One that is larger isn't the same file, and is reported rather than replaced.
+completeArchive returns the number of files that were copied.
+*/
+func completeArchive(src Destination, dst Destination, archive ArchiveInfo, sizes map[string]int64) (int, error) {
+	var copies, short []ArchiveInfo
+	for _, file := range archiveFiles(archive) {
+		size, ok := sizes[file.Name]
+		switch {
+		case !ok:
+		case size == file.Size:
+			continue
+		case size < file.Size:
+			short = append(short, file)
+		default:
+			return 0, fmt.Errorf("%s already has a different %s", dst, file.Name)
+		}
+		copies = append(copies, file)
+	}
+
+	for _, file := range short {
+		err := dst.Delete(file.Name)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(copies), copyFiles(src, dst, copies)
+}
+
+// fileSizes returns the sizes of the files that archives are stored as, and of their sidecars
+func fileSizes(archives []ArchiveInfo) map[string]int64 {
+	sizes := make(map[string]int64)
+	for _, archive := range archives {
+		for _, file := range archiveFiles(archive) {
+			sizes[file.Name] = file.Size
+		}
+	}
+	return sizes
+}
+
+/*
+SyncArchives copies every archive of a vault that is in src but missing from dst
+
+args:
+
+	vault Vault: The vault whose archives are synced, its naming template decides which files are archives
+	src Destination: Where the archives are copied from
+	dst Destination: Where missing archives are copied to
+	newest int: Only the newest archives in src are copied, 0 copies all of them (archives that retention would remove straight away aren't worth copying)
+	verbose bool: Whether every copied archive is logged
+
+Only complete archives are copied, files that are still being written or that aren't archives are left alone.
+An archive that dst already has is checked file by file (its parts and sidecars), files that are missing or were cut short
+are copied again, see completeArchive. An archive that fails to copy doesn't stop the others, SyncArchives returns the
+number of archives that were copied (or completed) and an error for every one that wasn't.
+*/
+func SyncArchives(vault Vault, src Destination, dst Destination, newest int, verbose bool) (int, error) {
+	archives, err := ListArchives(vault, src)
+	if err != nil {
+		return 0, err
+	}
+	if newest > 0 && len(archives) > newest {
+		archives = archives[len(archives)-newest:]
+	}
+	existing, err := ListArchives(vault, dst)
+	if err != nil {
+		return 0, err
+	}
+	sizes := fileSizes(existing)
+
+	copied := 0
+	var errs []error
+	for _, archive := range archives {
+		files, err := completeArchive(src, dst, archive, sizes)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", archive.Name, err))
+			continue
+		}
+		if files == 0 {
+			continue
+		}
+		copied++
+		if verbose {
+			log.Printf("Copied %s from %s to %s", archive.Name, src, dst)
+		}
+	}
+	return copied, errors.Join(errs...)
+}
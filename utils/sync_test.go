@@ -0,0 +1,215 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A volume set with recovery data, and an archive that is a single file
+const (
+	volumeSet = "2024-01-02T03-04-05Z.tar.gz"
+	single    = "2024-01-03T03-04-05Z.tar.gz"
+)
+
+var syncFiles = map[string]string{
+	volumeSet + ".part001":  "first volume",
+	volumeSet + ".part002":  "second volume",
+	volumeSet + ".recovery": "recovery data",
+	single:                  "single archive",
+}
+
+// writeFiles fills a local destination with files
+func writeFiles(t *testing.T, d localDestination, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		err := os.WriteFile(filepath.Join(d.dir, name), []byte(data), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readFiles returns what is in a local destination
+func readFiles(t *testing.T, d localDestination) map[string]string {
+	t.Helper()
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(d.dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[entry.Name()] = string(data)
+	}
+	return files
+}
+
+func newLocalDestination(t *testing.T, files map[string]string) localDestination {
+	d := localDestination{dir: t.TempDir()}
+	writeFiles(t, d, files)
+	return d
+}
+
+func TestSyncArchivesCompletesArchives(t *testing.T) {
+	vault := Vault{Name: "notes"}
+	tests := []struct {
+		name   string
+		dst    map[string]string
+		copied int
+	}{
+		{"empty", map[string]string{}, 2},
+		{"complete", syncFiles, 0},
+		{"missing volume", map[string]string{volumeSet + ".part001": "first volume", volumeSet + ".recovery": "recovery data", single: "single archive"}, 1},
+		{"missing sidecar", map[string]string{volumeSet + ".part001": "first volume", volumeSet + ".part002": "second volume", single: "single archive"}, 1},
+		{"short volume", map[string]string{volumeSet + ".part001": "first", volumeSet + ".part002": "second volume", volumeSet + ".recovery": "recovery data"}, 2},
+		{"short sidecar", map[string]string{volumeSet + ".part001": "first volume", volumeSet + ".part002": "second volume", volumeSet + ".recovery": "rec", single: "single archive"}, 1},
+		{"short archive", map[string]string{single: "single"}, 2},
+	}
+	for _, test := range tests {
+		src := newLocalDestination(t, syncFiles)
+		dst := newLocalDestination(t, test.dst)
+		copied, err := SyncArchives(vault, src, dst, 0, false)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if copied != test.copied {
+			t.Errorf("%s: copied %d archives, expected %d", test.name, copied, test.copied)
+		}
+		if got := readFiles(t, dst); !reflect.DeepEqual(got, syncFiles) {
+			t.Errorf("%s: dst has %v after the sync", test.name, got)
+		}
+	}
+}
+
+func TestSyncArchivesLeavesDifferentFilesAlone(t *testing.T) {
+	src := newLocalDestination(t, syncFiles)
+	different := map[string]string{volumeSet + ".part001": "a much longer first volume"}
+	dst := newLocalDestination(t, different)
+
+	copied, err := SyncArchives(Vault{Name: "notes"}, src, dst, 0, false)
+	if err == nil || !strings.Contains(err.Error(), "already has a different "+volumeSet+".part001") {
+		t.Errorf("SyncArchives gave %v, expected the different volume to be reported", err)
+	}
+	if copied != 1 {
+		t.Errorf("copied %d archives, expected only the one that didn't clash", copied)
+	}
+	want := map[string]string{volumeSet + ".part001": "a much longer first volume", single: "single archive"}
+	if got := readFiles(t, dst); !reflect.DeepEqual(got, want) {
+		t.Errorf("dst has %v after the sync", got)
+	}
+}
+
+// failingDestination fails to create one file
+type failingDestination struct {
+	Destination
+	fail string
+}
+
+func (d failingDestination) Create(name string) (ArchiveWriter, error) {
+	if name == d.fail {
+		return nil, errors.New("no space left")
+	}
+	return d.Destination.Create(name)
+}
+
+func TestMoveArchiveOnlyRemovesCompleteMoves(t *testing.T) {
+	vault := Vault{Name: "notes"}
+	for _, fail := range []string{volumeSet + ".part001", volumeSet + ".part002", volumeSet + ".recovery"} {
+		src := newLocalDestination(t, syncFiles)
+		dst := newLocalDestination(t, nil)
+		archives, err := ListArchives(vault, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var archive ArchiveInfo
+		for _, a := range archives {
+			if a.Name == volumeSet {
+				archive = a
+			}
+		}
+		if len(archive.Parts) != 2 || len(archive.Sidecars) != 1 {
+			t.Fatalf("ListArchives gave %+v", archives)
+		}
+
+		err = MoveArchive(src, failingDestination{dst, fail}, archive)
+		if err == nil {
+			t.Errorf("failing to copy %s wasn't reported", fail)
+		}
+		if got := readFiles(t, src); !reflect.DeepEqual(got, syncFiles) {
+			t.Errorf("failing to copy %s left %v in src", fail, got)
+		}
+
+		err = MoveArchive(src, dst, archive) // Finishes the move
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readFiles(t, src); !reflect.DeepEqual(got, map[string]string{single: "single archive"}) {
+			t.Errorf("src has %v after the move", got)
+		}
+		want := map[string]string{}
+		for name, data := range syncFiles {
+			if name != single {
+				want[name] = data
+			}
+		}
+		if got := readFiles(t, dst); !reflect.DeepEqual(got, want) {
+			t.Errorf("dst has %v after the move", got)
+		}
+	}
+}
+
+func TestMoveArchiveKeepsDifferentFiles(t *testing.T) {
+	for _, different := range []string{"a different, longer archive", "single ARCHIVE"} { // The second is just as long
+		src := newLocalDestination(t, syncFiles)
+		dst := newLocalDestination(t, map[string]string{single: different})
+		err := MoveArchive(src, dst, ArchiveInfo{Name: single, Size: int64(len(syncFiles[single]))})
+		if err == nil || !strings.Contains(err.Error(), "already has a different "+single) {
+			t.Errorf("MoveArchive gave %v, expected %q in dst to be reported", err, different)
+		}
+		if got := readFiles(t, src); !reflect.DeepEqual(got, syncFiles) {
+			t.Errorf("src has %v after the failed move", got)
+		}
+		if got := readFiles(t, dst); !reflect.DeepEqual(got, map[string]string{single: different}) {
+			t.Errorf("dst has %v after the failed move", got)
+		}
+	}
+
+	// A file that dst already has and that matches isn't copied again
+	src := newLocalDestination(t, syncFiles)
+	dst := newLocalDestination(t, map[string]string{single: "single archive"})
+	err := MoveArchive(src, failingDestination{dst, single}, ArchiveInfo{Name: single, Size: int64(len(syncFiles[single]))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := readFiles(t, src)[single]; ok {
+		t.Error("the archive is still in src after the move")
+	}
+}
+
+func TestCopyArchiveRemovesPartialCopies(t *testing.T) {
+	src := newLocalDestination(t, syncFiles)
+	archives, err := ListArchives(Vault{Name: "notes"}, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, archive := range archives {
+		for _, file := range archiveFiles(archive) {
+			dst := newLocalDestination(t, nil)
+			err := CopyArchive(src, failingDestination{dst, file.Name}, archive)
+			if err == nil {
+				t.Errorf("failing to copy %s wasn't reported", file.Name)
+			}
+			if got := readFiles(t, dst); len(got) != 0 {
+				t.Errorf("failing to copy %s left %v in dst", file.Name, sortedKeys(got))
+			}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+SystemdNotify sends a state update (like READY=1, RELOADING=1, STOPPING=1 or STATUS=...) to systemd, for services
+with Type=notify, see sd_notify(3)
+
+It does nothing when the process wasn't started by systemd, that is when NOTIFY_SOCKET isn't set.
+*/
+func SystemdNotify(state ...string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:] // An abstract socket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(strings.Join(state, "\n")))
+	return err
+}
+
+/*
+SystemdWatchdog tells systemd that the process is alive, at half of the service's WatchdogSec, until ctx is done
+
+It returns straight away when the watchdog isn't enabled for the process.
+*/
+func SystemdWatchdog(ctx context.Context) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return // Meant for another process
+	}
+	ticker := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			SystemdNotify("WATCHDOG=1")
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed templates/*.yaml
+var builtinTemplates embed.FS
+
+// Template is a starting point for a config file, with variables that are filled in when it is used
+type Template struct {
+	Name        string             `yaml:"-"`
+	Description string             `yaml:"description"`
+	Variables   []TemplateVariable `yaml:"variables"`
+	Config      string             `yaml:"config"` // The config file, as a text/template using the variables
+}
+
+// TemplateVariable is a value that a template asks for, it is available in the template as {{ .Name }}
+type TemplateVariable struct {
+	Name    string `yaml:"name"`
+	Prompt  string `yaml:"prompt"`
+	Default string `yaml:"default"`
+}
+
+/*
+LoadTemplate finds a template by name
+
+Templates in templatesDir (NAME.yaml) are looked at first, so a user template with the same name as a built-in one replaces it.
+*/
+func LoadTemplate(name string, templatesDir string) (Template, error) {
+	file, err := ioutil.ReadFile(filepath.Join(templatesDir, name+".yaml"))
+	if os.IsNotExist(err) {
+		file, err = builtinTemplates.ReadFile("templates/" + name + ".yaml")
+		if err != nil {
+			return Template{}, fmt.Errorf("no template named %q, run `go-archive-it init --list-templates` to see the available templates", name)
+		}
+	} else if err != nil {
+		return Template{}, err
+	}
+
+	return parseTemplate(name, file)
+}
+
+func parseTemplate(name string, file []byte) (Template, error) {
+	var t Template
+	err := yaml.Unmarshal(file, &t)
+	if err != nil {
+		return Template{}, fmt.Errorf("template %s: %w", name, err)
+	}
+	t.Name = name
+	if t.Config == "" {
+		return Template{}, fmt.Errorf("template %s has no config", name)
+	}
+	return t, nil
+}
+
+// ListTemplates returns every built-in and user template, sorted by name
+func ListTemplates(templatesDir string) ([]Template, error) {
+	files := make(map[string][]byte)
+
+	builtin, err := fs.Glob(builtinTemplates, "templates/*.yaml")
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range builtin {
+		file, err := builtinTemplates.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		files[strings.TrimSuffix(filepath.Base(path), ".yaml")] = file
+	}
+
+	user, err := filepath.Glob(filepath.Join(templatesDir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range user {
+		file, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		files[strings.TrimSuffix(filepath.Base(path), ".yaml")] = file
+	}
+
+	templates := make([]Template, 0, len(files))
+	for name, file := range files {
+		t, err := parseTemplate(name, file)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	return templates, nil
+}
+
+/*
+Render fills in the template's variables and returns the resulting config file
+
+args:
+
+	values map[string]string: Values for the variables, usually from --set flags
+	input io.Reader: Where to read answers from for variables that are not in values, or nil to never ask
+
+Variables that are not in values are asked for on input, an empty answer (or the end of input) uses the default.
+Variables without a default must be given a value.
+*/
+func (t Template) Render(values map[string]string, input io.Reader) ([]byte, error) {
+	data := make(map[string]string, len(t.Variables))
+	known := make(map[string]bool, len(t.Variables))
+	for _, variable := range t.Variables {
+		known[variable.Name] = true
+	}
+	for name := range values {
+		if !known[name] {
+			return nil, fmt.Errorf("template %s has no variable named %s", t.Name, name)
+		}
+	}
+
+	var reader *bufio.Reader
+	if input != nil {
+		reader = bufio.NewReader(input)
+	}
+
+	for _, variable := range t.Variables {
+		value, ok := values[variable.Name]
+		if !ok && reader != nil {
+			value = ask(reader, variable)
+		}
+		if value == "" {
+			value = variable.Default
+		}
+		if value == "" {
+			return nil, fmt.Errorf("template %s needs a value for %s, pass it with --set %s=VALUE", t.Name, variable.Name, variable.Name)
+		}
+		data[variable.Name] = value
+	}
+
+	tmpl, err := template.New(t.Name).Option("missingkey=error").Funcs(templateFuncs).Parse(t.Config)
+	if err != nil {
+		return nil, fmt.Errorf("template %s: %w", t.Name, err)
+	}
+	var config bytes.Buffer
+	err = tmpl.Execute(&config, data)
+	if err != nil {
+		return nil, fmt.Errorf("template %s: %w", t.Name, err)
+	}
+	return config.Bytes(), nil
+}
+
+/*
+templateFuncs are the functions templates can pass values through, so that a value can't change the yaml around it
+
+	quote: A yaml string in double quotes, so that # (a comment), : (a mapping), or * and & (aliases) are kept as they are
+	number: A whole number as it is, anything else is an error
+*/
+var templateFuncs = template.FuncMap{
+	"quote": func(value string) (string, error) {
+		out, err := yaml.Marshal(&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Style: yaml.DoubleQuotedStyle, Value: value})
+		return strings.TrimSuffix(string(out), "\n"), err
+	},
+	"number": func(value string) (string, error) {
+		_, err := strconv.Atoi(value)
+		if err != nil {
+			return "", fmt.Errorf("%q is not a whole number", value)
+		}
+		return value, nil
+	},
+}
+
+// ask prompts for a single variable on stdout and reads the answer
+func ask(reader *bufio.Reader, variable TemplateVariable) string {
+	prompt := variable.Prompt
+	if prompt == "" {
+		prompt = variable.Name
+	}
+	if variable.Default != "" {
+		fmt.Printf("%s [%s]: ", prompt, variable.Default)
+	} else {
+		fmt.Printf("%s: ", prompt)
+	}
+	answer, _ := reader.ReadString('\n')
+	return strings.TrimSpace(answer)
+}
+
+/*
+InitConfig creates a config file from a template
+
+If a config file already exists at configPath it is left alone. See Template.Render for how values and input are used.
+The config is checked like any other (see ValidateConfig) before it is written, so a value that doesn't work (like a
+vault path that doesn't exist) is reported instead of being written to a config that won't load.
+*/
+func InitConfig(configPath string, t Template, values map[string]string, input io.Reader) error {
+	if _, err := os.Stat(configPath); err == nil {
+		log.Printf("Config found at %s, leaving it alone", configPath)
+		return nil
+	}
+
+	config, err := t.Render(values, input)
+	if err != nil {
+		return err
+	}
+	_, errs := validateConfig(config, configPath)
+	if len(errs) > 0 {
+		lines := make([]string, len(errs))
+		for i, err := range errs {
+			lines[i] = "\n  " + err.Error()
+		}
+		return fmt.Errorf("the %s template made a config with mistakes, change the values (with --set) or the template:%s", t.Name, strings.Join(lines, ""))
+	}
+
+	err = os.MkdirAll(filepath.Dir(configPath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(configPath, config, 0664)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Config Created at %s from the %s template, make any neccesary changes and run `go-archive-it config validate`", configPath, t.Name)
+	return nil
+}
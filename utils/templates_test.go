@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderKeepsValuesAsTheyAre(t *testing.T) {
+	values := []string{
+		"/archive/notes #1",
+		"*notes",
+		"&notes",
+		"!notes",
+		"notes: old",
+		`quotes " and \ backslashes`,
+		"~/Documents",
+		"123",
+		"yes",
+	}
+	templates, err := ListTemplates(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tmpl := range templates {
+		for _, value := range values {
+			set := make(map[string]string)
+			for _, variable := range tmpl.Variables {
+				if variable.Name == "retention" {
+					set[variable.Name] = "7"
+				} else {
+					set[variable.Name] = value
+				}
+			}
+			file, err := tmpl.Render(set, nil)
+			if err != nil {
+				t.Errorf("%s with %q: %s", tmpl.Name, value, err)
+				continue
+			}
+			config, err := parseConfig(file)
+			if err != nil {
+				t.Errorf("%s with %q: %s\n%s", tmpl.Name, value, err, file)
+				continue
+			}
+			if config.Defaults.Destination != value {
+				t.Errorf("%s with %q: destination is %q", tmpl.Name, value, config.Defaults.Destination)
+			}
+			found := false
+			for _, vault := range config.Vaults {
+				found = found || vault.Path == value
+			}
+			if !found && tmpl.Name != "home-documents" { // The one template without a path variable
+				t.Errorf("%s with %q: no vault has it as its path\n%s", tmpl.Name, value, file)
+			}
+		}
+	}
+}
+
+func TestRenderRejectsNumbersThatArent(t *testing.T) {
+	tmpl, err := LoadTemplate("home-documents", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, retention := range []string{"ten", "1 # comment", "1: 2", "1.5"} {
+		_, err := tmpl.Render(map[string]string{"destination": "/archive", "retention": retention}, nil)
+		if err == nil {
+			t.Errorf("retention %q was accepted", retention)
+		}
+	}
+	_, err = tmpl.Render(map[string]string{"destination": "/archive", "retention": "12"}, nil)
+	if err != nil {
+		t.Errorf("retention 12: %s", err)
+	}
+}
+
+func TestInitConfigOnlyWritesValidConfigs(t *testing.T) {
+	dir := t.TempDir()
+	tmpl, err := LoadTemplate("obsidian-vault", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	missing := filepath.Join(dir, "missing.yaml")
+	err = InitConfig(missing, tmpl, map[string]string{"vault": filepath.Join(dir, "nowhere"), "destination": filepath.Join(dir, "archive")}, nil)
+	if err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("a vault path that doesn't exist gave %v, expected it to be reported", err)
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("the invalid config was written anyway")
+	}
+
+	vault := filepath.Join(dir, "my notes #1")
+	err = os.Mkdir(vault, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := filepath.Join(dir, "valid.yaml")
+	err = InitConfig(valid, tmpl, map[string]string{"vault": vault, "destination": filepath.Join(dir, "archive")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, errs := ValidateConfig(valid)
+	if len(errs) > 0 {
+		t.Fatalf("the written config has mistakes: %v", errs)
+	}
+	if len(config.Vaults) != 1 || config.Vaults[0].Path != vault {
+		t.Errorf("vaults are %+v, expected one at %s", config.Vaults, vault)
+	}
+}
@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+/*
+Skipping vaults that haven't changed
+
+Every archive of a vault with skipUnchanged set is saved along with a manifest (NAME.manifest), which lists each file
+that went into it with its size, modification time and mode, and with skipUnchanged set to hash, a SHA-256 of its
+contents too. Before the vault is archived again, a manifest of the vault as it is now is compared to the newest
+archive's in every destination, and when they all match nothing is archived, so an unchanged vault doesn't push an
+older archive that is actually different out of retention.
+
+The manifest is a sidecar of the archive, so it is removed, synced and moved to the cold tier along with it.
+*/
+
+// Values of the skipUnchanged setting
+const (
+	SkipMetadata = "metadata" // Compare paths, sizes, modification times and modes
+	SkipHash     = "hash"     // Compare the contents of every file as well, which means reading all of them
+)
+
+// Values of the archiveEvery setting, the calendar periods (in local time) that get at least one archive each
+const (
+	EveryDay   = "day"
+	EveryWeek  = "week" // Starting on Monday
+	EveryMonth = "month"
+)
+
+const manifestSuffix = ".manifest"
+
+// manifestVersion is bumped whenever what goes into a manifest changes, so older manifests never match
+const manifestVersion = 1
+
+/*
+makeManifest lists what an archive of the vault would hold, as it is right now
+
+Files are listed the same way they are archived, so excluded files are left out, and for a git vault only the files
+git would archive are listed (along with every ref, in bundle mode). The -wal, -shm and -journal files of SQLite
+databases are listed even though the database's snapshot is archived instead of them, because changes can sit in them
+without the database file itself changing.
+*/
+func makeManifest(vault Vault) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "go-archive-it manifest %d\nformat %s\nskipUnchanged %s\ngit %s\n", manifestVersion, vault.Format, vault.SkipUnchanged, vault.Git)
+	add := func(path string, rel string) error {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "%s\t%d\t%d\t%o", strconv.Quote(filepath.ToSlash(rel)), info.Size(), info.ModTime().UnixNano(), info.Mode())
+		if vault.SkipUnchanged == SkipHash {
+			sum, err := hashFile(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(&b, "\t%x", sum)
+		}
+		b.WriteByte('\n')
+		return nil
+	}
+
+	if vault.Git != "" {
+		if vault.Git == GitBundle {
+			err := runGit(vault.Path, &b, "for-each-ref", "--format=ref %(objectname) %(refname)")
+			if err != nil {
+				return nil, err
+			}
+		}
+		paths, err := gitListFiles(vault.Path, "--cached", "--others", "--exclude-standard")
+		if err != nil {
+			return nil, err
+		}
+		for _, rel := range paths {
+			path := filepath.Join(vault.Path, filepath.FromSlash(rel))
+			if isExcludedListed(path, vault.Path, vault.Exclude) {
+				continue
+			}
+			info, err := os.Stat(path)
+			if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+				continue // Deleted from the working tree, or a submodule, see addListed
+			}
+			err = add(path, rel)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return b.Bytes(), nil
+	}
+
+	vaultPath := vault.Path
+	if target, err := os.Readlink(vaultPath); err == nil {
+		vaultPath = target // tarArchive follows it as well
+	}
+	err := filepath.Walk(vaultPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != vaultPath && isExcluded(path, vaultPath, vault.Exclude) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(vaultPath, path)
+		if err != nil {
+			return err
+		}
+		return add(path, rel)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func hashFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+/*
+unchangedSince returns the newest archive of the vault when it holds what the manifest lists in every destination,
+or "" when the vault has to be archived
+
+A destination that can't be listed or read, doesn't have an archive with a manifest yet, or (with vault.ArchiveEvery
+set) whose newest archive was made before the current period started, means the vault is archived.
+*/
+func unchangedSince(vault Vault, dests []Destination, manifest []byte, now time.Time) string {
+	var periodStart time.Time
+	if vault.ArchiveEvery != "" {
+		periodStart = startOfPeriod(vault.ArchiveEvery, now)
+	}
+	name := ""
+	for _, dest := range dests {
+		if dest == nil {
+			return ""
+		}
+		archives, err := ListArchives(vault, dest)
+		if err != nil || len(archives) == 0 {
+			return ""
+		}
+		newest := archives[len(archives)-1]
+		if newest.ModTime.Before(periodStart) {
+			return ""
+		}
+		last, err := readManifest(dest, newest)
+		if err != nil || !bytes.Equal(last, manifest) {
+			return ""
+		}
+		if name == "" {
+			name = newest.Name
+		}
+	}
+	return name
+}
+
+// manifestReader returns a manifest as a reader that upload can take
+func manifestReader(manifest []byte) *io.SectionReader {
+	return io.NewSectionReader(bytes.NewReader(manifest), 0, int64(len(manifest)))
+}
+
+// readManifest reads the manifest that was saved along with an archive
+func readManifest(dest Destination, archive ArchiveInfo) ([]byte, error) {
+	found := false
+	for _, sidecar := range archive.Sidecars {
+		found = found || sidecar.Name == archive.Name+manifestSuffix
+	}
+	if !found {
+		return nil, fmt.Errorf("%s has no manifest", archive.Name)
+	}
+	reader, err := dest.Open(archive.Name + manifestSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// startOfPeriod returns when the archiveEvery period that now is in started, in local time
+func startOfPeriod(every string, now time.Time) time.Time {
+	now = now.Local()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	switch every {
+	case EveryWeek:
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case EveryMonth:
+		return day.AddDate(0, 0, 1-day.Day())
+	default:
+		return day
+	}
+}
@@ -0,0 +1,157 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	_ "time/tzdata" // So the zones below don't depend on the machine
+)
+
+func TestStartOfPeriod(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := time.Local
+	t.Cleanup(func() { time.Local = local })
+
+	tests := []struct {
+		zone  *time.Location
+		every string
+		now   time.Time
+		want  time.Time
+	}{
+		{time.UTC, EveryDay, time.Date(2024, 5, 15, 13, 45, 0, 0, time.UTC), time.Date(2024, 5, 15, 0, 0, 0, 0, time.UTC)},
+		{time.UTC, "", time.Date(2024, 5, 15, 13, 45, 0, 0, time.UTC), time.Date(2024, 5, 15, 0, 0, 0, 0, time.UTC)},
+		{time.UTC, EveryWeek, time.Date(2024, 5, 15, 13, 45, 0, 0, time.UTC), time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC)},   // Wednesday
+		{time.UTC, EveryWeek, time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC), time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC)},     // Monday
+		{time.UTC, EveryWeek, time.Date(2024, 5, 19, 23, 59, 0, 0, time.UTC), time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC)},   // Sunday
+		{time.UTC, EveryWeek, time.Date(2024, 1, 3, 12, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},      // Across the year
+		{time.UTC, EveryWeek, time.Date(2025, 1, 2, 12, 0, 0, 0, time.UTC), time.Date(2024, 12, 30, 0, 0, 0, 0, time.UTC)},    // Back into last year
+		{time.UTC, EveryMonth, time.Date(2024, 2, 29, 23, 0, 0, 0, time.UTC), time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},    // Leap day
+		{time.UTC, EveryMonth, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},      // The first instant of the month
+		{berlin, EveryDay, time.Date(2024, 5, 15, 23, 30, 0, 0, time.UTC), time.Date(2024, 5, 16, 0, 0, 0, 0, berlin)},        // Already tomorrow in local time
+		{berlin, EveryDay, time.Date(2024, 3, 31, 12, 0, 0, 0, berlin), time.Date(2024, 3, 30, 23, 0, 0, 0, time.UTC)},        // Clocks go forward that night
+		{berlin, EveryWeek, time.Date(2024, 3, 31, 12, 0, 0, 0, berlin), time.Date(2024, 3, 24, 23, 0, 0, 0, time.UTC)},       // The week started in winter time
+		{berlin, EveryMonth, time.Date(2024, 11, 5, 12, 0, 0, 0, berlin), time.Date(2024, 10, 31, 23, 0, 0, 0, time.UTC)},     // The month started in summer time
+		{berlin, EveryMonth, time.Date(2024, 10, 31, 23, 30, 0, 0, time.UTC), time.Date(2024, 10, 31, 23, 0, 0, 0, time.UTC)}, // November in local time
+	}
+	for _, test := range tests {
+		time.Local = test.zone
+		got := startOfPeriod(test.every, test.now)
+		if !got.Equal(test.want) {
+			t.Errorf("startOfPeriod(%q, %s) in %s = %s, expected %s", test.every, test.now, test.zone, got, test.want.In(test.zone))
+		}
+	}
+}
+
+// writeVault fills a directory with files, and gives them all the same modification time
+func writeVault(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		if err == nil {
+			err = os.WriteFile(path, []byte(data), 0o644)
+		}
+		if err == nil {
+			err = os.Chtimes(path, modTime, modTime)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMakeManifest(t *testing.T) {
+	files := map[string]string{"notes.md": "notes", "sub/todo.md": "todo", "cache/index": "cache"}
+	tests := []struct {
+		name    string
+		change  map[string]string // Written over the vault, with the same modification time
+		metaSee bool              // Whether a skipUnchanged metadata manifest changes
+		hashSee bool
+	}{
+		{"nothing", nil, false, false},
+		{"excluded file", map[string]string{"cache/index": "other"}, false, false},
+		{"same size", map[string]string{"notes.md": "NOTES"}, false, true},
+		{"new size", map[string]string{"sub/todo.md": "todo, done"}, true, true},
+		{"new file", map[string]string{"sub/more.md": "more"}, true, true},
+	}
+	for _, test := range tests {
+		for _, skip := range []string{SkipMetadata, SkipHash} {
+			dir := t.TempDir()
+			writeVault(t, dir, files)
+			vault := Vault{Name: "notes", Path: dir, Settings: Settings{Format: FormatTarGz, SkipUnchanged: skip, Exclude: []string{"cache"}}}
+			before, err := makeManifest(vault)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeVault(t, dir, test.change)
+			after, err := makeManifest(vault)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := test.metaSee
+			if skip == SkipHash {
+				want = test.hashSee
+			}
+			if changed := string(before) != string(after); changed != want {
+				t.Errorf("%s with %s: the manifest changed is %v, expected %v", test.name, skip, changed, want)
+			}
+		}
+	}
+}
+
+func TestUnchangedSince(t *testing.T) {
+	const name = "2024-05-15T10-00-00Z.tar.gz"
+	manifest := []byte("go-archive-it manifest 1\n\"notes.md\"\t5\t0\t644\n")
+	newArchive := func(manifest []byte, modTime time.Time) localDestination {
+		files := map[string]string{"2024-05-01T10-00-00Z.tar.gz": "older", name: "archive"}
+		if manifest != nil {
+			files[name+manifestSuffix] = string(manifest)
+		}
+		dest := newLocalDestination(t, files)
+		older := modTime.Add(-14 * 24 * time.Hour)
+		err := os.Chtimes(filepath.Join(dest.dir, "2024-05-01T10-00-00Z.tar.gz"), older, older)
+		if err == nil {
+			err = os.Chtimes(filepath.Join(dest.dir, name), modTime, modTime)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dest
+	}
+	made := time.Date(2024, 5, 15, 10, 0, 0, 0, time.UTC) // A Wednesday
+	local := time.Local
+	t.Cleanup(func() { time.Local = local })
+	time.Local = time.UTC
+
+	tests := []struct {
+		name  string
+		dests []Destination
+		every string
+		now   time.Time
+		want  string
+	}{
+		{"unchanged", []Destination{newArchive(manifest, made), newArchive(manifest, made)}, "", made.Add(time.Hour), name},
+		{"changed in one", []Destination{newArchive(manifest, made), newArchive([]byte("different"), made)}, "", made.Add(time.Hour), ""},
+		{"no manifest", []Destination{newArchive(manifest, made), newArchive(nil, made)}, "", made.Add(time.Hour), ""},
+		{"no archives", []Destination{newArchive(manifest, made), newLocalDestination(t, nil)}, "", made.Add(time.Hour), ""},
+		{"not opened", []Destination{newArchive(manifest, made), nil}, "", made.Add(time.Hour), ""},
+		{"same day", []Destination{newArchive(manifest, made)}, EveryDay, made.Add(13 * time.Hour), name},
+		{"next day", []Destination{newArchive(manifest, made)}, EveryDay, made.Add(14 * time.Hour), ""},
+		{"same week", []Destination{newArchive(manifest, made)}, EveryWeek, made.Add(4 * 24 * time.Hour), name}, // Sunday
+		{"next week", []Destination{newArchive(manifest, made)}, EveryWeek, made.Add(5 * 24 * time.Hour), ""},
+		{"same month", []Destination{newArchive(manifest, made)}, EveryMonth, made.Add(16 * 24 * time.Hour), name},
+		{"next month", []Destination{newArchive(manifest, made)}, EveryMonth, made.Add(17 * 24 * time.Hour), ""},
+	}
+	for _, test := range tests {
+		vault := Vault{Name: "notes", Settings: Settings{SkipUnchanged: SkipMetadata, ArchiveEvery: test.every}}
+		if got := unchangedSince(vault, test.dests, manifest, test.now); got != test.want {
+			t.Errorf("%s: unchangedSince gave %q, expected %q", test.name, got, test.want)
+		}
+	}
+}
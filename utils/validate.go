@@ -0,0 +1,876 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigError is a problem with a config file, located by the line and column of the offending yaml node
+type ConfigError struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+// configErrorf creates a ConfigError pointing at node
+func configErrorf(node *yaml.Node, format string, args ...any) ConfigError {
+	return ConfigError{Line: node.Line, Column: node.Column, Message: fmt.Sprintf(format, args...)}
+}
+
+// The keys that are allowed at each level of the config file
+var (
+	topKeys      = keySet("version", "defaults", "vaults", "discover")
+	settingsKeys = keySet("destination", "destinations", "format", "naming", "retention", "exclude", "hooks", "cold", "erasure", "recovery", "maxVolumeSize", "fileRetries", "git", "skipUnchanged", "archiveEvery", "watch", "schedule")
+	vaultKeys    = keySet("name", "path", "command", "file", "destination", "destinations", "format", "naming", "retention", "exclude", "hooks", "cold", "erasure", "recovery", "maxVolumeSize", "fileRetries", "git", "skipUnchanged", "archiveEvery", "watch", "schedule")
+	hooksKeys    = keySet("pre", "post", "onSuccess", "onFailure", "timeout")
+	targetKeys   = keySet("destination", "retention")
+	coldKeys     = keySet("destination", "age", "retention")
+	erasureKeys  = keySet("data", "parity")
+	watchKeys    = keySet("quiet", "minInterval")
+	scheduleKeys = keySet("cron", "jitter")
+	discoverKeys = keySet("root", "markers", "depth", "destination", "destinations", "format", "naming", "retention", "exclude", "hooks", "cold", "erasure", "recovery", "maxVolumeSize", "fileRetries", "git", "skipUnchanged", "archiveEvery", "watch", "schedule")
+	v1Keys       = keySet("vaultpath", "archivepath", "archivetype", "retention")
+)
+
+// The shape that the value of each key must have, keys that are not listed here hold mappings
+var (
+	listKeys   = keySet("vaults", "discover", "destinations", "exclude", "pre", "post", "onSuccess", "onFailure", "vaultpath", "markers")
+	numberKeys = keySet("version", "retention", "archivetype", "depth", "age", "data", "parity", "recovery", "fileRetries")
+)
+
+func keySet(keys ...string) map[string]bool {
+	set := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		set[key] = true
+	}
+	return set
+}
+
+// vaultNodes remembers where each of a vault's settings came from, so that errors can point at them
+type vaultNodes struct {
+	vault     *yaml.Node
+	name      *yaml.Node
+	path      *yaml.Node
+	command   *yaml.Node
+	file      *yaml.Node
+	targets   []*yaml.Node // One for each of the vault's destinations, either a string or a mapping
+	format    *yaml.Node
+	naming    *yaml.Node
+	retention *yaml.Node
+	cold      *yaml.Node
+	erasure   *yaml.Node
+	recovery  *yaml.Node
+	volumes   *yaml.Node // maxVolumeSize
+	timeout   *yaml.Node // hooks.timeout
+	quiet     *yaml.Node // watch.quiet
+	interval  *yaml.Node // watch.minInterval
+	cron      *yaml.Node // schedule, or schedule.cron
+	jitter    *yaml.Node // schedule.jitter
+	retries   *yaml.Node // fileRetries
+	git       *yaml.Node
+	skip      *yaml.Node // skipUnchanged
+	every     *yaml.Node // archiveEvery
+}
+
+// destination returns the node for the destination of a vault's target
+func (n vaultNodes) destination(target int) *yaml.Node {
+	if target >= len(n.targets) {
+		return n.vault
+	}
+	node := n.targets[target]
+	if _, destination := mappingValue(node, "destination"); destination != nil {
+		return destination
+	}
+	return node
+}
+
+// coldValue returns the node for a setting of the vault's cold tier
+func (n vaultNodes) coldValue(key string) *yaml.Node {
+	_, node := mappingValue(n.cold, key)
+	return or(node, n.cold, n.vault)
+}
+
+// targetRetention returns the node a target's retention came from, either the target itself or the vault
+func (n vaultNodes) targetRetention(target int) *yaml.Node {
+	if target < len(n.targets) {
+		if _, retention := mappingValue(n.targets[target], "retention"); retention != nil {
+			return retention
+		}
+	}
+	return or(n.retention, n.vault)
+}
+
+/*
+ValidateConfig loads the config file at configPath and checks it for mistakes
+
+It returns the loaded config (with defaults applied and paths expanded) and every problem that was found.
+The config should not be used if any errors are returned.
+
+The following are reported as errors:
+  - Unknown keys, and values of the wrong type
+  - Unsupported versions and formats, and retention values below 1
+  - Vault paths that do not exist or are not directories
+  - Destinations that are not writable, and destinations that are listed twice for the same vault
+  - Vaults that are nested inside each other, or that would share an archive directory
+*/
+func ValidateConfig(configPath string) (Config, []error) {
+	file, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return Config{}, []error{err}
+	}
+	return validateConfig(file, configPath)
+}
+
+// validateConfig checks a config file that is about to be written to configPath, or was read from it, see ValidateConfig
+func validateConfig(file []byte, configPath string) (Config, []error) {
+	var doc yaml.Node
+	err := yaml.Unmarshal(file, &doc)
+	if err != nil {
+		return Config{}, []error{err}
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return Config{}, []error{ConfigError{Line: 1, Column: 1, Message: "config file is empty"}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return Config{}, []error{configErrorf(root, "expected a mapping at the top level of the config")}
+	}
+
+	var errs []error
+	var config Config
+	var nodes []vaultNodes
+
+	_, versionNode := mappingValue(root, "version")
+	version := 0
+	if versionNode != nil {
+		err = versionNode.Decode(&version)
+		if err != nil {
+			return Config{}, []error{configErrorf(versionNode, "version must be a number")}
+		}
+	}
+
+	switch version {
+	case 0, 1:
+		errs = append(errs, checkKeys(root, v1Keys, "")...)
+		if _, retention := mappingValue(root, "retention"); retention != nil {
+			var value int
+			if retention.Decode(&value) == nil && (value < 0 || value > 255) {
+				errs = append(errs, configErrorf(retention, "retention must be less than 256 before config version %d, run `go-archive-it config migrate` to lift the limit", ConfigVersion))
+			}
+		}
+		if len(errs) > 0 {
+			return Config{}, sortErrors(errs)
+		}
+		var old configV1
+		err = root.Decode(&old)
+		if err != nil {
+			return Config{}, append(errs, decodeErrors(err)...)
+		}
+		config = old.upgrade()
+		nodes = v1Nodes(root)
+		if _, typeNode := mappingValue(root, "archivetype"); typeNode != nil && old.ArchiveType > 1 {
+			errs = append(errs, configErrorf(typeNode, "archivetype must be 0 (tar) or 1 (tar.gz), got %d", old.ArchiveType))
+		}
+	case ConfigVersion:
+		errs = append(errs, checkConfigKeys(root)...)
+		if len(errs) > 0 {
+			return Config{}, sortErrors(errs) // Decoding would only report the same problems again without columns
+		}
+		err = root.Decode(&config)
+		if err != nil {
+			return Config{}, append(errs, decodeErrors(err)...)
+		}
+		for _, rule := range config.Discover {
+			config.Vaults = append(config.Vaults, rule.vault())
+		}
+		nodes = v2Nodes(root)
+	default:
+		return Config{}, []error{configErrorf(versionNode, "unsupported config version %d", version)}
+	}
+
+	config.applyDefaults()
+	expandErrs := config.expandPaths(filepath.Dir(configPath))
+	for i, err := range expandErrs {
+		node := nodes[i].path
+		switch err.key {
+		case "destination":
+			node = nodes[i].destination(err.target)
+		case "cold":
+			node = nodes[i].coldValue("destination")
+		}
+		errs = append(errs, configErrorf(or(node, nodes[i].vault), "%s", err))
+	}
+	if len(expandErrs) == 0 {
+		var findErrs []error
+		config.Vaults, nodes, findErrs = findVaults(config.Vaults, nodes)
+		errs = append(errs, findErrs...)
+	}
+	config.assignNames()
+	errs = append(errs, checkVaults(config, nodes, root, expandErrs)...)
+
+	return config, sortErrors(errs)
+}
+
+// sortErrors puts errors in the order of the lines they point at, and drops repeated ones
+func sortErrors(errs []error) []error {
+	sort.SliceStable(errs, func(i, j int) bool {
+		a, aok := errs[i].(ConfigError)
+		b, bok := errs[j].(ConfigError)
+		if !aok || !bok {
+			return aok
+		}
+		return a.Line < b.Line || (a.Line == b.Line && a.Column < b.Column)
+	})
+	return dedupeErrors(errs)
+}
+
+// dedupeErrors drops repeated errors, which happen when a bad value in the defaults is applied to several vaults
+func dedupeErrors(errs []error) []error {
+	seen := make(map[string]bool, len(errs))
+	unique := errs[:0]
+	for _, err := range errs {
+		if !seen[err.Error()] {
+			seen[err.Error()] = true
+			unique = append(unique, err)
+		}
+	}
+	return unique
+}
+
+// mappingValue finds key in a mapping node and returns its key and value nodes, or nil if it is not there
+func mappingValue(node *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i], node.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+// checkKeys reports every key in a mapping node that is not in allowed
+func checkKeys(node *yaml.Node, allowed map[string]bool, where string) []error {
+	var errs []error
+	if node.Kind != yaml.MappingNode {
+		return []error{configErrorf(node, "expected a mapping%s", where)}
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		value := node.Content[i+1]
+		if !allowed[key.Value] {
+			errs = append(errs, configErrorf(key, "unknown key %q%s%s", key.Value, where, suggestKey(key.Value, allowed)))
+			continue
+		}
+		if err := checkShape(key.Value, value); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// checkShape reports a value that does not have the shape its key expects
+func checkShape(key string, value *yaml.Node) error {
+	switch {
+	case listKeys[key]:
+		if value.Kind != yaml.SequenceNode {
+			return configErrorf(value, "%s must be a list", key)
+		}
+		for _, item := range value.Content {
+			if key == "destinations" && item.Kind != yaml.ScalarNode && item.Kind != yaml.MappingNode {
+				return configErrorf(item, "destinations must be a list of destinations, or of mappings with a destination and retention")
+			}
+			if key != "vaults" && key != "discover" && key != "destinations" && item.Kind != yaml.ScalarNode {
+				return configErrorf(item, "%s must be a list of strings", key)
+			}
+		}
+	case numberKeys[key]:
+		if value.Kind != yaml.ScalarNode || value.ShortTag() != "!!int" {
+			return configErrorf(value, "%s must be a whole number", key)
+		}
+	case key == "schedule":
+		if value.Kind != yaml.ScalarNode && value.Kind != yaml.MappingNode {
+			return configErrorf(value, "schedule must be a cron expression, or a mapping with cron and jitter")
+		}
+	case key == "defaults" || key == "hooks" || key == "cold" || key == "erasure" || key == "watch":
+		if value.Kind != yaml.MappingNode {
+			return configErrorf(value, "%s must be a mapping", key)
+		}
+	default:
+		if value.Kind != yaml.ScalarNode {
+			return configErrorf(value, "%s must be a string", key)
+		}
+	}
+	return nil
+}
+
+// suggestKey points out the allowed key that is closest to a misspelled one
+func suggestKey(key string, allowed map[string]bool) string {
+	best, bestDistance := "", 3 // Anything further away than this is probably not a typo
+	for candidate := range allowed {
+		if distance := editDistance(strings.ToLower(key), strings.ToLower(candidate)); distance < bestDistance {
+			best, bestDistance = candidate, distance
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %q?", best)
+}
+
+// editDistance is the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt(values ...int) int {
+	smallest := values[0]
+	for _, value := range values[1:] {
+		if value < smallest {
+			smallest = value
+		}
+	}
+	return smallest
+}
+
+// checkConfigKeys walks a version 2 config and reports unknown keys at every level
+func checkConfigKeys(root *yaml.Node) []error {
+	errs := checkKeys(root, topKeys, "")
+	if _, defaults := mappingValue(root, "defaults"); defaults != nil && defaults.Kind == yaml.MappingNode {
+		errs = append(errs, checkSettingsKeys(defaults, settingsKeys, " in defaults")...)
+	}
+	if _, vaults := mappingValue(root, "vaults"); vaults != nil && vaults.Kind == yaml.SequenceNode {
+		for _, vault := range vaults.Content {
+			errs = append(errs, checkSettingsKeys(vault, vaultKeys, " in vault")...)
+		}
+	}
+	if _, rules := mappingValue(root, "discover"); rules != nil && rules.Kind == yaml.SequenceNode {
+		for _, rule := range rules.Content {
+			errs = append(errs, checkSettingsKeys(rule, discoverKeys, " in discovery rule")...)
+		}
+	}
+	return errs
+}
+
+// checkSettingsKeys checks a defaults or vault mapping, along with the hooks and targets nested in it
+func checkSettingsKeys(node *yaml.Node, allowed map[string]bool, where string) []error {
+	errs := checkKeys(node, allowed, where)
+	if _, hooks := mappingValue(node, "hooks"); hooks != nil && hooks.Kind == yaml.MappingNode {
+		errs = append(errs, checkKeys(hooks, hooksKeys, " in hooks")...)
+	}
+	_, destination := mappingValue(node, "destination")
+	key, targets := mappingValue(node, "destinations")
+	if destination != nil && targets != nil {
+		errs = append(errs, configErrorf(key, "use either destination or destinations%s, not both", where))
+	}
+	for _, target := range sequenceContent(targets) {
+		if target.Kind == yaml.MappingNode {
+			errs = append(errs, checkKeys(target, targetKeys, " in destinations")...)
+		}
+	}
+	if _, cold := mappingValue(node, "cold"); cold != nil && cold.Kind == yaml.MappingNode {
+		errs = append(errs, checkKeys(cold, coldKeys, " in cold")...)
+	}
+	if _, erasure := mappingValue(node, "erasure"); erasure != nil && erasure.Kind == yaml.MappingNode {
+		errs = append(errs, checkKeys(erasure, erasureKeys, " in erasure")...)
+	}
+	if _, watch := mappingValue(node, "watch"); watch != nil && watch.Kind == yaml.MappingNode {
+		errs = append(errs, checkKeys(watch, watchKeys, " in watch")...)
+	}
+	if _, schedule := mappingValue(node, "schedule"); schedule != nil && schedule.Kind == yaml.MappingNode {
+		errs = append(errs, checkKeys(schedule, scheduleKeys, " in schedule")...)
+	}
+	return errs
+}
+
+// decodeErrors splits a yaml.TypeError into one error per problem
+func decodeErrors(err error) []error {
+	typeErr, ok := err.(*yaml.TypeError)
+	if !ok {
+		return []error{err}
+	}
+	errs := make([]error, 0, len(typeErr.Errors))
+	for _, message := range typeErr.Errors {
+		errs = append(errs, fmt.Errorf("%s", message))
+	}
+	return errs
+}
+
+// v2Nodes finds the nodes for each vault's settings in a version 2 config
+func v2Nodes(root *yaml.Node) []vaultNodes {
+	_, defaults := mappingValue(root, "defaults")
+	_, vaults := mappingValue(root, "vaults")
+	_, rules := mappingValue(root, "discover")
+
+	var nodes []vaultNodes
+	for _, vault := range sequenceContent(vaults) {
+		n := vaultNodes{vault: vault}
+		_, n.name = mappingValue(vault, "name")
+		_, n.path = mappingValue(vault, "path")
+		_, n.command = mappingValue(vault, "command")
+		_, n.file = mappingValue(vault, "file")
+		n.targets = targetNodes(vault, defaults)
+		n.format = settingNode(vault, defaults, "format")
+		n.naming = settingNode(vault, defaults, "naming")
+		n.retention = settingNode(vault, defaults, "retention")
+		n.cold = settingNode(vault, defaults, "cold")
+		n.erasure = settingNode(vault, defaults, "erasure")
+		n.recovery = settingNode(vault, defaults, "recovery")
+		n.volumes = settingNode(vault, defaults, "maxVolumeSize")
+		n.timeout = nestedSettingNode(vault, defaults, "hooks", "timeout")
+		n.quiet = nestedSettingNode(vault, defaults, "watch", "quiet")
+		n.interval = nestedSettingNode(vault, defaults, "watch", "minInterval")
+		n.cron = cronNode(vault, defaults)
+		n.jitter = nestedSettingNode(vault, defaults, "schedule", "jitter")
+		n.retries = settingNode(vault, defaults, "fileRetries")
+		n.git = settingNode(vault, defaults, "git")
+		n.skip = settingNode(vault, defaults, "skipUnchanged")
+		n.every = settingNode(vault, defaults, "archiveEvery")
+		nodes = append(nodes, n)
+	}
+	for _, rule := range sequenceContent(rules) { // Discovery rules are added to the vaults after the listed ones
+		n := vaultNodes{vault: rule}
+		_, n.path = mappingValue(rule, "root")
+		n.targets = targetNodes(rule, defaults)
+		n.format = settingNode(rule, defaults, "format")
+		n.naming = settingNode(rule, defaults, "naming")
+		n.retention = settingNode(rule, defaults, "retention")
+		n.cold = settingNode(rule, defaults, "cold")
+		n.erasure = settingNode(rule, defaults, "erasure")
+		n.recovery = settingNode(rule, defaults, "recovery")
+		n.volumes = settingNode(rule, defaults, "maxVolumeSize")
+		n.timeout = nestedSettingNode(rule, defaults, "hooks", "timeout")
+		n.quiet = nestedSettingNode(rule, defaults, "watch", "quiet")
+		n.interval = nestedSettingNode(rule, defaults, "watch", "minInterval")
+		n.cron = cronNode(rule, defaults)
+		n.jitter = nestedSettingNode(rule, defaults, "schedule", "jitter")
+		n.retries = settingNode(rule, defaults, "fileRetries")
+		n.git = settingNode(rule, defaults, "git")
+		n.skip = settingNode(rule, defaults, "skipUnchanged")
+		n.every = settingNode(rule, defaults, "archiveEvery")
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+// sequenceContent returns the items of a sequence node, or nothing if node is not a sequence
+func sequenceContent(node *yaml.Node) []*yaml.Node {
+	if node == nil || node.Kind != yaml.SequenceNode {
+		return nil
+	}
+	return node.Content
+}
+
+// settingNode returns the node a vault setting came from, either the vault itself or the defaults
+func settingNode(vault *yaml.Node, defaults *yaml.Node, key string) *yaml.Node {
+	if _, node := mappingValue(vault, key); node != nil {
+		return node
+	}
+	if _, node := mappingValue(defaults, key); node != nil {
+		return node
+	}
+	return nil
+}
+
+// nestedSettingNode returns the node of a setting in one of a vault's mappings (like hooks.timeout), which may come from the defaults
+func nestedSettingNode(vault *yaml.Node, defaults *yaml.Node, key string, setting string) *yaml.Node {
+	for _, node := range []*yaml.Node{vault, defaults} {
+		_, mapping := mappingValue(node, key)
+		if _, value := mappingValue(mapping, setting); value != nil {
+			return value
+		}
+	}
+	return nil
+}
+
+// cronNode returns the node of a vault's cron expression, which is either its schedule or the cron in it
+func cronNode(vault *yaml.Node, defaults *yaml.Node) *yaml.Node {
+	for _, node := range []*yaml.Node{vault, defaults} {
+		_, schedule := mappingValue(node, "schedule")
+		if schedule != nil && schedule.Kind == yaml.ScalarNode {
+			return schedule
+		}
+		if _, cron := mappingValue(schedule, "cron"); cron != nil {
+			return cron
+		}
+	}
+	return nil
+}
+
+// targetNodes returns the nodes of a vault's targets, in the same order as applyDefaults puts them in Destinations
+func targetNodes(vault *yaml.Node, defaults *yaml.Node) []*yaml.Node {
+	for _, node := range []*yaml.Node{vault, defaults} {
+		_, destination := mappingValue(node, "destination")
+		_, targets := mappingValue(node, "destinations")
+		if destination == nil && targets == nil {
+			continue
+		}
+		nodes := append([]*yaml.Node{}, sequenceContent(targets)...)
+		if destination != nil {
+			nodes = append(nodes, destination)
+		}
+		return nodes
+	}
+	return nil
+}
+
+// v1Nodes finds the nodes for each vault's settings in a version 1 config
+func v1Nodes(root *yaml.Node) []vaultNodes {
+	_, paths := mappingValue(root, "vaultpath")
+	_, archivePath := mappingValue(root, "archivepath")
+	_, retention := mappingValue(root, "retention")
+	if paths == nil {
+		return nil
+	}
+
+	nodes := make([]vaultNodes, 0, len(paths.Content))
+	for _, path := range paths.Content {
+		n := vaultNodes{vault: path, path: path, retention: retention}
+		if archivePath != nil {
+			n.targets = []*yaml.Node{archivePath}
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+// or returns the first node that is not nil
+func or(nodes ...*yaml.Node) *yaml.Node {
+	for _, node := range nodes {
+		if node != nil {
+			return node
+		}
+	}
+	return nil
+}
+
+// checkVaults checks the values of every vault once the defaults have been applied
+func checkVaults(config Config, nodes []vaultNodes, root *yaml.Node, skip map[int]expandError) []error {
+	var errs []error
+	if len(config.Vaults) == 0 && len(config.Discover) == 0 {
+		errs = append(errs, configErrorf(root, "no vaults are configured"))
+	}
+
+	checkedDestinations := make(map[string]bool)
+	for i, vault := range config.Vaults {
+		n := nodes[i]
+		if _, ok := skip[i]; ok {
+			continue // The paths could not be expanded, so checking them would only add confusing errors
+		}
+
+		switch vault.Format {
+		case FormatTar, FormatTarGz, FormatTarZst:
+		default:
+			errs = append(errs, configErrorf(or(n.format, n.vault), "unknown format %q, expected one of %s, %s or %s", vault.Format, FormatTar, FormatTarGz, FormatTarZst))
+		}
+
+		if err := CheckNaming(vault.Naming); err != nil {
+			errs = append(errs, configErrorf(or(n.naming, n.vault), "%s", err))
+		}
+
+		switch {
+		case vault.Command != "":
+			if vault.Path != "" {
+				errs = append(errs, configErrorf(or(n.command, n.vault), "vault has both a path and a command, its archive can only hold one of them"))
+			}
+			if n.name == nil {
+				errs = append(errs, configErrorf(or(n.command, n.vault), "a vault with a command needs a name"))
+			}
+			if vault.File != "" && !filepath.IsLocal(filepath.FromSlash(vault.File)) {
+				errs = append(errs, configErrorf(or(n.file, n.vault), "file must be a relative path inside the archive, got %q", vault.File))
+			}
+		case vault.File != "":
+			errs = append(errs, configErrorf(or(n.file, n.vault), "file is the name of a command's output, it needs a command"))
+		case vault.Path == "":
+			errs = append(errs, configErrorf(n.vault, "vault has no path or command"))
+		default:
+			if info, err := os.Stat(vault.Path); err != nil {
+				errs = append(errs, configErrorf(or(n.path, n.vault), "vault path %s does not exist", vault.Path))
+			} else if !info.IsDir() {
+				errs = append(errs, configErrorf(or(n.path, n.vault), "vault path %s is not a directory", vault.Path))
+			} else if vault.Git != "" {
+				if err := checkGitRepository(vault.Path); err != nil {
+					errs = append(errs, configErrorf(or(n.git, n.vault), "git is set, but vault path %s can't be archived with git: %s", vault.Path, err))
+				}
+			}
+		}
+
+		switch vault.Git {
+		case "", GitFiles, GitBundle:
+			if vault.Git != "" && vault.Command != "" {
+				errs = append(errs, configErrorf(or(n.git, n.vault), "git can't be used with a command, it is for vaults that are git repositories"))
+			}
+		default:
+			errs = append(errs, configErrorf(or(n.git, n.vault), "unknown git mode %q, expected %s or %s", vault.Git, GitFiles, GitBundle))
+		}
+
+		switch vault.SkipUnchanged {
+		case "", SkipMetadata, SkipHash:
+		default:
+			errs = append(errs, configErrorf(or(n.skip, n.vault), "unknown skipUnchanged mode %q, expected %s or %s", vault.SkipUnchanged, SkipMetadata, SkipHash))
+		}
+		switch vault.ArchiveEvery {
+		case "":
+		case EveryDay, EveryWeek, EveryMonth:
+			if vault.SkipUnchanged == "" {
+				errs = append(errs, configErrorf(or(n.every, n.vault), "archiveEvery only matters with skipUnchanged, every run archives the vault without it"))
+			}
+		default:
+			errs = append(errs, configErrorf(or(n.every, n.vault), "unknown archiveEvery period %q, expected %s, %s or %s", vault.ArchiveEvery, EveryDay, EveryWeek, EveryMonth))
+		}
+
+		if len(vault.Destinations) == 0 {
+			errs = append(errs, configErrorf(n.vault, "vault has no destination"))
+		}
+		for t, target := range vault.Destinations {
+			node := n.destination(t)
+			if target.Retention < 1 {
+				errs = append(errs, configErrorf(n.targetRetention(t), "retention must be at least 1, got %d", target.Retention))
+			}
+
+			if target.Destination == "" {
+				errs = append(errs, configErrorf(node, "vault has no destination"))
+			} else if isURL(target.Destination) {
+				_, err := OpenDestination(target.Destination, vault.Name) // Only checks the URL, nothing is sent over the network
+				if err != nil {
+					errs = append(errs, configErrorf(node, "%s", err))
+				}
+			} else if !checkedDestinations[target.Destination] {
+				checkedDestinations[target.Destination] = true
+				err := checkWritable(target.Destination)
+				if err != nil {
+					errs = append(errs, configErrorf(node, "destination %s is not writable: %s", target.Destination, err))
+				}
+			}
+
+			for _, other := range vault.Destinations[:t] {
+				if target.Destination == other.Destination {
+					errs = append(errs, configErrorf(node, "destination %s is listed more than once", redactDestination(target.Destination)))
+				}
+			}
+		}
+
+		if cold := vault.Cold; cold.Destination != "" || cold.Age != 0 || cold.Retention != 0 {
+			errs = append(errs, checkCold(vault, n, checkedDestinations)...)
+		}
+
+		if erasure := vault.Erasure; erasure.Enabled() {
+			node := or(n.erasure, n.vault)
+			shards := erasure.Data + erasure.Parity
+			perDestination := (shards + len(vault.Destinations) - 1) / maxInt(len(vault.Destinations), 1)
+			switch {
+			case erasure.Data < 1 || erasure.Parity < 1:
+				errs = append(errs, configErrorf(node, "erasure needs at least 1 data and 1 parity shard, got %d and %d", erasure.Data, erasure.Parity))
+			case shards > 255:
+				errs = append(errs, configErrorf(node, "erasure can have at most 255 shards, got %d", shards))
+			case len(vault.Destinations) < 2:
+				errs = append(errs, configErrorf(node, "erasure needs at least 2 destinations to spread the shards over"))
+			case perDestination > erasure.Parity:
+				errs = append(errs, configErrorf(node, "losing one of the %d destinations would lose %d shards, more than the %d parity shards, add destinations or parity", len(vault.Destinations), perDestination, erasure.Parity))
+			case vault.Cold.Destination != "":
+				errs = append(errs, configErrorf(node, "erasure can't be used with cold, the shards would all end up in the cold destination"))
+			}
+			for t, target := range vault.Destinations {
+				if target.Retention != vault.Destinations[0].Retention {
+					errs = append(errs, configErrorf(n.targetRetention(t), "erasure needs the same retention in every destination, or archives lose shards, got %d and %d", vault.Destinations[0].Retention, target.Retention))
+					break
+				}
+			}
+		}
+
+		if vault.Recovery != 0 {
+			node := or(n.recovery, n.vault)
+			if vault.Recovery < 1 || vault.Recovery > 100 {
+				errs = append(errs, configErrorf(node, "recovery is a percentage of the archive's size, from 1 to 100, got %d", vault.Recovery))
+			} else if vault.Erasure.Enabled() {
+				errs = append(errs, configErrorf(node, "recovery can't be used with erasure, the shards already have parity"))
+			}
+		}
+
+		if vault.Hooks.Timeout != "" {
+			timeout, err := time.ParseDuration(vault.Hooks.Timeout)
+			if err != nil || timeout <= 0 {
+				errs = append(errs, configErrorf(or(n.timeout, n.vault), "hooks timeout must be a duration like 30s or 5m, got %q", vault.Hooks.Timeout))
+			}
+		}
+
+		if vault.Watch.Quiet != "" {
+			quiet, err := time.ParseDuration(vault.Watch.Quiet)
+			if err != nil || quiet <= 0 {
+				errs = append(errs, configErrorf(or(n.quiet, n.vault), "watch quiet must be a duration like 30s or 5m, got %q", vault.Watch.Quiet))
+			}
+		}
+		if vault.Watch.MinInterval != "" {
+			interval, err := time.ParseDuration(vault.Watch.MinInterval)
+			if err != nil || interval < 0 {
+				errs = append(errs, configErrorf(or(n.interval, n.vault), "watch minInterval must be a duration like 30m or 1h, got %q", vault.Watch.MinInterval))
+			}
+		}
+
+		if vault.Schedule.Cron != "" {
+			schedule, err := parseCron(vault.Schedule.Cron)
+			if err != nil {
+				errs = append(errs, configErrorf(or(n.cron, n.vault), "schedule %q: %s", vault.Schedule.Cron, err))
+			} else if schedule.next(time.Now()).IsZero() {
+				errs = append(errs, configErrorf(or(n.cron, n.vault), "schedule %q never runs", vault.Schedule.Cron))
+			}
+		}
+		if vault.Schedule.Jitter != "" {
+			jitter, err := time.ParseDuration(vault.Schedule.Jitter)
+			if err != nil || jitter < 0 {
+				errs = append(errs, configErrorf(or(n.jitter, n.vault), "schedule jitter must be a duration like 10m or 1h, got %q", vault.Schedule.Jitter))
+			}
+		}
+
+		if n.retries != nil {
+			var retries int // From the node, FileRetries can't tell 0 from fileRetries not being set
+			if n.retries.Decode(&retries) == nil && (retries < 1 || retries > 100) {
+				errs = append(errs, configErrorf(n.retries, "fileRetries must be from 1 to 100, got %d", retries))
+			}
+		}
+
+		if vault.MaxVolumeSize != "" {
+			node := or(n.volumes, n.vault)
+			size, err := parseSize(vault.MaxVolumeSize)
+			switch {
+			case err != nil:
+				errs = append(errs, configErrorf(node, "maxVolumeSize %s", err))
+			case size < minVolumeSize:
+				errs = append(errs, configErrorf(node, "maxVolumeSize must be at least 1MiB, got %s", vault.MaxVolumeSize))
+			case vault.Erasure.Enabled():
+				errs = append(errs, configErrorf(node, "maxVolumeSize can't be used with erasure, the shards are already split over destinations"))
+			}
+		}
+
+		for j, other := range config.Vaults[:i] {
+			m := nodes[j]
+			if strings.EqualFold(vault.Name, other.Name) && shareDestination(vault, other) { // Case insensitive, for drives formatted as exFAT or APFS
+				errs = append(errs, configErrorf(or(n.name, n.path, n.vault), "vault %s (%q) shares its archive directory with %s on line %d, give one of them a different name", vault.Path, vault.Name, other.Path, m.vault.Line))
+			}
+			if vault.Path == "" || other.Path == "" {
+				continue
+			}
+			if isWithin(vault.Path, other.Path) || isWithin(other.Path, vault.Path) {
+				errs = append(errs, configErrorf(or(n.path, n.vault), "vault path %s overlaps with %s on line %d", vault.Path, other.Path, m.vault.Line))
+			}
+		}
+	}
+	return errs
+}
+
+// checkCold checks a vault's cold tier
+func checkCold(vault Vault, n vaultNodes, checkedDestinations map[string]bool) []error {
+	var errs []error
+	cold := vault.Cold
+	if cold.Age < 0 {
+		errs = append(errs, configErrorf(n.coldValue("age"), "age must be a number of days, got %d", cold.Age))
+	}
+	if cold.Retention < 0 {
+		errs = append(errs, configErrorf(n.coldValue("retention"), "retention must be at least 1, got %d", cold.Retention))
+	}
+
+	node := n.coldValue("destination")
+	switch {
+	case cold.Destination == "":
+		errs = append(errs, configErrorf(node, "cold has no destination"))
+	case isURL(cold.Destination):
+		_, err := OpenDestination(cold.Destination, vault.Name)
+		if err != nil {
+			errs = append(errs, configErrorf(node, "%s", err))
+		}
+	case !checkedDestinations[cold.Destination]:
+		checkedDestinations[cold.Destination] = true
+		err := checkWritable(cold.Destination)
+		if err != nil {
+			errs = append(errs, configErrorf(node, "destination %s is not writable: %s", cold.Destination, err))
+		}
+	}
+	for _, target := range vault.Destinations {
+		if target.Destination == cold.Destination {
+			errs = append(errs, configErrorf(node, "cold destination %s is also one of the vault's destinations", redactDestination(cold.Destination)))
+		}
+	}
+	return errs
+}
+
+// shareDestination reports whether two vaults have a destination in common
+func shareDestination(a Vault, b Vault) bool {
+	for _, x := range a.AllDestinations() {
+		for _, y := range b.AllDestinations() {
+			if x.Destination == y.Destination {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isWithin reports whether path is dir or inside of it
+func isWithin(path string, dir string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// checkWritable checks that files can be created in dir, or in the closest parent that exists if dir does not exist yet
+func checkWritable(dir string) error {
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", dir)
+			}
+			file, err := os.CreateTemp(dir, ".go-archive-it-*")
+			if err != nil {
+				return err
+			}
+			file.Close()
+			return os.Remove(file.Name())
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return err
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// cutSidecarSuffix returns the name of the archive that a file belongs with, if it is one of an archive's sidecars
+func cutSidecarSuffix(name string) (string, bool) {
+	for _, suffix := range []string{recoverySuffix, manifestSuffix} {
+		if archive, ok := strings.CutSuffix(name, suffix); ok {
+			return archive, true
+		}
+	}
+	return "", false
+}
+
+/*
+ListArchives returns the vault's archives in a destination, oldest first
+
+Only files that are named like archives (by the vault's naming template, or the RFC3339 names that older versions used)
+are returned, anything else that is stored alongside them is left out.
+
+An archive that is stored as several files is returned once, named after the archive, with the files in Parts.
+Its size is that of all of the parts, and its modification time that of the newest one. Files that belong with an
+archive (its recovery data and manifest) are in Sidecars, and aren't counted in its size.
+*/
+func ListArchives(vault Vault, dest Destination) ([]ArchiveInfo, error) {
+	pattern, err := archivePattern(vault)
+	if err != nil {
+		return nil, err
+	}
+	files, err := dest.List()
+	if err != nil {
+		return nil, err
+	}
+
+	archives := make([]ArchiveInfo, 0, len(files))
+	parted := make(map[string]int) // Index in archives
+	sidecars := make(map[string][]ArchiveInfo)
+	for _, file := range files {
+		if isArchive(file.Name, pattern) {
+			archives = append(archives, file)
+			continue
+		}
+		if name, ok := cutSidecarSuffix(file.Name); ok && isArchive(name, pattern) {
+			sidecars[name] = append(sidecars[name], file)
+			continue
+		}
+		name, _, ok := archivePart(file.Name)
+		if !ok || !isArchive(name, pattern) {
+			continue
+		}
+		i, ok := parted[name]
+		if !ok {
+			i = len(archives)
+			parted[name] = i
+			archives = append(archives, ArchiveInfo{Name: name})
+		}
+		archive := &archives[i]
+		archive.Parts = append(archive.Parts, file)
+		archive.Size += file.Size
+		if file.ModTime.After(archive.ModTime) {
+			archive.ModTime = file.ModTime
+		}
+	}
+	for i, archive := range archives {
+		archives[i].Sidecars = sidecars[archive.Name]
+		sort.Slice(archive.Parts, func(i, j int) bool {
+			_, a, _ := archivePart(archive.Parts[i].Name)
+			_, b, _ := archivePart(archive.Parts[j].Name)
+			return a < b
+		})
+	}
+	sort.Slice(archives, func(i, j int) bool {
+		if archives[i].ModTime.Equal(archives[j].ModTime) {
+			return archives[i].Name < archives[j].Name
+		}
+		return archives[i].ModTime.Before(archives[j].ModTime)
+	})
+	return archives, nil
+}
+
+/*
+VerifyArchive reads an archive back from a destination and checks that it is intact
+
+Every file in the archive is read (all of its volumes, for a volume set), so damaged compression or a truncated upload
+is found. The number of bytes read is compared with the size the destination reported. VerifyArchive returns the number of files in the archive.
+
+When the archive has recovery data, every block of the archive is checked against it as well. Damaged blocks are
+returned as a *DamagedError, and damaged recovery data (of an archive that is otherwise intact) as ErrRecoveryDamaged.
+*/
+func VerifyArchive(dest Destination, archive ArchiveInfo) (int, error) {
+	var checker *blockChecker
+	var recoveryErr error
+	if archive.HasRecovery() {
+		index, err := loadRecovery(dest, archive, nil)
+		switch {
+		case err != nil:
+			recoveryErr = fmt.Errorf("%w (%s), run repair to make it again", ErrRecoveryDamaged, err)
+		case index.damagedParity() > 0:
+			recoveryErr = fmt.Errorf("%w (%d parity blocks), run repair to make it again", ErrRecoveryDamaged, index.damagedParity())
+			checker = newBlockChecker(index)
+		default:
+			checker = newBlockChecker(index)
+		}
+	}
+
+	reader, err := openArchive(dest, archive)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	counter := &countingReader{r: reader}
+	var r io.Reader = counter
+	if checker != nil {
+		r = io.TeeReader(counter, checker)
+	}
+	files, err := readArchive(r, archive.Name)
+	if err == nil {
+		_, err = io.Copy(io.Discard, r) // Padding after the end of the tar stream
+	} else if checker != nil {
+		io.Copy(io.Discard, r) // Every block is checked, so the damage is known past the point where reading failed
+	}
+	if checker != nil {
+		if damage := checker.finish(err); damage != nil {
+			return files, damage
+		}
+	}
+	if err != nil {
+		return files, err
+	}
+	if archive.Size > 0 && counter.n != archive.Size {
+		return files, fmt.Errorf("read %d bytes, but %s reports %d", counter.n, dest, archive.Size)
+	}
+	return files, recoveryErr
+}
+
+// archivePart splits the file name of one part of an archive (a shard or a volume) into the archive's name and the part's index
+func archivePart(name string) (string, int, bool) {
+	if archive, index, _, ok := splitShard(name); ok {
+		return archive, index, true
+	}
+	return splitVolume(name)
+}
+
+// decompress returns the tar stream of an archive, decompressed based on its extension, done releases the decompressor
+func decompress(r io.Reader, name string) (tarStream io.Reader, done func(), err error) {
+	switch {
+	case strings.HasSuffix(name, "."+FormatTarGz):
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gr, func() { gr.Close() }, nil
+	case strings.HasSuffix(name, "."+FormatTarZst):
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, zr.Close, nil
+	case strings.HasSuffix(name, "."+FormatTar):
+		return r, func() {}, nil
+	default:
+		return nil, nil, fmt.Errorf("%s is not an archive", name)
+	}
+}
+
+// readArchive decompresses an archive (based on its extension) and reads every file in it
+func readArchive(r io.Reader, name string) (int, error) {
+	r, done, err := decompress(r, name)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	files := 0
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			_, err = io.Copy(io.Discard, r) // Reading to the end makes the decompressor check its checksum
+			return files, err
+		}
+		if err != nil {
+			return files, err
+		}
+		_, err = io.Copy(io.Discard, tr)
+		if err != nil {
+			return files, fmt.Errorf("%s: %w", header.Name, err)
+		}
+		files++
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
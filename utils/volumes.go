@@ -0,0 +1,298 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+Volumes
+
+With maxVolumeSize set, an archive is written as numbered volumes (NAME.part001, NAME.part002, ...) of at most that
+size, to fit file size limits like FAT32's. Put together in order, the volumes are the archive. ListArchives returns
+a volume set as a single archive with the volumes in Parts, so retention, sync and cold storage keep or move all of
+the volumes of a set together.
+*/
+
+const minVolumeSize = 1 << 20
+
+var volumeSuffix = regexp.MustCompile(`\.part(\d{3,})$`)
+
+// volumeName returns the file name of one of an archive's volumes, index counts from 0
+func volumeName(archive string, index int) string {
+	return fmt.Sprintf("%s.part%03d", archive, index+1)
+}
+
+// splitVolume splits a volume's file name into the archive's name and the volume's index (from 0)
+func splitVolume(name string) (string, int, bool) {
+	match := volumeSuffix.FindStringSubmatchIndex(name)
+	if match == nil {
+		return "", 0, false
+	}
+	index, err := strconv.Atoi(name[match[2]:match[3]])
+	if err != nil || index < 1 {
+		return "", 0, false
+	}
+	return name[:match[0]], index - 1, true
+}
+
+// isVolumeSet reports whether an archive is stored as volumes
+func isVolumeSet(archive ArchiveInfo) bool {
+	if len(archive.Parts) == 0 {
+		return false
+	}
+	_, _, ok := splitVolume(archive.Parts[0].Name)
+	return ok
+}
+
+var sizeUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"kb":  1000,
+	"mb":  1000 * 1000,
+	"gb":  1000 * 1000 * 1000,
+	"tb":  1000 * 1000 * 1000 * 1000,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+}
+
+// parseSize parses a size in bytes, with an optional unit (KB, MB, GB and TB are powers of 1000, KiB, MiB, GiB and TiB of 1024)
+func parseSize(size string) (int64, error) {
+	size = strings.TrimSpace(size)
+	number := strings.TrimRightFunc(size, func(r rune) bool { return r < '0' || r > '9' })
+	unit := strings.ToLower(strings.TrimSpace(size[len(number):]))
+	multiplier, ok := sizeUnits[unit]
+	if !ok || number == "" {
+		return 0, fmt.Errorf("%q is not a size, expected a number of bytes with an optional unit like MB, GB, MiB or GiB", size)
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a size: %w", size, err)
+	}
+	bytes := value * float64(multiplier)
+	if bytes >= math.MaxInt64 {
+		return 0, fmt.Errorf("%q is too large", size)
+	}
+	return int64(bytes), nil
+}
+
+/*
+volumeWriter writes an archive as volumes of at most size bytes
+
+A volume shows up in its destination as soon as it is full, so Abort removes the volumes that were already finished
+along with the one that is being written.
+*/
+type volumeWriter struct {
+	dest     Destination
+	name     string
+	size     int64
+	current  ArchiveWriter
+	written  int64    // To the current volume
+	finished []string // Volumes that were closed
+	names    []string // Every volume that was started
+}
+
+// createVolumes starts writing an archive as volumes, the first volume is created straight away
+func createVolumes(dest Destination, name string, size int64) (*volumeWriter, error) {
+	v := &volumeWriter{dest: dest, name: name, size: size}
+	return v, v.next()
+}
+
+// next finishes the current volume and starts the next one
+func (v *volumeWriter) next() error {
+	if v.current != nil {
+		current := v.current
+		v.current = nil
+		err := current.Close()
+		if err != nil {
+			return err
+		}
+		v.finished = append(v.finished, v.names[len(v.names)-1])
+	}
+	name := volumeName(v.name, len(v.names))
+	writer, err := v.dest.Create(name)
+	if err != nil {
+		return err
+	}
+	v.current, v.written, v.names = writer, 0, append(v.names, name)
+	return nil
+}
+
+func (v *volumeWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		if v.current == nil {
+			return total, errors.New("the previous volume failed")
+		}
+		if v.written == v.size {
+			err := v.next()
+			if err != nil {
+				return total, err
+			}
+		}
+		n, err := v.current.Write(p[:minInt64(int64(len(p)), v.size-v.written)])
+		total += n
+		v.written += int64(n)
+		p = p[n:]
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (v *volumeWriter) Close() error {
+	if v.current == nil {
+		return errors.New("the previous volume failed")
+	}
+	current := v.current
+	v.current = nil
+	err := current.Close()
+	if err == nil {
+		v.finished = append(v.finished, v.names[len(v.names)-1])
+	}
+	return err
+}
+
+func (v *volumeWriter) Abort() error {
+	var errs []error
+	if v.current != nil {
+		errs = append(errs, v.current.Abort())
+		v.current = nil
+	}
+	for _, name := range v.finished {
+		errs = append(errs, v.dest.Delete(name))
+	}
+	return errors.Join(errs...)
+}
+
+// createArchive starts writing an archive to a destination, as volumes when volumeSize is set
+func createArchive(dest Destination, name string, volumeSize int64) (ArchiveWriter, error) {
+	if volumeSize > 0 {
+		return createVolumes(dest, name, volumeSize)
+	}
+	return dest.Create(name)
+}
+
+// savedSize returns the size of an archive that writer has finished writing, according to the destination
+func savedSize(dest Destination, name string, writer ArchiveWriter) (int64, error) {
+	volumes, ok := writer.(*volumeWriter)
+	if !ok {
+		info, err := dest.Stat(name)
+		return info.Size, err
+	}
+	var size int64
+	for _, volume := range volumes.names {
+		info, err := dest.Stat(volume)
+		if err != nil {
+			return 0, err
+		}
+		size += info.Size
+	}
+	return size, nil
+}
+
+/*
+openArchive opens an archive in a destination for reading, a volume set is read as one archive
+
+ListArchives decides what is a volume set, so archive has to come from it.
+*/
+func openArchive(dest Destination, archive ArchiveInfo) (io.ReadCloser, error) {
+	if !isVolumeSet(archive) {
+		return dest.Open(archive.Name)
+	}
+	for i, part := range archive.Parts {
+		if _, index, _ := splitVolume(part.Name); index != i {
+			return nil, fmt.Errorf("volume %d is missing", i+1)
+		}
+	}
+	return &volumeReader{dest: dest, parts: archive.Parts}, nil
+}
+
+// volumeReader reads the volumes of an archive one after the other
+type volumeReader struct {
+	dest    Destination
+	parts   []ArchiveInfo
+	current io.ReadCloser
+}
+
+func (v *volumeReader) Read(p []byte) (int, error) {
+	for {
+		if v.current == nil {
+			if len(v.parts) == 0 {
+				return 0, io.EOF
+			}
+			reader, err := v.dest.Open(v.parts[0].Name)
+			if err != nil {
+				return 0, err
+			}
+			v.current, v.parts = reader, v.parts[1:]
+		}
+		n, err := v.current.Read(p)
+		if err == io.EOF {
+			v.current.Close()
+			v.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (v *volumeReader) Close() error {
+	if v.current != nil {
+		return v.current.Close()
+	}
+	return nil
+}
+
+/*
+replaceArchive replaces an archive in a destination with the contents of a local file
+
+A volume set is written back as volumes of the size of its largest volume (which is what maxVolumeSize was,
+unless there is only one volume). The names of the files that were written are returned.
+*/
+func replaceArchive(dest Destination, archive ArchiveInfo, file *io.SectionReader) ([]string, error) {
+	if !isVolumeSet(archive) {
+		err := dest.Delete(archive.Name)
+		if err != nil {
+			return nil, err
+		}
+		return []string{archive.Name}, upload(dest, archive.Name, file)
+	}
+
+	volumeSize := int64(1)
+	for _, part := range archive.Parts {
+		volumeSize = maxInt64(volumeSize, part.Size)
+		err := dest.Delete(part.Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var names []string
+	for i := 0; int64(i)*volumeSize < file.Size() || i == 0; i++ {
+		offset := int64(i) * volumeSize
+		names = append(names, volumeName(archive.Name, i))
+		err := upload(dest, names[i], io.NewSectionReader(file, offset, minInt64(volumeSize, file.Size()-offset)))
+		if err != nil {
+			return names, err
+		}
+	}
+	return names, nil
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		size    string
+		want    int64
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"1048576", 1 << 20, false},
+		{"100B", 100, false},
+		{"4KB", 4000, false},
+		{"4KiB", 4096, false},
+		{"4095MiB", 4095 << 20, false},
+		{"4095 MiB", 4095 << 20, false},
+		{" 2gb ", 2000 * 1000 * 1000, false},
+		{"1.5GiB", 3 << 29, false},
+		{"1TiB", 1 << 40, false},
+		{"1TB", 1000 * 1000 * 1000 * 1000, false},
+		{"", 0, true},
+		{"MB", 0, true},
+		{"4 MiBs", 0, true},
+		{"4PB", 0, true},
+		{"1.2.3MB", 0, true},
+		{"ten MB", 0, true},
+		{"10000000TiB", 0, true}, // More than fits in an int64
+	}
+	for _, test := range tests {
+		got, err := parseSize(test.size)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseSize(%q) = %d, expected an error", test.size, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSize(%q): %s", test.size, err)
+		} else if got != test.want {
+			t.Errorf("parseSize(%q) = %d, expected %d", test.size, got, test.want)
+		}
+	}
+}
+
+func TestSplitVolume(t *testing.T) {
+	for _, index := range []int{0, 1, 998, 999, 1500} {
+		name := volumeName("2024.tar.gz", index)
+		archive, got, ok := splitVolume(name)
+		if !ok || archive != "2024.tar.gz" || got != index {
+			t.Errorf("splitVolume(%q) = %q, %d, %v", name, archive, got, ok)
+		}
+	}
+	for _, name := range []string{"2024.tar.gz", "2024.tar.gz.part1", "2024.tar.gz.part000", "2024.tar.gz.part001.recovery"} {
+		if _, _, ok := splitVolume(name); ok {
+			t.Errorf("%q was taken for a volume", name)
+		}
+	}
+}
+
+func TestVolumeWriter(t *testing.T) {
+	const name = "2024-01-02T03-04-05Z.tar"
+	tests := []struct {
+		size  int
+		sizes []int64 // Of the volumes
+	}{
+		{0, []int64{0}},
+		{999, []int64{999}},
+		{1000, []int64{1000}},
+		{1001, []int64{1000, 1}},
+		{3500, []int64{1000, 1000, 1000, 500}},
+	}
+	for _, test := range tests {
+		dest := newLocalDestination(t, nil)
+		data := randomBytes(t, test.size)
+		writer, err := createArchive(dest, name, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rest := data; len(rest) > 0; rest = rest[minInt(len(rest), 300):] { // Writes that cross volumes
+			_, err := writer.Write(rest[:minInt(len(rest), 300)])
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = writer.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		size, err := savedSize(dest, name, writer)
+		if err != nil || size != int64(test.size) {
+			t.Errorf("%d bytes: savedSize gave %d, %v", test.size, size, err)
+		}
+
+		archives, err := ListArchives(Vault{Name: "notes"}, dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(archives) != 1 || !isVolumeSet(archives[0]) || archives[0].Size != int64(test.size) {
+			t.Fatalf("%d bytes: ListArchives gave %+v", test.size, archives)
+		}
+		var sizes []int64
+		for _, part := range archives[0].Parts {
+			sizes = append(sizes, part.Size)
+		}
+		if !reflect.DeepEqual(sizes, test.sizes) {
+			t.Errorf("%d bytes: the volumes are %v, expected %v", test.size, sizes, test.sizes)
+		}
+
+		reader, err := openArchive(dest, archives[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: read back %d bytes, %v", test.size, len(got), err)
+		}
+	}
+}
+
+func TestVolumeWriterAbort(t *testing.T) {
+	dest := newLocalDestination(t, nil)
+	writer, err := createArchive(dest, "2024-01-02T03-04-05Z.tar", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = writer.Write(randomBytes(t, 2500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.Abort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := readFiles(t, dest); len(files) != 0 {
+		t.Errorf("Abort left %v", sortedKeys(files))
+	}
+}
@@ -0,0 +1,245 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+/*
+Watching vaults for changes
+
+WatchVaults archives a vault once it has gone watch.quiet without changes after it changed, so a burst of edits (like
+a note that is saved every few seconds) ends up in a single archive, taken once the burst is over. A vault is archived
+at most once every watch.minInterval, changes made sooner than that are archived once it has passed.
+
+Changes are picked up with inotify on Linux, which takes a watch for every directory in a vault. Vaults that can't be
+watched that way (on other systems, or once fs.inotify.max_user_watches runs out) are polled instead: the vault is
+listed the way skipUnchanged lists it (see makeManifest), and compared to the listing from the last poll.
+
+Before a vault is archived, its listing is compared to the one from when it was last archived, and it is only archived
+when they differ. So changes that would make no difference to the archive (to files that are excluded, or that
+.gitignore ignores in a git vault, or that were undone) don't lead to a new one.
+*/
+
+// Defaults for the watch settings
+const (
+	DefaultWatchQuiet       = 5 * time.Minute
+	DefaultWatchMinInterval = time.Hour
+)
+
+// maxPollInterval is how long a vault that is polled goes between polls at most, with a short quiet they are polled more often
+const maxPollInterval = time.Minute
+
+// changeWatcher reports changes to the vaults it watches, by their index in the vaults given to WatchVaults
+type changeWatcher interface {
+	changes() <-chan int
+	Close() error
+}
+
+// watchedVault is the state of a vault that WatchVaults looks after
+type watchedVault struct {
+	vault       Vault
+	quiet       time.Duration
+	minInterval time.Duration
+	changed     time.Time // When the last change that hasn't been archived yet was seen, zero when there is none
+	archived    time.Time // When the vault was last archived
+	listing     []byte    // The vault's listing when it was last archived
+	polled      []byte    // The vault's listing when it was last polled, nil when it is watched with inotify
+	nextPoll    time.Time
+	running     bool
+}
+
+// watchRun is how archiving a vault went
+type watchRun struct {
+	index    int
+	listing  []byte
+	archived bool // A new archive was made
+	failed   bool
+	at       time.Time
+}
+
+/*
+WatchVaults watches vaults for changes until ctx is done, and calls archive for a vault once it has been quiet for
+watch.quiet after a change (and watch.minInterval has passed since its last archive), see above
+
+archive reports whether the vault is archived as it is now. When it isn't, the vault is tried again once another
+watch.quiet has passed. Vaults are archived in the background, so one doesn't hold up the others. Once ctx is done,
+WatchVaults waits for the archives that are running to finish.
+
+Every vault has to have a path, command vaults have nothing to watch.
+*/
+func WatchVaults(ctx context.Context, vaults []Vault, archive func(Vault) bool) error {
+	watched := make([]*watchedVault, len(vaults))
+	for i, vault := range vaults {
+		w := &watchedVault{vault: vault, quiet: DefaultWatchQuiet, minInterval: DefaultWatchMinInterval}
+		if vault.Watch.Quiet != "" {
+			w.quiet, _ = time.ParseDuration(vault.Watch.Quiet) // LoadConfig checks these
+		}
+		if vault.Watch.MinInterval != "" {
+			w.minInterval, _ = time.ParseDuration(vault.Watch.MinInterval)
+		}
+		w.archived = lastArchived(vault)
+		listing, err := listVault(vault)
+		if err != nil {
+			return err
+		}
+		w.listing = listing
+		watched[i] = w
+	}
+
+	notify, polled := newNotifyWatcher(vaults)
+	var changes <-chan int
+	if notify != nil {
+		defer notify.Close()
+		changes = notify.changes()
+	}
+	for _, i := range polled {
+		watched[i].polled = watched[i].listing
+	}
+
+	done := make(chan watchRun)
+	running := 0
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			for ; running > 0; running-- {
+				<-done
+			}
+			return nil
+
+		case i := <-changes:
+			watched[i].changed = time.Now()
+
+		case run := <-done:
+			running--
+			watched[run.index].finish(run)
+
+		case now := <-ticker.C:
+			for i, w := range watched {
+				if w.polled != nil && !now.Before(w.nextPoll) {
+					w.poll(now)
+				}
+				if !w.start(now) {
+					continue
+				}
+				running++
+				go func(i int, vault Vault, listing []byte) {
+					done <- archiveChanged(i, vault, listing, archive)
+				}(i, w.vault, w.listing)
+			}
+		}
+	}
+}
+
+// start reports whether the vault is due to be archived at now, and marks it as running when it is
+func (w *watchedVault) start(now time.Time) bool {
+	if w.changed.IsZero() || w.running || now.Before(w.changed.Add(w.quiet)) || now.Before(w.archived.Add(w.minInterval)) {
+		return false
+	}
+	w.changed = time.Time{}
+	w.running = true
+	return true
+}
+
+// finish notes how archiving the vault went
+func (w *watchedVault) finish(run watchRun) {
+	w.running = false
+	w.listing = run.listing
+	if run.archived {
+		w.archived = run.at
+	}
+	if run.failed && w.changed.IsZero() {
+		w.changed = run.at // Tried again after another quiet period
+	}
+}
+
+// poll lists a vault that isn't watched with inotify, and notes a change when the listing differs from the last one
+func (w *watchedVault) poll(now time.Time) {
+	w.nextPoll = now.Add(minDuration(maxDuration(w.quiet/2, time.Second), maxPollInterval))
+	listing, err := listVault(w.vault)
+	if err != nil {
+		log.Printf("[watch] %s", err)
+		return
+	}
+	if !bytes.Equal(listing, w.polled) {
+		w.polled = listing
+		w.changed = now
+	}
+}
+
+// archiveChanged archives a vault when its listing differs from the one it was last archived with
+func archiveChanged(i int, vault Vault, listing []byte, archive func(Vault) bool) watchRun {
+	run := watchRun{index: i, listing: listing}
+	current, err := listVault(vault)
+	if err != nil {
+		log.Printf("[watch] %s", err)
+		run.failed, run.at = true, time.Now()
+		return run
+	}
+	if bytes.Equal(current, listing) {
+		return run // Nothing that would end up in the archive changed
+	}
+	ok := archive(vault)
+	run.at = time.Now()
+	if ok {
+		run.listing, run.archived = current, true
+	} else {
+		run.failed = true
+	}
+	return run
+}
+
+// listVault lists a vault's files the way skipUnchanged does, without hashing them
+func listVault(vault Vault) ([]byte, error) {
+	vault.SkipUnchanged = SkipMetadata
+	listing, err := makeManifest(vault)
+	if err != nil {
+		return nil, fmt.Errorf("listing %s: %w", vault.Name, err)
+	}
+	return listing, nil
+}
+
+// lastArchived returns when the vault's newest archive was made, in any of its destinations, or the zero time when there is none
+func lastArchived(vault Vault) time.Time {
+	var last time.Time
+	for _, target := range vault.Destinations {
+		dest, err := OpenDestination(target.Destination, vault.Name)
+		if err != nil {
+			continue
+		}
+		archives, err := ListArchives(vault, dest)
+		dest.Close()
+		if err == nil && len(archives) > 0 && archives[len(archives)-1].ModTime.After(last) {
+			last = archives[len(archives)-1].ModTime
+		}
+	}
+	return last
+}
+
+// allVaults returns the index of every one of n vaults
+func allVaults(n int) []int {
+	indexes := make([]int, n)
+	for i := range indexes {
+		indexes[i] = i
+	}
+	return indexes
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
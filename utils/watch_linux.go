@@ -0,0 +1,173 @@
+//go:build linux
+
+package utils
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// inotifyMask is the events that count as a change to a directory in a vault
+const inotifyMask = syscall.IN_MODIFY | syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_DELETE_SELF | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_MOVE_SELF | syscall.IN_ONLYDIR
+
+// inotifyWatcher watches every directory of the vaults with a single inotify instance
+type inotifyWatcher struct {
+	fd     int
+	file   *os.File // The same descriptor, so that reads can be interrupted by closing it
+	vaults []Vault
+	roots  []string           // The directory each vault is archived from, with its symlink followed
+	dirs   map[int]watchedDir // By watch descriptor, only used by read once it has started
+	out    chan int
+	done   chan struct{}
+}
+
+type watchedDir struct {
+	vault int
+	path  string
+}
+
+/*
+newNotifyWatcher watches the vaults with inotify, and returns the indexes of the ones it couldn't watch, which have to
+be polled
+
+A vault can't be watched when one of its directories can't be, usually because fs.inotify.max_user_watches ran out.
+*/
+func newNotifyWatcher(vaults []Vault) (changeWatcher, []int) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		log.Printf("[watch] inotify isn't available (%s), polling every vault instead", err)
+		return nil, allVaults(len(vaults))
+	}
+	w := &inotifyWatcher{
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		vaults: vaults,
+		roots:  make([]string, len(vaults)),
+		dirs:   make(map[int]watchedDir),
+		out:    make(chan int),
+		done:   make(chan struct{}),
+	}
+	var polled []int
+	for i, vault := range vaults {
+		w.roots[i] = vault.Path
+		if target, err := os.Readlink(vault.Path); err == nil {
+			w.roots[i] = target // tarArchive follows it as well
+		}
+		err := w.addTree(i, w.roots[i])
+		if err != nil {
+			log.Printf("[watch] %s can't be watched with inotify (%s), polling it instead", vault.Name, err)
+			polled = append(polled, i)
+		}
+	}
+	go w.read()
+	return w, polled
+}
+
+// addTree watches a directory of a vault and every directory in it, except the excluded ones
+func (w *inotifyWatcher) addTree(vault int, dir string) error {
+	root := w.roots[vault]
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path != dir && os.IsNotExist(err) {
+				return nil // Removed since the directory it is in was read
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if path != root && isExcluded(path, root, w.vaults[vault].Exclude) {
+			return filepath.SkipDir
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, path, inotifyMask)
+		if errors.Is(err, syscall.ENOSPC) {
+			return errors.New("out of inotify watches, raise fs.inotify.max_user_watches")
+		}
+		if err != nil {
+			return err
+		}
+		w.dirs[wd] = watchedDir{vault, path}
+		return nil
+	})
+}
+
+// read reads events until the watcher is closed, and passes on which vaults changed
+func (w *inotifyWatcher) read() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			select {
+			case <-w.done:
+			default:
+				log.Printf("[watch] reading inotify events: %s", err)
+			}
+			return
+		}
+
+		changed := make(map[int]bool)
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			offset = start + int(event.Len)
+			name := strings.TrimRight(string(buf[start:offset]), "\x00")
+			w.handle(int(event.Wd), event.Mask, name, changed)
+		}
+		for vault := range changed {
+			select {
+			case w.out <- vault:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+// handle notes which vault an event is for in changed, and starts watching directories that are added to a vault
+func (w *inotifyWatcher) handle(wd int, mask uint32, name string, changed map[int]bool) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		for i := range w.vaults {
+			changed[i] = true // Events were lost, so anything could have changed
+		}
+		return
+	}
+	dir, ok := w.dirs[wd]
+	if !ok {
+		return
+	}
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.dirs, wd) // The directory is gone, the event for that went to the directory it was in
+		return
+	}
+
+	path := dir.path
+	if name != "" {
+		path = filepath.Join(dir.path, name)
+	}
+	root := w.roots[dir.vault]
+	if path != root && isExcluded(path, root, w.vaults[dir.vault].Exclude) {
+		return
+	}
+	if mask&syscall.IN_ISDIR != 0 && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		err := w.addTree(dir.vault, path)
+		if err != nil {
+			log.Printf("[watch] %s: %s won't be watched: %s", w.vaults[dir.vault].Name, path, err)
+		}
+	}
+	changed[dir.vault] = true
+}
+
+func (w *inotifyWatcher) changes() <-chan int {
+	return w.out
+}
+
+func (w *inotifyWatcher) Close() error {
+	close(w.done)
+	return w.file.Close()
+}
@@ -0,0 +1,62 @@
+//go:build linux
+
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// nextChange waits a while for the watcher to report a vault, and returns -1 when it doesn't
+func nextChange(w changeWatcher, wait time.Duration) int {
+	select {
+	case i := <-w.changes():
+		return i
+	case <-time.After(wait):
+		return -1
+	}
+}
+
+func TestInotifyWatcher(t *testing.T) {
+	dirs := []string{t.TempDir(), t.TempDir()}
+	writeVault(t, dirs[1], map[string]string{"notes.md": "notes", "cache/index": "cache"})
+	vaults := []Vault{
+		{Name: "first", Path: dirs[0]},
+		{Name: "second", Path: dirs[1], Settings: Settings{Exclude: []string{"cache"}}},
+	}
+	w, polled := newNotifyWatcher(vaults)
+	if w == nil || len(polled) != 0 {
+		t.Skipf("inotify can't watch the vaults, %v are polled", polled)
+	}
+	defer w.Close()
+
+	steps := []struct {
+		name  string
+		write func() error
+		vault int // That changed, -1 for none
+	}{
+		{"excluded file", func() error { return os.WriteFile(filepath.Join(dirs[1], "cache/index"), []byte("other"), 0o644) }, -1},
+		{"file", func() error { return os.WriteFile(filepath.Join(dirs[1], "notes.md"), []byte("new notes"), 0o644) }, 1},
+		{"new directory", func() error { return os.Mkdir(filepath.Join(dirs[0], "sub"), 0o755) }, 0},
+		{"file in the new directory", func() error { return os.WriteFile(filepath.Join(dirs[0], "sub/todo.md"), []byte("todo"), 0o644) }, 0},
+		{"removed directory", func() error { return os.RemoveAll(filepath.Join(dirs[0], "sub")) }, 0},
+	}
+	for _, step := range steps {
+		err := step.write()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wait := 5 * time.Second
+		if step.vault < 0 {
+			wait = 200 * time.Millisecond
+		}
+		if got := nextChange(w, wait); got != step.vault {
+			t.Fatalf("%s: vault %d changed, expected %d", step.name, got, step.vault)
+		}
+		for nextChange(w, 100*time.Millisecond) >= 0 {
+			// More events for the same change
+		}
+	}
+}
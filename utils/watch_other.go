@@ -0,0 +1,8 @@
+//go:build !linux
+
+package utils
+
+// newNotifyWatcher returns no watcher where inotify isn't available, so every vault is polled
+func newNotifyWatcher(vaults []Vault) (changeWatcher, []int) {
+	return nil, allVaults(len(vaults))
+}
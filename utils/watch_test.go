@@ -0,0 +1,163 @@
+package utils
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+/*
+simulateWatch runs a vault through WatchVaults' loop a second at a time until until, with changes seen at the offsets
+in changes, and returns the offsets at which it was archived
+
+Archiving takes took, and the first fail of them fail.
+*/
+func simulateWatch(w *watchedVault, start time.Time, changes []time.Duration, took time.Duration, fail int, until time.Duration) []time.Duration {
+	var started []time.Duration
+	var finishAt time.Duration
+	finish := func(now time.Time) {
+		failed := len(started) <= fail
+		w.finish(watchRun{listing: w.listing, archived: !failed, failed: failed, at: now})
+	}
+	for d := time.Duration(0); d <= until; d += time.Second {
+		now := start.Add(d)
+		if w.running && d == finishAt {
+			finish(now)
+		}
+		for _, change := range changes {
+			if change == d {
+				w.changed = now
+			}
+		}
+		if w.start(now) {
+			started = append(started, d)
+			finishAt = d + took
+			if took == 0 {
+				finish(now)
+			}
+		}
+	}
+	return started
+}
+
+func TestWatchDebounce(t *testing.T) {
+	start := time.Date(2024, 5, 15, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		minInterval time.Duration
+		archived    time.Duration // Before start
+		changes     []time.Duration
+		took        time.Duration
+		fail        int
+		want        []time.Duration
+	}{
+		{"no changes", time.Hour, 2 * time.Hour, nil, 0, 0, nil},
+		{"one change", time.Hour, 2 * time.Hour, []time.Duration{0}, 0, 0, []time.Duration{5 * time.Minute}},
+		{"a burst", time.Hour, 2 * time.Hour, []time.Duration{0, 2 * time.Minute, 4 * time.Minute, 6 * time.Minute}, 0, 0, []time.Duration{11 * time.Minute}},
+		{"never archived", time.Hour, -1, []time.Duration{0}, 0, 0, []time.Duration{5 * time.Minute}},
+		{"archived recently", time.Hour, 50 * time.Minute, []time.Duration{0}, 0, 0, []time.Duration{10 * time.Minute}},
+		{"two bursts", time.Hour, 2 * time.Hour, []time.Duration{0, 10 * time.Minute}, 0, 0, []time.Duration{5 * time.Minute, 65 * time.Minute}},
+		{"no minimum interval", 0, 2 * time.Hour, []time.Duration{0, 10 * time.Minute}, 0, 0, []time.Duration{5 * time.Minute, 15 * time.Minute}},
+		{"failed", time.Hour, 2 * time.Hour, []time.Duration{0}, 0, 1, []time.Duration{5 * time.Minute, 10 * time.Minute}},
+		{"failed twice", time.Hour, 2 * time.Hour, []time.Duration{0}, 0, 2, []time.Duration{5 * time.Minute, 10 * time.Minute, 15 * time.Minute}},
+		{"changed while archiving", time.Hour, 2 * time.Hour, []time.Duration{0, 6 * time.Minute}, 3 * time.Minute, 0, []time.Duration{5 * time.Minute, 68 * time.Minute}},
+		{"changed while failing", time.Hour, 2 * time.Hour, []time.Duration{0, 6 * time.Minute}, 3 * time.Minute, 1, []time.Duration{5 * time.Minute, 11 * time.Minute}},
+	}
+	for _, test := range tests {
+		w := &watchedVault{quiet: 5 * time.Minute, minInterval: test.minInterval}
+		if test.archived >= 0 {
+			w.archived = start.Add(-test.archived)
+		}
+		got := simulateWatch(w, start, test.changes, test.took, test.fail, 2*time.Hour)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: archived at %v, expected %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWatchPoll(t *testing.T) {
+	now := time.Date(2024, 5, 15, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		quiet    time.Duration
+		interval time.Duration
+	}{
+		{5 * time.Minute, maxPollInterval},
+		{time.Minute, 30 * time.Second},
+		{30 * time.Second, 15 * time.Second},
+		{time.Second, time.Second},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		writeVault(t, dir, map[string]string{"notes.md": "notes", "cache/index": "cache"})
+		vault := Vault{Name: "notes", Path: dir, Settings: Settings{Format: FormatTarGz, Exclude: []string{"cache"}}}
+		listing, err := listVault(vault)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := &watchedVault{vault: vault, quiet: test.quiet, listing: listing, polled: listing}
+
+		w.poll(now)
+		if !w.changed.IsZero() {
+			t.Errorf("quiet %s: a change was seen in a vault that didn't change", test.quiet)
+		}
+		if w.nextPoll != now.Add(test.interval) {
+			t.Errorf("quiet %s: polled again after %s, expected %s", test.quiet, w.nextPoll.Sub(now), test.interval)
+		}
+
+		writeVault(t, dir, map[string]string{"cache/index": "other"})
+		w.poll(now.Add(time.Second))
+		if !w.changed.IsZero() {
+			t.Errorf("quiet %s: a change to an excluded file was seen", test.quiet)
+		}
+		writeVault(t, dir, map[string]string{"notes.md": "new notes"})
+		w.poll(now.Add(2 * time.Second))
+		if w.changed != now.Add(2*time.Second) {
+			t.Errorf("quiet %s: the change was seen at %v", test.quiet, w.changed)
+		}
+		if !bytes.Equal(w.listing, listing) {
+			t.Errorf("quiet %s: polling changed the listing the vault was archived with", test.quiet)
+		}
+	}
+}
+
+func TestArchiveChanged(t *testing.T) {
+	tests := []struct {
+		name     string
+		change   map[string]string
+		ok       bool // What archive returns
+		archived bool
+		failed   bool
+	}{
+		{"unchanged", nil, true, false, false},
+		{"excluded file", map[string]string{"cache/index": "other"}, true, false, false},
+		{"changed", map[string]string{"notes.md": "new notes"}, true, true, false},
+		{"failed", map[string]string{"notes.md": "new notes"}, false, false, true},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		writeVault(t, dir, map[string]string{"notes.md": "notes", "cache/index": "cache"})
+		vault := Vault{Name: "notes", Path: dir, Settings: Settings{Format: FormatTarGz, Exclude: []string{"cache"}}}
+		listing, err := listVault(vault)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeVault(t, dir, test.change)
+
+		called := false
+		run := archiveChanged(3, vault, listing, func(Vault) bool {
+			called = true
+			return test.ok
+		})
+		if called != (test.archived || test.failed) {
+			t.Errorf("%s: archive was called is %v", test.name, called)
+		}
+		if run.index != 3 || run.archived != test.archived || run.failed != test.failed {
+			t.Errorf("%s: archiveChanged gave %+v", test.name, run)
+		}
+		// The next run compares the vault to the listing it was last archived with
+		if bytes.Equal(run.listing, listing) == test.archived {
+			t.Errorf("%s: the listing changed is %v, expected %v", test.name, !test.archived, test.archived)
+		}
+	}
+}
@@ -0,0 +1,431 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeWebDAV is a WebDAV server that keeps its files in memory, and assembles Nextcloud chunked uploads
+type fakeWebDAV struct {
+	server *httptest.Server
+
+	mu          sync.Mutex
+	files       map[string][]byte
+	collections map[string]bool
+	log         []string // The requests that were made, with the ids of chunked uploads replaced by ID
+	failAt      string   // A request from the log that fails with 507 Insufficient Storage
+	stall       time.Duration
+}
+
+var uploadID = regexp.MustCompile(`go-archive-it-[0-9a-f]{32}`)
+
+// newFakeWebDAV starts a server with the collections that Nextcloud has for alice
+func newFakeWebDAV(t *testing.T) *fakeWebDAV {
+	f := &fakeWebDAV{files: map[string][]byte{}, collections: map[string]bool{"/": true}}
+	for _, dir := range []string{"/remote.php/dav/files/alice", "/remote.php/dav/uploads/alice", "/dav"} {
+		for ; dir != "/"; dir = path.Dir(dir) {
+			f.collections[dir] = true
+		}
+	}
+	f.server = httptest.NewServer(f)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// open opens a destination for the notes vault at a path on the server
+func (f *fakeWebDAV) open(t *testing.T, p string) *webdavDestination {
+	u, err := url.Parse("webdav://alice:secret@" + f.server.Listener.Addr().String() + p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := newWebDAVDestination(u, "notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func (f *fakeWebDAV) requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.log...)
+}
+
+func (f *fakeWebDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+	p := path.Clean(r.URL.Path)
+	request := r.Method + " " + uploadID.ReplaceAllString(p, "go-archive-it-ID")
+	if r.Method == http.MethodPut && r.ContentLength == -1 {
+		request += " (streamed)"
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.log = append(f.log, request)
+	if user, password, ok := r.BasicAuth(); !ok || user != "alice" || password != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if request == f.failAt {
+		w.WriteHeader(http.StatusInsufficientStorage)
+		fmt.Fprint(w, `<?xml version="1.0"?><d:error xmlns:d="DAV:" xmlns:s="http://sabredav.org/ns"><s:message>Not enough space</s:message></d:error>`)
+		return
+	}
+	// Nextcloud needs to know where a chunked upload is going from the start
+	if strings.HasPrefix(p, "/remote.php/dav/uploads/") && r.Method != http.MethodDelete && r.Header.Get("Destination") == "" {
+		http.Error(w, "no Destination", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "MKCOL":
+		switch {
+		case f.collections[p] || f.files[p] != nil:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case !f.collections[path.Dir(p)]:
+			w.WriteHeader(http.StatusConflict)
+		default:
+			f.collections[p] = true
+			w.WriteHeader(http.StatusCreated)
+		}
+
+	case http.MethodPut:
+		if !f.collections[path.Dir(p)] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.files[p] = body
+		w.WriteHeader(http.StatusCreated)
+
+	case "MOVE":
+		f.move(w, r, p)
+
+	case http.MethodDelete:
+		if f.files[p] == nil && !f.collections[p] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.files, p)
+		delete(f.collections, p)
+		for name := range f.files {
+			if strings.HasPrefix(name, p+"/") {
+				delete(f.files, name)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodHead, http.MethodGet:
+		data := f.files[p]
+		if data == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", "Wed, 01 May 2024 09:30:15 GMT")
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.(http.Flusher).Flush()
+			f.mu.Unlock()
+			time.Sleep(f.stall)
+			f.mu.Lock()
+			w.Write(data)
+		}
+
+	case "PROPFIND":
+		f.propfind(w, r, p)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// move renames a file, or assembles the chunks of an upload when .file is moved
+func (f *fakeWebDAV) move(w http.ResponseWriter, r *http.Request, p string) {
+	destination, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || destination.Host != r.Host || r.Header.Get("Overwrite") != "F" {
+		http.Error(w, "bad MOVE", http.StatusBadRequest)
+		return
+	}
+	to := path.Clean(destination.Path)
+	if f.files[to] != nil {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	if !f.collections[path.Dir(to)] {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	if path.Base(p) == ".file" {
+		upload := path.Dir(p)
+		if !f.collections[upload] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var chunks []string
+		for name := range f.files {
+			if path.Dir(name) == upload {
+				chunks = append(chunks, name)
+			}
+		}
+		sort.Strings(chunks)
+		var data []byte
+		for i, chunk := range chunks {
+			if len(f.files[chunk]) < webdavMinChunkMiB<<20 && i < len(chunks)-1 { // Only the last chunk can be smaller
+				http.Error(w, "chunk too small", http.StatusBadRequest)
+				return
+			}
+			data = append(data, f.files[chunk]...)
+			delete(f.files, chunk)
+		}
+		delete(f.collections, upload)
+		if r.Header.Get("OC-Total-Length") != strconv.Itoa(len(data)) {
+			http.Error(w, "wrong OC-Total-Length", http.StatusBadRequest)
+			return
+		}
+		f.files[to] = data
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	if f.files[p] == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	f.files[to] = f.files[p]
+	delete(f.files, p)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// propfind lists a collection, with the 404 propstats real servers give for properties that collections don't have
+func (f *fakeWebDAV) propfind(w http.ResponseWriter, r *http.Request, p string) {
+	if r.Header.Get("Depth") != "1" {
+		http.Error(w, "only Depth: 1", http.StatusBadRequest)
+		return
+	}
+	if !f.collections[p] {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var out strings.Builder
+	out.WriteString(`<?xml version="1.0"?><d:multistatus xmlns:d="DAV:">`)
+	entry := func(name string, collection bool) {
+		href := (&url.URL{Path: name}).EscapedPath()
+		if collection {
+			fmt.Fprintf(&out, `<d:response><d:href>%s/</d:href><d:propstat><d:prop><d:resourcetype><d:collection/></d:resourcetype></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat>`, href)
+			out.WriteString(`<d:propstat><d:prop><d:getcontentlength/></d:prop><d:status>HTTP/1.1 404 Not Found</d:status></d:propstat></d:response>`)
+			return
+		}
+		fmt.Fprintf(&out, `<d:response><d:href>%s</d:href><d:propstat><d:prop><d:resourcetype/><d:getcontentlength>%d</d:getcontentlength>`, href, len(f.files[name]))
+		out.WriteString(`<d:getlastmodified>Wed, 01 May 2024 09:30:15 GMT</d:getlastmodified></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>`)
+	}
+	entry(p, true)
+	for name := range f.collections {
+		if name != p && path.Dir(name) == p {
+			entry(name, true)
+		}
+	}
+	for name := range f.files {
+		if path.Dir(name) == p {
+			entry(name, false)
+		}
+	}
+	out.WriteString(`</d:multistatus>`)
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, out.String())
+}
+
+func checkRequests(t *testing.T, f *fakeWebDAV, want []string) {
+	t.Helper()
+	got := f.requests()
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("the requests were\n  %s\nexpected\n  %s", strings.Join(got, "\n  "), strings.Join(want, "\n  "))
+	}
+}
+
+func TestWebDAVChunkedUpload(t *testing.T) {
+	f := newFakeWebDAV(t)
+	d := f.open(t, "/remote.php/dav/files/alice/backups?chunk-size=5")
+	if d.uploads != "/remote.php/dav/uploads/alice" {
+		t.Fatalf("chunked uploads go to %q", d.uploads)
+	}
+	f.collections["/remote.php/dav/files/alice/backups"] = true
+
+	data := randomBytes(t, 12<<20+7)
+	writeArchiveTo(t, d, "2024.tar", data)
+	upload := "/remote.php/dav/uploads/alice/go-archive-it-ID"
+	checkRequests(t, f, []string{
+		"MKCOL /remote.php/dav/files/alice/backups/notes",
+		"MKCOL " + upload,
+		"PUT " + upload + "/00001",
+		"PUT " + upload + "/00002",
+		"PUT " + upload + "/00003",
+		"MOVE " + upload + "/.file",
+	})
+	for name := range f.files {
+		if strings.HasPrefix(name, "/remote.php/dav/uploads/") {
+			t.Errorf("%s was left in the uploads collection", name)
+		}
+	}
+	checkRoundtrip(t, d, "2024.tar", data)
+}
+
+func TestWebDAVChunkedUploadFailureAborts(t *testing.T) {
+	f := newFakeWebDAV(t)
+	d := f.open(t, "/remote.php/dav/files/alice?chunk-size=5")
+	f.failAt = "PUT /remote.php/dav/uploads/alice/go-archive-it-ID/00002"
+
+	w, err := d.Create("2024.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write(randomBytes(t, 11<<20))
+	if err == nil || !strings.Contains(err.Error(), "Not enough space") {
+		t.Fatalf("Write gave %v, expected the server's message", err)
+	}
+	err = w.Abort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := f.requests()
+	if last := requests[len(requests)-1]; last != "DELETE /remote.php/dav/uploads/alice/go-archive-it-ID" {
+		t.Errorf("the upload wasn't deleted, the last request was %s", last)
+	}
+	if len(f.files) != 0 {
+		t.Errorf("files were left on the server: %v", sortedKeys(f.files))
+	}
+}
+
+func TestWebDAVSmallArchive(t *testing.T) {
+	f := newFakeWebDAV(t)
+	d := f.open(t, "/remote.php/dav/files/alice/backups")
+
+	data := []byte("a small archive")
+	writeArchiveTo(t, d, "2024.tar", data)
+	checkRequests(t, f, []string{
+		"MKCOL /remote.php/dav/files/alice/backups/notes", // The parent is missing
+		"MKCOL /remote.php/dav/files/alice/backups",
+		"MKCOL /remote.php/dav/files/alice/backups/notes",
+		"PUT /remote.php/dav/files/alice/backups/notes/.2024.tar.partial",
+		"MOVE /remote.php/dav/files/alice/backups/notes/.2024.tar.partial",
+	})
+
+	w, err := d.Create("2024.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("a different archive"))
+	if w.Close() == nil {
+		t.Error("an existing archive was replaced")
+	}
+	if f.files["/remote.php/dav/files/alice/backups/notes/.2024.tar.partial"] != nil {
+		t.Error("the temporary file was left after the MOVE failed")
+	}
+	checkRoundtrip(t, d, "2024.tar", data)
+}
+
+func TestWebDAVStreamedUpload(t *testing.T) {
+	f := newFakeWebDAV(t)
+	d := f.open(t, "/dav?chunk-size=1")
+	data := randomBytes(t, 3<<20+5)
+	writeArchiveTo(t, d, "2024.tar", data)
+	checkRequests(t, f, []string{
+		"MKCOL /dav/notes",
+		"PUT /dav/notes/.2024.tar.partial (streamed)",
+		"MOVE /dav/notes/.2024.tar.partial",
+	})
+	checkRoundtrip(t, d, "2024.tar", data)
+
+	f.failAt = "PUT /dav/notes/.2024.tar.partial (streamed)"
+	w, err := d.Create("2024.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write(data)
+	if err == nil {
+		err = w.Close()
+	} else {
+		w.Abort()
+	}
+	if err == nil {
+		t.Error("a failed PUT wasn't reported")
+	}
+	if len(f.files) != 0 {
+		t.Errorf("files were left on the server: %v", sortedKeys(f.files))
+	}
+}
+
+func TestWebDAVStalledServer(t *testing.T) {
+	timeout := httpStallTimeout
+	t.Cleanup(func() { httpStallTimeout = timeout })
+	httpStallTimeout = 200 * time.Millisecond
+
+	f := newFakeWebDAV(t)
+	d := f.open(t, "/dav")
+	writeArchiveTo(t, d, "2024.tar", []byte("archive"))
+	f.stall = time.Second
+
+	start := time.Now()
+	r, err := d.Open("2024.tar")
+	if err == nil {
+		_, err = io.ReadAll(r)
+		r.Close()
+	}
+	if err == nil || !strings.Contains(err.Error(), "stopped responding") {
+		t.Errorf("reading from a stalled server gave %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 800*time.Millisecond {
+		t.Errorf("it took %s to give up", elapsed)
+	}
+}
+
+func TestWebDAVChunkSize(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    int
+		wantErr bool
+	}{
+		{"/dav", webdavChunkSize, false},
+		{"/dav?chunk-size=1", 1 << 20, false},
+		{"/dav?chunk-size=0", 0, true},
+		{"/dav?chunk-size=big", 0, true},
+		{"/remote.php/dav/files/alice?chunk-size=5", 5 << 20, false},
+		{"/remote.php/dav/files/alice?chunk-size=4", 0, true},
+		{"/remote.php/dav/files/alice?chunk-size=4&chunked=false", 4 << 20, false},
+	}
+	for _, test := range tests {
+		u, err := url.Parse("webdavs://alice@cloud.example.com" + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := newWebDAVDestination(u, "notes")
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s was accepted", test.path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.path, err)
+		} else if d.chunkSize != test.want {
+			t.Errorf("%s: chunks of %d bytes, expected %d", test.path, d.chunkSize, test.want)
+		}
+	}
+}